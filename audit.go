@@ -0,0 +1,152 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditFlushInterval is the interval at which the buffered audit events are
+// written to AuditFile.
+const auditFlushInterval = time.Second
+
+// auditLog records every decision in AuditFile, when it is set.
+var auditLog auditor
+
+// auditEvent is a line of AuditFile.
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	QueueID    string    `json:"queue_id"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason"`
+	DMARC      string    `json:"dmarc"`
+	FromDomain string    `json:"from_domain"`
+	HeaderFrom string    `json:"header_from"`
+}
+
+// auditor appends events as JSON lines to a file opened in append-only mode.
+// The events are buffered, so that the decisions do not wait for the disk,
+// and written by flush.
+type auditor struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+// open closes the current file, if any, and opens the one at path to append
+// the next events to it. An empty path disables the auditor.
+func (a *auditor) open(path string) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.closeLocked()
+	a.path = path
+	a.f = f
+	if f != nil {
+		a.w = bufio.NewWriter(f)
+	}
+	return err
+}
+
+// reopen opens the file again at the same path, after it was rotated.
+func (a *auditor) reopen() error {
+	a.mu.Lock()
+	path := a.path
+	a.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	return a.open(path)
+}
+
+// add buffers the event, if the auditor is open.
+func (a *auditor) add(e auditEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return
+	}
+	a.w.Write(append(line, '\n'))
+}
+
+// flush writes the buffered events to the file.
+func (a *auditor) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return nil
+	}
+	return a.w.Flush()
+}
+
+// close flushes the buffered events and closes the file.
+func (a *auditor) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeLocked()
+}
+
+func (a *auditor) closeLocked() error {
+	if a.f == nil {
+		return nil
+	}
+	err := a.w.Flush()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f, a.w = nil, nil
+	return err
+}
+
+// flushAudit writes the buffered audit events, logging the failures.
+func flushAudit() {
+	if err := auditLog.flush(); err != nil {
+		l.Print("Failed to write AuditFile: ", err)
+	}
+}
+
+// flushAuditEvery writes the buffered audit events at the given interval,
+// until done is closed.
+func flushAuditEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flushAudit()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/club-1/dmarcator/miltertest"
+)
+
+// readAudit returns the events of the audit file at path.
+func readAudit(t *testing.T, path string) []auditEvent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("unexpected error decoding %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestAuditor(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "audit.log")
+	if err := os.WriteFile(path, []byte(`{"queue_id":"OLD"}`+"\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	var a auditor
+	if err := a.open(path); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	a.add(auditEvent{Time: now, QueueID: "A", Action: "reject"})
+	if events := readAudit(t, path); len(events) != 1 {
+		t.Errorf("expected the event to be buffered, got %#v", events)
+	}
+	if err := a.flush(); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected := []auditEvent{{QueueID: "OLD"}, {Time: now, QueueID: "A", Action: "reject"}}
+	if events := readAudit(t, path); !reflect.DeepEqual(expected, events) {
+		t.Errorf("expected %#v, got %#v", expected, events)
+	}
+
+	// rotation
+	a.add(auditEvent{Time: now, QueueID: "B", Action: "accept"})
+	rotated := filepath.Join(tmp, "audit.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.reopen(); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	a.add(auditEvent{Time: now, QueueID: "C", Action: "defer"})
+	if err := a.close(); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected = append(expected, auditEvent{Time: now, QueueID: "B", Action: "accept"})
+	if events := readAudit(t, rotated); !reflect.DeepEqual(expected, events) {
+		t.Errorf("expected %#v, got %#v", expected, events)
+	}
+	expected = []auditEvent{{Time: now, QueueID: "C", Action: "defer"}}
+	if events := readAudit(t, path); !reflect.DeepEqual(expected, events) {
+		t.Errorf("expected %#v, got %#v", expected, events)
+	}
+
+	// closed
+	a.add(auditEvent{QueueID: "D"})
+	if err := a.flush(); err != nil {
+		t.Error("unexpected error: ", err)
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Registered before the setup, to run once the server is stopped.
+	t.Cleanup(func() {
+		expected := []auditEvent{
+			{QueueID: "QUEUEID", Action: "reject", Reason: "domain-action", DMARC: "fail", FromDomain: "gmail.com", HeaderFrom: "Alice <alice@gmail.com>"},
+			{QueueID: "QUEUEID", Action: "accept", Reason: "pass", DMARC: "pass", FromDomain: "gmail.com", HeaderFrom: "bob@gmail.com"},
+		}
+		events := readAudit(t, path)
+		for i, e := range events {
+			if e.Time.IsZero() {
+				t.Errorf("expected a time in event %d", i)
+			}
+			events[i].Time = time.Time{}
+		}
+		if !reflect.DeepEqual(expected, events) {
+			t.Errorf("expected %#v, got %#v", expected, events)
+		}
+	})
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+AuditFile = "` + path + `"
+`
+	network, address, _ := setup(t, config)
+	for _, h := range [][]string{
+		{"From", "Alice <alice@gmail.com>", "Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"},
+		{"From", "bob@gmail.com", "Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com"},
+	} {
+		session := miltertest.Session(t, network, address)
+		miltertest.Headers(t, session, []string{"i", "QUEUEID"}, h...)
+	}
+}
@@ -0,0 +1,195 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// exampleControlURI is the example of a valid ControlListenURI given in the
+// error messages.
+const exampleControlURI = "unix:///run/dmarcator/control.sock"
+
+// controlDomain is an entry of the domains listed by the control API.
+type controlDomain struct {
+	Domain  string                `json:"domain"`
+	Action  Action                `json:"action"`
+	Results []authres.ResultValue `json:"results,omitempty"`
+	Tag     bool                  `json:"tag,omitempty"`
+	Log     bool                  `json:"log,omitempty"`
+}
+
+// newControlServer returns the server of the control API, meant to be only
+// reachable from the host, through a unix socket.
+func newControlServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/domains", serveDomains)
+	mux.HandleFunc("/reload", serveReload)
+	mux.HandleFunc("/evaluate", serveEvaluate)
+	if conf.RejectDomainsFile != "" {
+		mux.HandleFunc("/domains/reload", serveReloadDomains)
+	}
+	return &http.Server{Handler: mux}
+}
+
+// serveDomains writes the domains currently loaded, with their rule, sorted
+// by domain, as a JSON array.
+func serveDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domains := []controlDomain{}
+	domainActions().Each(func(domain string, rule dmarc.Rule) {
+		domains = append(domains, controlDomain{domain, rule.Action, rule.Results, rule.Tag, rule.Log})
+	})
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Domain < domains[j].Domain
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domains)
+}
+
+// controlReload is the response of the control API to a reload of
+// RejectDomainsFile.
+type controlReload struct {
+	Domains  int `json:"domains"`
+	Previous int `json:"previous"`
+}
+
+// serveReloadDomains reloads RejectDomainsFile, and writes the number of its
+// domains before and after as JSON.
+func serveReloadDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	before, after, err := loadDomainsFile()
+	if err != nil {
+		l.Printf("Failed to reload RejectDomainsFile, keeping the previous list: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.Printf("Reloaded RejectDomainsFile: %d domains, previously %d", after, before)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controlReload{after, before})
+}
+
+// serveReload writes the status of the last reload of the config as JSON, or
+// reloads it first on POST.
+func serveReload(w http.ResponseWriter, r *http.Request) {
+	var status reloadStatus
+	switch r.Method {
+	case http.MethodGet:
+		status = lastReload.Load().(reloadStatus)
+	case http.MethodPost:
+		status = reload()
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.Error != "" && r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// controlEvaluate is the request of the control API to evaluate a message.
+type controlEvaluate struct {
+	From     string              `json:"from"`
+	DMARC    authres.ResultValue `json:"dmarc"`
+	Authserv string              `json:"authserv"`
+}
+
+// controlEvaluation is the response of the control API to the evaluation of
+// a message.
+type controlEvaluation struct {
+	Action  string `json:"action"`
+	Reason  Reason `json:"reason"`
+	Domain  string `json:"domain"`
+	Reply   string `json:"reply,omitempty"`
+	Details string `json:"details"`
+}
+
+// maxEvaluateBody is the maximum size of the body of a request to evaluate a
+// message.
+const maxEvaluateBody = 64 << 10
+
+// serveEvaluate takes the decision for a message with the From header field
+// and the DMARC result of the JSON request, and writes it as JSON, without
+// logging, counting nor auditing it.
+func serveEvaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req controlEvaluate
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEvaluateBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.DMARC {
+	case "", authres.ResultNone, authres.ResultPass, authres.ResultFail, authres.ResultTempError, authres.ResultPermError:
+	default:
+		http.Error(w, fmt.Sprintf("invalid dmarc %q, must be none, pass, fail, temperror or permerror", req.DMARC), http.StatusBadRequest)
+		return
+	}
+
+	confMu.RLock()
+	defer confMu.RUnlock()
+	var fields []headerField
+	if req.From != "" {
+		fields = append(fields, headerField{"From", req.From})
+	}
+	if req.DMARC != "" {
+		authserv := req.Authserv
+		if authserv == "" {
+			authserv = conf.AuthservID
+		}
+		value := fmt.Sprintf("%s; dmarc=%s", authserv, req.DMARC)
+		if domain := dmarc.AddressDomain(req.From); domain != "" {
+			value += " header.from=" + domain
+		}
+		fields = append(fields, headerField{conf.AuthResHeaders[0], value})
+	}
+	d, details := dryEvaluate("evaluate", fields)
+	reply, _ := d.reply()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controlEvaluation{d.actions(), d.Reason, d.Domain, reply, details})
+}
+
+// serveControl serves the control server on ln until it is closed.
+func serveControl(srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		l.Fatal("Failed to serve control API: ", err)
+	}
+}
@@ -0,0 +1,359 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// controlClient returns an HTTP client connecting to the control API on the
+// unix socket sock.
+func controlClient(sock string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+}
+
+func TestControlDomains(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ControlListenURI = "unix://` + sock + `"
+RejectDomains = "gmail.com, Hotmail.fr"
+DomainActions = { "*.example.org" = "quarantine", "www.example.org" = "accept" }
+
+[[Domain]]
+name = "example.net"
+actions = ["tag", "quarantine"]
+results = ["none"]
+`
+	setup(t, config)
+	client := controlClient(sock)
+
+	resp, err := client.Get("http://localhost/domains")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	var domains []controlDomain
+	if err := json.NewDecoder(resp.Body).Decode(&domains); err != nil {
+		t.Fatal("unexpected error decoding domains: ", err)
+	}
+	expected := []controlDomain{
+		{Domain: "*.example.org", Action: ActionQuarantine},
+		{Domain: "example.net", Action: ActionQuarantine, Results: []authres.ResultValue{authres.ResultNone}, Tag: true},
+		{Domain: "gmail.com", Action: ActionReject},
+		{Domain: "hotmail.fr", Action: ActionReject},
+		{Domain: "www.example.org", Action: ActionAccept},
+	}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	resp, err = client.Post("http://localhost/domains", "application/json", nil)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestControlReloadDomains(t *testing.T) {
+	tmp := t.TempDir()
+	sock := filepath.Join(tmp, "control.sock")
+	file := filepath.Join(tmp, "blocklist.txt")
+	if err := os.WriteFile(file, []byte("gmail.com\nhotmail.fr # comment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ControlListenURI = "unix://` + sock + `"
+RejectDomainsFile = "` + file + `"
+DomainActions = { "gmail.com" = "tag" }
+`
+	_, _, out := setup(t, config)
+	client := controlClient(sock)
+
+	getDomains := func() []controlDomain {
+		t.Helper()
+		resp, err := client.Get("http://localhost/domains")
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		defer resp.Body.Close()
+		var domains []controlDomain
+		if err := json.NewDecoder(resp.Body).Decode(&domains); err != nil {
+			t.Fatal("unexpected error decoding domains: ", err)
+		}
+		return domains
+	}
+	expected := []controlDomain{
+		{Domain: "gmail.com", Action: ActionTag},
+		{Domain: "hotmail.fr", Action: ActionReject},
+	}
+	if domains := getDomains(); !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	if err := os.WriteFile(file, []byte("gmail.com\nyahoo.com\nexample.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post("http://localhost/domains/reload", "", nil)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	var reload controlReload
+	err = json.NewDecoder(resp.Body).Decode(&reload)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected error decoding reload: ", err)
+	}
+	if expected := (controlReload{Domains: 3, Previous: 2}); reload != expected {
+		t.Errorf("expected %#v, got %#v", expected, reload)
+	}
+	if e := "Reloaded RejectDomainsFile: 3 domains, previously 2"; !waitForLog(out, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+	}
+	expected = []controlDomain{
+		{Domain: "example.org", Action: ActionReject},
+		{Domain: "gmail.com", Action: ActionTag},
+		{Domain: "yahoo.com", Action: ActionReject},
+	}
+	if domains := getDomains(); !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	// an invalid file keeps the previous list
+	if err := os.WriteFile(file, []byte("gmail,com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Post("http://localhost/domains/reload", "", nil)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if e := `Failed to reload RejectDomainsFile, keeping the previous list: line 1: invalid domain "gmail,com"`; !waitForLog(out, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+	}
+	if domains := getDomains(); !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	resp, err = client.Get("http://localhost/domains/reload")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestControlReload(t *testing.T) {
+	tmp := t.TempDir()
+	sock := filepath.Join(tmp, "control.sock")
+	file := filepath.Join(tmp, "blocklist.txt")
+	if err := os.WriteFile(file, []byte("gmail.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ControlListenURI = "unix://` + sock + `"
+RejectDomainsFile = "` + file + `"
+`
+	_, _, out := setup(t, config)
+	client := controlClient(sock)
+
+	postReload := func(expectedCode int) reloadStatus {
+		t.Helper()
+		resp, err := client.Post("http://localhost/reload", "", nil)
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedCode {
+			t.Errorf("expected status %d, got %d", expectedCode, resp.StatusCode)
+		}
+		var status reloadStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal("unexpected error decoding status: ", err)
+		}
+		return status
+	}
+
+	// the domains of RejectDomainsFile are kept along with the new config
+	rewriteConf(t, config+`DomainActions = { "hotmail.fr" = "quarantine" }`)
+	if status := postReload(http.StatusOK); status.Status != "ok" || status.Error != "" || status.Time.IsZero() {
+		t.Errorf("expected ok status, got %+v", status)
+	}
+	expected := []controlDomain{
+		{Domain: "gmail.com", Action: ActionReject},
+		{Domain: "hotmail.fr", Action: ActionQuarantine},
+	}
+	var domains []controlDomain
+	resp, err := client.Get("http://localhost/domains")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&domains)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected error decoding domains: ", err)
+	}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	rewriteConf(t, config+`LogLevel = "verbose"`)
+	failed := postReload(http.StatusInternalServerError)
+	if failed.Status != "failed" || failed.Error != `invalid LogLevel "verbose", must be "info" or "debug"` {
+		t.Errorf("expected failed status, got %+v", failed)
+	}
+	if e := "Failed to reload config, keeping the running one: invalid LogLevel"; !waitForLog(out, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+	}
+
+	resp, err = client.Get("http://localhost/reload")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	var status reloadStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected error decoding status: ", err)
+	}
+	if status.Status != failed.Status || status.Error != failed.Error || !status.Time.Equal(failed.Time) {
+		t.Errorf("expected %+v, got %+v", failed, status)
+	}
+}
+
+func TestControlEvaluate(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ControlListenURI = "unix://` + sock + `"
+AuthservID = "mx.example.org"
+RejectDomains = ["gmail.com"]
+`
+	_, _, out := setup(t, config)
+	client := controlClient(sock)
+
+	cases := []struct {
+		name     string
+		body     string
+		expected controlEvaluation
+	}{
+		{
+			name: "reject",
+			body: `{"from": "Alice <alice@gmail.com>", "dmarc": "fail"}`,
+			expected: controlEvaluation{
+				Action:  "reject",
+				Reason:  ReasonDomainAction,
+				Domain:  "gmail.com",
+				Reply:   "550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+				Details: `dmarc=fail from=gmail.com addr="Alice <alice@gmail.com>" header_from_domain=gmail.com`,
+			},
+		},
+		{
+			name: "pass",
+			body: `{"from": "alice@gmail.com", "dmarc": "pass"}`,
+			expected: controlEvaluation{
+				Action:  "accept",
+				Reason:  ReasonPass,
+				Domain:  "gmail.com",
+				Details: `dmarc=pass from=gmail.com addr="alice@gmail.com" header_from_domain=gmail.com reason=pass`,
+			},
+		},
+		{
+			name: "untrusted authserv",
+			body: `{"from": "alice@gmail.com", "dmarc": "fail", "authserv": "mx.example.com"}`,
+			expected: controlEvaluation{
+				Action:  "accept",
+				Reason:  ReasonNoTrustedAuthres,
+				Domain:  "gmail.com",
+				Details: `dmarc=unknown from=unknown addr="alice@gmail.com" header_from_domain=gmail.com reason=no-trusted-authres`,
+			},
+		},
+	}
+	rejected := metricRejected.Value()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := client.Post("http://localhost/evaluate", "application/json", strings.NewReader(c.body))
+			if err != nil {
+				t.Fatal("unexpected error: ", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			var evaluation controlEvaluation
+			if err := json.NewDecoder(resp.Body).Decode(&evaluation); err != nil {
+				t.Fatal("unexpected error decoding evaluation: ", err)
+			}
+			if evaluation != c.expected {
+				t.Errorf("expected %#v, got %#v", c.expected, evaluation)
+			}
+		})
+	}
+	if value := metricRejected.Value(); value != rejected {
+		t.Errorf("expected the evaluations not to be counted, got %d rejected instead of %d", value, rejected)
+	}
+	if strings.Contains(out.String(), "evaluate: ") {
+		t.Errorf("expected the evaluations not to be logged, got:\n%s", out.String())
+	}
+
+	for _, body := range []string{`{"dmarc": "softfail"}`, `{"from": "alice@gmail.com", "policy": "reject"}`, `not json`} {
+		resp, err := client.Post("http://localhost/evaluate", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, body, resp.StatusCode)
+		}
+	}
+	resp, err := client.Get("http://localhost/evaluate")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("expected status %d with Allow POST, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
@@ -0,0 +1,235 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/emersion/go-milter"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// Action is the action decided for a message.
+type Action = dmarc.Action
+
+const (
+	ActionAccept     = dmarc.Accept
+	ActionReject     = dmarc.Reject
+	ActionDefer      = dmarc.Defer
+	ActionQuarantine = dmarc.Quarantine
+	ActionTag        = dmarc.Tag
+)
+
+// Reason identifies the rule that led to a decision.
+type Reason = dmarc.ReasonCode
+
+// The reasons of the decisions, logged as the value of the "reason" key,
+// recorded in AuditFile and counted by the messages_by_reason metric.
+const (
+	ReasonUnknown                = dmarc.ReasonUnknown
+	ReasonNoTrustedAuthres       = dmarc.ReasonNoTrustedAuthres
+	ReasonFromMismatch           = dmarc.ReasonFromMismatch
+	ReasonHeaderFromDomain       = dmarc.ReasonHeaderFromDomain
+	ReasonExemptReason           = dmarc.ReasonExemptReason
+	ReasonResultAction           = dmarc.ReasonResultAction
+	ReasonMechanismInconsistency = dmarc.ReasonMechanismInconsistency
+	ReasonPass                   = dmarc.ReasonPass
+	ReasonPublishedPolicy        = dmarc.ReasonPublishedPolicy
+	ReasonNotListed              = dmarc.ReasonNotListed
+	ReasonResultNotListed        = dmarc.ReasonResultNotListed
+	ReasonDomainAction           = dmarc.ReasonDomainAction
+
+	ReasonTrustedSubmitter Reason = "trusted-submitter"
+	ReasonAuthenticated    Reason = "authenticated"
+	ReasonOverride         Reason = "override"
+	ReasonTrustedNetwork   Reason = "trusted-network"
+	ReasonMultipleFrom     Reason = "multiple-from"
+	ReasonMissingFrom      Reason = "missing-from"
+	ReasonMailingList      Reason = "mailing-list"
+	ReasonEnvelopeMismatch Reason = "envelope-mismatch"
+	ReasonNoFromToConfirm  Reason = "no-from-to-confirm"
+	// ReasonFallbackPolicy is the reason of the decisions taken by
+	// FallbackDNS from the policy of the DMARC record of the domain.
+	ReasonFallbackPolicy Reason = "fallback-policy"
+	// ReasonNoRecord is the reason of the decisions taken by FallbackDNS
+	// for a domain without DMARC record.
+	ReasonNoRecord Reason = "no-record"
+	// ReasonFallbackError is the reason of the messages accepted because
+	// FallbackDNS failed to look up the DMARC record.
+	ReasonFallbackError Reason = "fallback-error"
+	// ReasonInternalError is the reason of the decisions replaced by
+	// InternalErrorAction.
+	ReasonInternalError Reason = "internal-error"
+	// ReasonProtocolError is the reason of the messages handled with
+	// OnProtocolError, as the MTA does not offer what dmarcator needs.
+	ReasonProtocolError Reason = "protocol-error"
+)
+
+// minReplyLength is the minimum value of MaxReplyLength, leaving room for
+// a meaningful text after the codes.
+const minReplyLength = 64
+
+// deferFmt is the reason sent at SMTP level when deferring a mail.
+const deferFmt = "temporary DMARC error for %s, try again later"
+
+// quarantineFmt is the reason given to the MTA when quarantining a mail.
+const quarantineFmt = "DMARC failure for %s with quarantine policy"
+
+// missingFromText is the reason sent at SMTP level when rejecting a mail
+// without From header field.
+const missingFromText = "rejected because of missing From header field"
+
+// tagHeader is the header field added to a mail when tagging it, with a
+// value formatted with tagFmt.
+const (
+	tagHeader = "X-Dmarcator"
+	tagFmt    = "DMARC failure for %s"
+)
+
+// Decision is the result of the evaluation of a message.
+type Decision struct {
+	Action Action
+	Domain string
+	// Reason is the rule that led to the decision.
+	Reason Reason
+	// Result is the value of the DMARC result the decision is based on,
+	// if any.
+	Result string
+	// Message is the reason of reject of the domain, if any.
+	Message string
+	// Tag is set when the message is tagged in addition to Action.
+	Tag bool
+	// Log is set when the decision is logged in full, whatever Action.
+	Log bool
+
+	// text replaces the reason sent at SMTP level, if set.
+	text string
+}
+
+// outcome returns the DMARC outcome of an accepted message, for
+// AcceptHeaderFmt: the DMARC result value, "fail-but-not-listed" for a
+// failure that was accepted, or "unknown" without result.
+func (d Decision) outcome() string {
+	switch d.Result {
+	case "":
+		return "unknown"
+	case string(authres.ResultFail):
+		return "fail-but-not-listed"
+	}
+	return d.Result
+}
+
+// actions returns the actions of the decision, joined by "+".
+func (d Decision) actions() string {
+	actions := d.Action.String()
+	if d.Tag {
+		actions += "+" + ActionTag.String()
+	}
+	if d.Log {
+		actions += "+" + logAction
+	}
+	return actions
+}
+
+// Reply returns the SMTP reply sent for the decision, or an empty string if
+// the message is accepted.
+func (d Decision) Reply() string {
+	reply, _ := d.reply()
+	return reply
+}
+
+// reply is like Reply, and also reports whether the text of the reply was
+// truncated to fit in MaxReplyLength. The line breaks of the text are
+// replaced by spaces, as they would start a multi-line reply.
+func (d Decision) reply() (string, bool) {
+	var codes, text string
+	switch {
+	case d.text != "" && d.Action == ActionReject:
+		codes, text = "550 5.7.1 ", d.text
+	case d.Action == ActionReject:
+		codes, text = "550 5.7.1 ", fmt.Sprintf(d.rejectFmt(), d.Domain)
+	case d.Action == ActionDefer:
+		codes, text = "451 4.7.1 ", fmt.Sprintf(deferFmt, d.Domain)
+	default:
+		return "", false
+	}
+	text = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, text)
+	if len(codes)+len(text) <= conf.MaxReplyLength {
+		return codes + text, false
+	}
+	// Only cut the text, between two characters.
+	n := conf.MaxReplyLength - len(codes)
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return codes + text[:n], true
+}
+
+// rejectFmt returns the format of the reject reason, which can depend on
+// the domain and on the DMARC result.
+func (d Decision) rejectFmt() string {
+	if d.Message != "" {
+		return d.Message
+	}
+	if format, ok := conf.RejectFmtByResult[d.Result]; ok && d.Result != "" {
+		return format
+	}
+	return conf.RejectFmt
+}
+
+// Response returns the milter response corresponding to the decision. For
+// actions that modify the message, including accept with AcceptHeader, it is
+// RespContinue, as they can only be applied at the end of the message, by
+// calling Apply.
+func (d Decision) Response() milter.Response {
+	if reply := d.Reply(); reply != "" {
+		return milter.NewResponseStr(byte(milter.ActReplyCode), reply)
+	}
+	if d.Action == ActionQuarantine || d.Action == ActionTag || (d.Action == ActionAccept && conf.AcceptHeader != "") {
+		return milter.RespContinue
+	}
+	return milter.RespAccept
+}
+
+// Apply applies the modifications of the decision to the message.
+func (d Decision) Apply(m *milter.Modifier) error {
+	switch d.Action {
+	case ActionQuarantine:
+		if d.Tag {
+			if err := m.AddHeader(tagHeader, fmt.Sprintf(tagFmt, d.Domain)); err != nil {
+				return err
+			}
+		}
+		return m.Quarantine(fmt.Sprintf(quarantineFmt, d.Domain))
+	case ActionTag:
+		return m.AddHeader(tagHeader, fmt.Sprintf(tagFmt, d.Domain))
+	case ActionAccept:
+		if conf.AcceptHeader != "" {
+			return m.AddHeader(conf.AcceptHeader, fmt.Sprintf(conf.AcceptHeaderFmt, d.outcome()))
+		}
+	}
+	return nil
+}
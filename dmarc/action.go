@@ -0,0 +1,64 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+// Package dmarc implements the decision logic of dmarcator: it reads the
+// DMARC result of a trusted Authentication-Results header field, and decides
+// what to do with the message depending on the configured domains. It can be
+// used to embed this logic in another milter.
+package dmarc
+
+import "fmt"
+
+// Action is the action decided for a message.
+type Action int
+
+const (
+	Accept Action = iota
+	Reject
+	Defer
+	Quarantine
+	Tag
+)
+
+var actionNames = []string{
+	Accept:     "accept",
+	Reject:     "reject",
+	Defer:      "defer",
+	Quarantine: "quarantine",
+	Tag:        "tag",
+}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Action) UnmarshalText(text []byte) error {
+	for i, name := range actionNames {
+		if string(text) == name {
+			*a = Action(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid action %q", text)
+}
@@ -0,0 +1,89 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AuthservRule matches the authserv-id of Authentication-Results header
+// fields that are trusted.
+type AuthservRule struct {
+	// pattern is the rule as written in the config.
+	pattern string
+	// suffix is set for the wildcard rules, like ".example.com".
+	suffix string
+	re     *regexp.Regexp
+}
+
+// CompileAuthservRules parses the rules of trusted authserv-ids. A rule of the
+// form "*.example.com" matches all the subdomains of example.com, a rule
+// enclosed in slashes like "/^mx[0-9]+\.example\.com$/" is a regular
+// expression and any other rule is matched exactly. All of them are matched
+// case-insensitively.
+func CompileAuthservRules(patterns []string) ([]AuthservRule, error) {
+	rules := make([]AuthservRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule := AuthservRule{pattern: pattern}
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			rule.suffix = strings.ToLower(pattern[1:])
+		case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+			re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regexp %q: %w", pattern, err)
+			}
+			rule.re = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Match reports whether the authserv-id id matches the rule.
+func (r AuthservRule) Match(id string) bool {
+	switch {
+	case r.suffix != "":
+		return len(id) > len(r.suffix) && strings.EqualFold(id[len(id)-len(r.suffix):], r.suffix)
+	case r.re != nil:
+		return r.re.MatchString(id)
+	default:
+		return strings.EqualFold(id, r.pattern)
+	}
+}
+
+// String returns the rule as it was written.
+func (r AuthservRule) String() string {
+	return r.pattern
+}
+
+// MatchAuthservID returns the rule matching the authserv-id id, if any. The
+// AuthservID is tried first, then the rules of TrustedAuthservIDs.
+func (c Config) MatchAuthservID(id string) (string, bool) {
+	if id == c.AuthservID || (!c.CaseSensitiveAuthservID && strings.EqualFold(id, c.AuthservID)) {
+		return "AuthservID", true
+	}
+	for _, rule := range c.TrustedAuthservIDs {
+		if rule.Match(id) {
+			return rule.pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,82 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import "testing"
+
+func TestMatchAuthservID(t *testing.T) {
+	rules, err := CompileAuthservRules([]string{"*.example.com", `/^mx[0-9]+\.example\.org$/`, "Relay.example.net"})
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	cfg := Config{AuthservID: "mail.club1.fr", TrustedAuthservIDs: rules}
+	cases := []struct {
+		id       string
+		expected string
+		ok       bool
+	}{
+		{"mail.club1.fr", "AuthservID", true},
+		{"MAIL.club1.fr", "AuthservID", true},
+		{"mx01.example.com", "*.example.com", true},
+		{"a.b.EXAMPLE.com", "*.example.com", true},
+		{"example.com", "", false},
+		{"badexample.com", "", false},
+		{"mx02.example.org", `/^mx[0-9]+\.example\.org$/`, true},
+		{"MX3.example.org", `/^mx[0-9]+\.example\.org$/`, true},
+		{"mx.example.org", "", false},
+		{"relay.example.net", "Relay.example.net", true},
+		{"club1.fr", "", false},
+	}
+	for _, c := range cases {
+		rule, ok := cfg.MatchAuthservID(c.id)
+		if rule != c.expected || ok != c.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", c.id, c.expected, c.ok, rule, ok)
+		}
+	}
+}
+
+func TestMatchAuthservIDCaseSensitive(t *testing.T) {
+	rules, err := CompileAuthservRules([]string{"Relay.example.net"})
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	cfg := Config{AuthservID: "Mail.club1.fr", CaseSensitiveAuthservID: true, TrustedAuthservIDs: rules}
+	cases := []struct {
+		id       string
+		expected string
+		ok       bool
+	}{
+		{"Mail.club1.fr", "AuthservID", true},
+		{"mail.club1.fr", "", false},
+		{"MAIL.CLUB1.FR", "", false},
+		// The rules of TrustedAuthservIDs are still case-insensitive.
+		{"relay.example.net", "Relay.example.net", true},
+	}
+	for _, c := range cases {
+		rule, ok := cfg.MatchAuthservID(c.id)
+		if rule != c.expected || ok != c.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", c.id, c.expected, c.ok, rule, ok)
+		}
+	}
+}
+
+func TestCompileAuthservRulesInvalid(t *testing.T) {
+	if _, err := CompileAuthservRules([]string{"/mx[/"}); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
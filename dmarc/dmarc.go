@@ -0,0 +1,463 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Config is the configuration of the decision.
+type Config struct {
+	// AuthservID is the authserv-id of the trusted Authentication-Results
+	// header fields.
+	AuthservID string
+	// CaseSensitiveAuthservID matches AuthservID exactly, instead of
+	// case-insensitively.
+	CaseSensitiveAuthservID bool
+	// TrustedAuthservIDs are the rules of additional authserv-ids to trust.
+	TrustedAuthservIDs []AuthservRule
+	// Domains maps the domains to the action to take when their DMARC
+	// result is not "pass".
+	Domains *Domains
+	// ExemptReasons are the values of the reason property of the DMARC
+	// result, like "forwarded", for which the messages are accepted,
+	// regardless of the result.
+	ExemptReasons []string
+	// NoAuthResultAction is the action to take without DMARC result.
+	NoAuthResultAction Action
+	// PermErrorAction is the action to take instead of the one of Domains
+	// when the result is "permerror", unless the latter is Accept.
+	PermErrorAction Action
+	// MatchHeaderFromDomain also matches the domain of the From header
+	// field against Domains, exactly or by its organizational domain, when
+	// its organizational domain differs from the one of the result. The
+	// result does not authenticate that domain, so its rule is applied as
+	// for a "fail".
+	MatchHeaderFromDomain bool
+	// RejectOnFromMismatch treats the messages for which the organizational
+	// domain of the From header field differs from the one of the result as
+	// a "fail" of the former, to which the rule of Domains is applied, if
+	// any. The messages of the other domains are handled normally.
+	RejectOnFromMismatch bool
+	// ResultActions maps DMARC results to actions, regardless of the
+	// domain. The keys are either a result value, like "fail", or a result
+	// value and a published policy separated by a slash, like "none/reject".
+	ResultActions map[string]Action
+	// RespectPublishedPolicy applies the DMARC policy published by the
+	// domain when the result is "fail".
+	RespectPublishedPolicy bool
+	// StrictMechanismCheck rejects the messages of listed domains for which
+	// DMARC passed even though both SPF and DKIM failed.
+	StrictMechanismCheck bool
+	// StripTrailingDot strips a single trailing dot of the header.from of
+	// the results and of the domain of the From header field, so that
+	// "example.com." matches "example.com". The Domains are expected to be
+	// stripped as well.
+	StripTrailingDot bool
+	// TempErrorAction is like PermErrorAction, for "temperror" results.
+	TempErrorAction Action
+}
+
+// Result is the DMARC result of an Authentication-Results header field.
+type Result struct {
+	Value authres.ResultValue
+	// Reason is the value of the reason property, if any.
+	Reason string
+	// From is the domain of the header.from property.
+	From string
+	// Policy is the published DMARC policy, in lowercase, or an empty string
+	// if it was not recorded.
+	Policy string
+	// Rule is the rule that matched the authserv-id of the field.
+	Rule string
+	// SPF is the value of the SPF result of the same field, if any.
+	SPF authres.ResultValue
+	// DKIM are the values of the DKIM results of the same field, one per
+	// signature, in order.
+	DKIM []authres.ResultValue
+}
+
+// Methods returns a compact summary of the SPF and DKIM results, like
+// "spf=pass dkim=fail,pass", with the methods that have no result omitted.
+func (r *Result) Methods() string {
+	var methods []string
+	if r.SPF != "" {
+		methods = append(methods, "spf="+string(r.SPF))
+	}
+	if len(r.DKIM) > 0 {
+		values := make([]string, len(r.DKIM))
+		for i, v := range r.DKIM {
+			values[i] = string(v)
+		}
+		methods = append(methods, "dkim="+strings.Join(values, ","))
+	}
+	return strings.Join(methods, " ")
+}
+
+// mechanismsFailed reports whether both the SPF result and all the DKIM
+// results are known and not "pass".
+func (r *Result) mechanismsFailed() bool {
+	if r.SPF == "" || r.SPF == authres.ResultPass || len(r.DKIM) == 0 {
+		return false
+	}
+	for _, v := range r.DKIM {
+		if v == authres.ResultPass {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseResult returns the DMARC result of the value of an
+// Authentication-Results header field. It returns nil if the field has no
+// DMARC result or if its authserv-id is not trusted.
+func (c Config) ParseResult(value string) (*Result, error) {
+	id, result, err := ParseField(value)
+	if err != nil {
+		return nil, err
+	}
+	rule, ok := c.MatchAuthservID(id)
+	if !ok {
+		// Not our Authentication-Results, ignore the field
+		return nil, nil
+	}
+	if result != nil {
+		result.Rule = rule
+		if c.StripTrailingDot {
+			result.From = TrimTrailingDot(result.From)
+		}
+	}
+	return result, nil
+}
+
+// ParseField returns the authserv-id and the DMARC result of the value of
+// an Authentication-Results header field, regardless of whether it is
+// trusted. The result is nil if the field has none.
+func ParseField(value string) (string, *Result, error) {
+	id, results, err := authres.Parse(value)
+	if err != nil {
+		return "", nil, err
+	}
+	var result *Result
+	var spf authres.ResultValue
+	var dkim []authres.ResultValue
+	for _, r := range results {
+		switch r := r.(type) {
+		case *authres.SPFResult:
+			spf = r.Value
+		case *authres.DKIMResult:
+			dkim = append(dkim, r.Value)
+		case *authres.DMARCResult:
+			result = &Result{Value: r.Value, Reason: r.Reason, From: r.From, Policy: ParsePolicy(value)}
+		}
+	}
+	if result != nil {
+		result.SPF = spf
+		result.DKIM = dkim
+	}
+	return id, result, nil
+}
+
+// ReasonCode identifies the rule that led to a decision. It is logged as the
+// value of the "reason" key.
+type ReasonCode string
+
+// The reasons of the decisions taken by DecideResult.
+const (
+	// ReasonUnknown is the reason of a message without DMARC result nor
+	// From header field.
+	ReasonUnknown ReasonCode = "unknown"
+	// ReasonNoTrustedAuthres is the reason of a message with a From header
+	// field, but without trusted DMARC result.
+	ReasonNoTrustedAuthres ReasonCode = "no-trusted-authres"
+	// ReasonFromMismatch is the reason of a decision taken for the domain
+	// of the From header field by RejectOnFromMismatch.
+	ReasonFromMismatch ReasonCode = "from-mismatch"
+	// ReasonHeaderFromDomain is the reason of a decision taken for the
+	// domain of the From header field by MatchHeaderFromDomain.
+	ReasonHeaderFromDomain ReasonCode = "header-from-domain"
+	// ReasonExemptReason is the reason of a message accepted because of
+	// one of ExemptReasons.
+	ReasonExemptReason ReasonCode = "exempt-reason"
+	// ReasonResultAction is the reason of a decision taken by ResultActions.
+	ReasonResultAction ReasonCode = "result-action"
+	// ReasonMechanismInconsistency is the reason of a reject by
+	// StrictMechanismCheck.
+	ReasonMechanismInconsistency ReasonCode = "mechanism-inconsistency"
+	// ReasonPass is the reason of a message accepted because DMARC passed.
+	ReasonPass ReasonCode = "pass"
+	// ReasonPublishedPolicy is the reason of a decision taken by
+	// RespectPublishedPolicy.
+	ReasonPublishedPolicy ReasonCode = "published-policy"
+	// ReasonNotListed is the reason of a message of a domain that is not in
+	// Domains.
+	ReasonNotListed ReasonCode = "not-listed"
+	// ReasonResultNotListed is the reason of a message accepted because its
+	// result is not one of the Results of the rule of its domain.
+	ReasonResultNotListed ReasonCode = "result-not-listed"
+	// ReasonDomainAction is the reason of a decision taken by the rule of
+	// the domain in Domains.
+	ReasonDomainAction ReasonCode = "domain-action"
+)
+
+// Reason explains a decision.
+type Reason struct {
+	// Code is the rule that led to the decision.
+	Code ReasonCode
+	// Domain is the domain the decision is about, to be used in the replies.
+	Domain string
+	// Details are the facts that led to the decision, as key=value pairs
+	// to be logged.
+	Details string
+	// Message is the reason of reject of the rule of the domain, if any.
+	Message string
+	// Tag is set when the quarantined message must also be tagged, as
+	// requested by the rule of the domain.
+	Tag bool
+	// Log is set when the decision must be logged in full, as requested by
+	// the rule of the domain.
+	Log bool
+}
+
+func (r Reason) String() string {
+	return r.Details
+}
+
+// Decide returns the action to take for a message, given the value of its
+// Authentication-Results and From header fields, either of which can be
+// empty. An Authentication-Results header field that cannot be parsed is
+// handled as if there was none.
+func Decide(cfg Config, arHeader, fromHeader string) (Action, Reason) {
+	var result *Result
+	if arHeader != "" {
+		result, _ = cfg.ParseResult(arHeader)
+	}
+	return DecideResult(cfg, result, fromHeader)
+}
+
+// DecideResult is like Decide, with an already parsed result, that can be
+// nil.
+func DecideResult(cfg Config, r *Result, fromHeader string) (Action, Reason) {
+	fromDomain := AddressDomain(fromHeader)
+	if cfg.StripTrailingDot {
+		fromDomain = TrimTrailingDot(fromDomain)
+	}
+	if r == nil {
+		reason := Reason{Domain: fromDomain,
+			Details: fmt.Sprintf("dmarc=unknown from=unknown addr=%q header_from_domain=%s", fromHeader, fromDomain)}
+		// A From without trusted result often reveals that the upstream
+		// DMARC milter is not running, or that its authserv-id is not
+		// trusted.
+		why := ReasonUnknown
+		if fromDomain != "" {
+			why = ReasonNoTrustedAuthres
+		}
+		return cfg.NoAuthResultAction, reason.accept(cfg.NoAuthResultAction, why)
+	}
+	if cfg.RejectOnFromMismatch && cfg.Domains != nil && fromDomain != "" && OrgDomain(fromDomain) != OrgDomain(r.From) {
+		if rule, ok := headerFromRule(cfg.Domains, fromDomain); ok {
+			return rule.Action, Reason{Code: ReasonFromMismatch, Domain: fromDomain, Message: rule.Message, Tag: rule.Tag && rule.Action == Quarantine, Log: rule.Log,
+				Details: fmt.Sprintf("reason=%s header_from=%s ar_from=%s addr=%q", ReasonFromMismatch, fromDomain, r.From, fromHeader)}
+		}
+	}
+	if cfg.MatchHeaderFromDomain && cfg.Domains != nil && fromDomain != "" && OrgDomain(fromDomain) != OrgDomain(r.From) {
+		if rule, ok := headerFromRule(cfg.Domains, fromDomain); ok {
+			return rule.Action, Reason{Code: ReasonHeaderFromDomain, Domain: fromDomain, Message: rule.Message, Tag: rule.Tag && rule.Action == Quarantine, Log: rule.Log,
+				Details: fmt.Sprintf("reason=%s dmarc=%v from=%s from_org_domain=%s addr=%q header_from_domain=%s header_from_org_domain=%s",
+					ReasonHeaderFromDomain, r.Value, r.From, OrgDomain(r.From), fromHeader, fromDomain, OrgDomain(fromDomain))}
+		}
+	}
+	reason := Reason{Domain: r.From, Details: fmt.Sprintf("dmarc=%v from=%s addr=%q header_from_domain=%s", r.Value, r.From, fromHeader, fromDomain)}
+	if r.Policy != "" {
+		reason.Details += " policy=" + r.Policy
+	}
+	if r.Reason != "" {
+		reason.Details += fmt.Sprintf(" dmarc_reason=%q", r.Reason)
+	}
+	for _, exempt := range cfg.ExemptReasons {
+		if r.Reason != "" && strings.EqualFold(r.Reason, exempt) {
+			return Accept, reason.accept(Accept, ReasonExemptReason)
+		}
+	}
+	if action, ok := cfg.ResultActions[string(r.Value)+"/"+r.Policy]; ok && r.Policy != "" {
+		return action, reason.with(ReasonResultAction)
+	}
+	if action, ok := cfg.ResultActions[string(r.Value)]; ok {
+		return action, reason.with(ReasonResultAction)
+	}
+	if r.Value == authres.ResultPass {
+		if cfg.StrictMechanismCheck && cfg.Domains != nil && r.mechanismsFailed() {
+			if _, ok := cfg.Domains.MatchRule(r.From); ok {
+				reason.Details = fmt.Sprintf("reason=%s %s", ReasonMechanismInconsistency, reason.Details)
+				return Reject, reason.with(ReasonMechanismInconsistency)
+			}
+		}
+		return Accept, reason.accept(Accept, ReasonPass)
+	}
+	if cfg.RespectPublishedPolicy && r.Value == authres.ResultFail {
+		switch r.Policy {
+		case "quarantine":
+			return Quarantine, reason.with(ReasonPublishedPolicy)
+		case "reject":
+			return Reject, reason.with(ReasonPublishedPolicy)
+		}
+	}
+	if cfg.Domains == nil {
+		return Accept, reason.accept(Accept, ReasonNotListed)
+	}
+	rule, ok := cfg.Domains.MatchRule(r.From)
+	if !ok {
+		return Accept, reason.accept(Accept, ReasonNotListed)
+	}
+	reason.Message = rule.Message
+	if len(rule.Results) > 0 {
+		for _, value := range rule.Results {
+			if value == r.Value {
+				reason.Tag = rule.Tag && rule.Action == Quarantine
+				reason.Log = rule.Log
+				return rule.Action, reason.accept(rule.Action, ReasonDomainAction)
+			}
+		}
+		return Accept, reason.accept(Accept, ReasonResultNotListed)
+	}
+	action := rule.Action
+	if action != Accept {
+		switch r.Value {
+		case authres.ResultTempError:
+			action = cfg.TempErrorAction
+		case authres.ResultPermError:
+			action = cfg.PermErrorAction
+		}
+	}
+	reason.Tag = rule.Tag && action == Quarantine
+	reason.Log = rule.Log
+	return action, reason.accept(action, ReasonDomainAction)
+}
+
+// headerFromRule returns the rule of the domain of a From header field that
+// is not authenticated by the DMARC result, matched exactly or by its
+// organizational domain, if it takes an action for a "fail".
+func headerFromRule(domains *Domains, fromDomain string) (Rule, bool) {
+	rule, ok := domains.MatchRule(fromDomain)
+	if !ok {
+		rule, ok = domains.MatchRule(OrgDomain(fromDomain))
+	}
+	if !ok || rule.Action == Accept {
+		return Rule{}, false
+	}
+	if len(rule.Results) == 0 {
+		return rule, true
+	}
+	for _, value := range rule.Results {
+		if value == authres.ResultFail {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// accept sets the code of the reason, and appends it to the details if action
+// is Accept, as the other actions are explained by the result already.
+func (r Reason) accept(action Action, code ReasonCode) Reason {
+	if action == Accept {
+		r.Details += " reason=" + string(code)
+	}
+	return r.with(code)
+}
+
+// with returns the reason with the given code.
+func (r Reason) with(code ReasonCode) Reason {
+	r.Code = code
+	return r
+}
+
+// ValidateResultKey returns an error if key is not a valid key of
+// ResultActions.
+func ValidateResultKey(key string) error {
+	value, policy, hasPolicy := strings.Cut(key, "/")
+	switch authres.ResultValue(value) {
+	case authres.ResultNone, authres.ResultPass, authres.ResultFail, authres.ResultTempError, authres.ResultPermError:
+	default:
+		return fmt.Errorf("invalid DMARC result %q", value)
+	}
+	if !hasPolicy {
+		return nil
+	}
+	switch policy {
+	case "none", "quarantine", "reject":
+		return nil
+	default:
+		return fmt.Errorf("invalid DMARC policy %q", policy)
+	}
+}
+
+// OrgDomain returns the organizational domain of domain, as defined by
+// RFC 7489, using the public suffix list. It falls back to the domain itself
+// if it cannot be determined.
+func OrgDomain(domain string) string {
+	domain = strings.ToLower(domain)
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// AddressDomain returns the domain part of an address as found in a From
+// header field, with or without display name, or an empty string if there is
+// none. If the address cannot be parsed, it falls back to the text after the
+// last "@".
+func AddressDomain(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	i := strings.LastIndexByte(address, '@')
+	if i < 0 {
+		return ""
+	}
+	domain := address[i+1:]
+	if end := strings.IndexAny(domain, ">,; \t"); end >= 0 {
+		domain = domain[:end]
+	}
+	return domain
+}
+
+var (
+	policyComment  = regexp.MustCompile(`(?i)\bdmarc=[a-z]+\s*\([^)]*\bp=([a-z]+)`)
+	policyProperty = regexp.MustCompile(`(?i)\bpolicy\.published-domain-policy=([a-z]+)`)
+)
+
+// ParsePolicy returns the published DMARC policy recorded in the value of an
+// Authentication-Results header field, in lowercase, or an empty string if
+// there is none. It can either be in the "policy.published-domain-policy"
+// property, or in a comment right after the DMARC result, as done by
+// OpenDMARC, e.g. "dmarc=fail (p=none dis=none)".
+func ParsePolicy(value string) string {
+	if m := policyProperty.FindStringSubmatch(value); m != nil {
+		return strings.ToLower(m[1])
+	}
+	if m := policyComment.FindStringSubmatch(value); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
@@ -0,0 +1,427 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+func TestDecide(t *testing.T) {
+	domains := NewDomains()
+	domains.Insert("gmail.com", Reject)
+	domains.Insert("example.org", Tag)
+	domains.Insert("example.net", Accept)
+	cfg := Config{
+		AuthservID:         "mail.club1.fr",
+		Domains:            domains,
+		NoAuthResultAction: Accept,
+		PermErrorAction:    Reject,
+		TempErrorAction:    Defer,
+	}
+	cases := []struct {
+		name    string
+		cfg     func(*Config)
+		ar      string
+		from    string
+		action  Action
+		code    ReasonCode
+		domain  string
+		details string
+		message string
+	}{
+		{
+			name:    "fail for listed domain",
+			ar:      "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			from:    "Coucou <coucou@gmail.com>",
+			action:  Reject,
+			code:    ReasonDomainAction,
+			domain:  "gmail.com",
+			details: `dmarc=fail from=gmail.com addr="Coucou <coucou@gmail.com>" header_from_domain=gmail.com`,
+		},
+		{
+			name:    "pass for listed domain",
+			ar:      "mail.club1.fr; dmarc=pass header.from=gmail.com",
+			from:    "coucou@gmail.com",
+			action:  Accept,
+			code:    ReasonPass,
+			domain:  "gmail.com",
+			details: `dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com reason=pass`,
+		},
+		{
+			name:   "fail for tagged domain",
+			ar:     "mail.club1.fr; dmarc=fail header.from=example.org",
+			action: Tag,
+			code:   ReasonDomainAction,
+			domain: "example.org",
+		},
+		{
+			name:   "temperror for tagged domain",
+			ar:     "mail.club1.fr; dmarc=temperror header.from=example.org",
+			action: Defer,
+			code:   ReasonDomainAction,
+			domain: "example.org",
+		},
+		{
+			name:    "permerror for accepted domain",
+			ar:      "mail.club1.fr; dmarc=permerror header.from=example.net",
+			from:    "coucou@example.net",
+			action:  Accept,
+			code:    ReasonDomainAction,
+			domain:  "example.net",
+			details: `dmarc=permerror from=example.net addr="coucou@example.net" header_from_domain=example.net reason=domain-action`,
+		},
+		{
+			name:    "fail for unlisted domain",
+			ar:      "mail.club1.fr; dmarc=fail header.from=example.com",
+			from:    "coucou@example.com",
+			action:  Accept,
+			code:    ReasonNotListed,
+			domain:  "example.com",
+			details: `dmarc=fail from=example.com addr="coucou@example.com" header_from_domain=example.com reason=not-listed`,
+		},
+		{
+			name:    "untrusted authserv-id",
+			ar:      "example.com; dmarc=fail header.from=gmail.com",
+			from:    "coucou@gmail.com",
+			action:  Accept,
+			code:    ReasonNoTrustedAuthres,
+			domain:  "gmail.com",
+			details: `dmarc=unknown from=unknown addr="coucou@gmail.com" header_from_domain=gmail.com reason=no-trusted-authres`,
+		},
+		{
+			name:   "invalid header",
+			ar:     "mail.club1.fr; dmarc header.from=gmail.com",
+			action: Accept,
+			code:   ReasonUnknown,
+		},
+		{
+			name:   "no header with reject action",
+			cfg:    func(c *Config) { c.NoAuthResultAction = Reject },
+			from:   "coucou@gmail.com",
+			action: Reject,
+			code:   ReasonNoTrustedAuthres,
+			domain: "gmail.com",
+		},
+		{
+			name:    "from mismatch",
+			cfg:     func(c *Config) { c.RejectOnFromMismatch = true },
+			ar:      "mail.club1.fr; dmarc=pass header.from=attacker.com",
+			from:    "Google <no-reply@gmail.com>",
+			action:  Reject,
+			code:    ReasonFromMismatch,
+			domain:  "gmail.com",
+			details: `reason=from-mismatch header_from=gmail.com ar_from=attacker.com addr="Google <no-reply@gmail.com>"`,
+		},
+		{
+			name:   "from mismatch with domain action",
+			cfg:    func(c *Config) { c.RejectOnFromMismatch = true },
+			ar:     "mail.club1.fr; dmarc=pass header.from=attacker.com",
+			from:   "news@example.org",
+			action: Tag,
+			code:   ReasonFromMismatch,
+			domain: "example.org",
+		},
+		{
+			name:   "from mismatch of unlisted domain",
+			cfg:    func(c *Config) { c.RejectOnFromMismatch = true },
+			ar:     "mail.club1.fr; dmarc=pass header.from=attacker.com",
+			from:   "PayPal <service@paypal.com>",
+			action: Accept,
+			code:   ReasonPass,
+			domain: "attacker.com",
+		},
+		{
+			name:    "header from domain",
+			cfg:     func(c *Config) { c.MatchHeaderFromDomain = true },
+			ar:      "mail.club1.fr; dmarc=pass header.from=gmai1.com",
+			from:    "Google <no-reply@accounts.gmail.com>",
+			action:  Reject,
+			code:    ReasonHeaderFromDomain,
+			domain:  "accounts.gmail.com",
+			details: `reason=header-from-domain dmarc=pass from=gmai1.com from_org_domain=gmai1.com addr="Google <no-reply@accounts.gmail.com>" header_from_domain=accounts.gmail.com header_from_org_domain=gmail.com`,
+		},
+		{
+			name:    "header from domain not listed",
+			cfg:     func(c *Config) { c.MatchHeaderFromDomain = true },
+			ar:      "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			from:    "coucou@example.com",
+			action:  Reject,
+			code:    ReasonDomainAction,
+			domain:  "gmail.com",
+			details: `dmarc=fail from=gmail.com addr="coucou@example.com" header_from_domain=example.com`,
+		},
+		{
+			name:    "pass with failed mechanisms",
+			cfg:     func(c *Config) { c.StrictMechanismCheck = true },
+			ar:      "mail.club1.fr; spf=fail smtp.mailfrom=gmail.com; dkim=fail header.d=gmail.com; dmarc=pass header.from=gmail.com",
+			from:    "coucou@gmail.com",
+			action:  Reject,
+			code:    ReasonMechanismInconsistency,
+			domain:  "gmail.com",
+			details: `reason=mechanism-inconsistency dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com`,
+		},
+		{
+			name:   "pass with one passed mechanism",
+			cfg:    func(c *Config) { c.StrictMechanismCheck = true },
+			ar:     "mail.club1.fr; spf=fail smtp.mailfrom=gmail.com; dkim=fail header.d=gmail.com; dkim=pass header.d=gmail.com; dmarc=pass header.from=gmail.com",
+			action: Accept,
+			code:   ReasonPass,
+			domain: "gmail.com",
+		},
+		{
+			name:   "pass with failed mechanisms for unlisted domain",
+			cfg:    func(c *Config) { c.StrictMechanismCheck = true },
+			ar:     "mail.club1.fr; spf=fail smtp.mailfrom=example.com; dkim=fail header.d=example.com; dmarc=pass header.from=example.com",
+			action: Accept,
+			code:   ReasonPass,
+			domain: "example.com",
+		},
+		{
+			name:   "pass without mechanisms",
+			cfg:    func(c *Config) { c.StrictMechanismCheck = true },
+			ar:     "mail.club1.fr; dmarc=pass header.from=gmail.com",
+			action: Accept,
+			code:   ReasonPass,
+			domain: "gmail.com",
+		},
+		{
+			name:    "published policy",
+			cfg:     func(c *Config) { c.RespectPublishedPolicy = true },
+			ar:      "mail.club1.fr; dmarc=fail (p=quarantine dis=quarantine) header.from=example.com",
+			from:    "coucou@example.com",
+			action:  Quarantine,
+			code:    ReasonPublishedPolicy,
+			domain:  "example.com",
+			details: `dmarc=fail from=example.com addr="coucou@example.com" header_from_domain=example.com policy=quarantine`,
+		},
+		{
+			name:   "published policy with temperror",
+			cfg:    func(c *Config) { c.RespectPublishedPolicy = true },
+			ar:     "mail.club1.fr; dmarc=temperror (p=reject dis=none) header.from=gmail.com",
+			action: Defer,
+			code:   ReasonDomainAction,
+			domain: "gmail.com",
+		},
+		{
+			name: "rule with results and message",
+			cfg: func(c *Config) {
+				c.Domains = NewDomains()
+				c.Domains.InsertRule("example.com", Rule{Action: Reject, Message: "no DMARC record for %s", Results: []authres.ResultValue{authres.ResultNone}})
+			},
+			ar:      "mail.club1.fr; dmarc=none header.from=example.com",
+			action:  Reject,
+			code:    ReasonDomainAction,
+			domain:  "example.com",
+			message: "no DMARC record for %s",
+		},
+		{
+			name: "rule with other results",
+			cfg: func(c *Config) {
+				c.Domains = NewDomains()
+				c.Domains.InsertRule("example.com", Rule{Action: Reject, Results: []authres.ResultValue{authres.ResultNone}})
+			},
+			ar:     "mail.club1.fr; dmarc=temperror header.from=example.com",
+			action: Accept,
+			code:   ReasonResultNotListed,
+			domain: "example.com",
+		},
+		{
+			name:    "exempt reason",
+			cfg:     func(c *Config) { c.ExemptReasons = []string{"local_policy", "forwarded"} },
+			ar:      "mail.club1.fr; dmarc=fail reason=Forwarded header.from=gmail.com",
+			from:    "coucou@gmail.com",
+			action:  Accept,
+			code:    ReasonExemptReason,
+			domain:  "gmail.com",
+			details: `dmarc=fail from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com dmarc_reason="Forwarded" reason=exempt-reason`,
+		},
+		{
+			name:   "not exempt reason",
+			cfg:    func(c *Config) { c.ExemptReasons = []string{"forwarded"} },
+			ar:     "mail.club1.fr; dmarc=fail reason=unaligned header.from=gmail.com",
+			action: Reject,
+			code:   ReasonDomainAction,
+			domain: "gmail.com",
+		},
+		{
+			name:    "result action with policy",
+			cfg:     func(c *Config) { c.ResultActions = map[string]Action{"none/reject": Reject, "none": Tag} },
+			ar:      "mail.club1.fr; dmarc=none reason=unaligned policy.published-domain-policy=reject header.from=example.com",
+			from:    "coucou@example.com",
+			action:  Reject,
+			code:    ReasonResultAction,
+			domain:  "example.com",
+			details: `dmarc=none from=example.com addr="coucou@example.com" header_from_domain=example.com policy=reject dmarc_reason="unaligned"`,
+		},
+		{
+			name:   "result action without policy",
+			cfg:    func(c *Config) { c.ResultActions = map[string]Action{"none/reject": Reject, "none": Tag} },
+			ar:     "mail.club1.fr; dmarc=none (p=quarantine dis=none) header.from=example.com",
+			action: Tag,
+			code:   ReasonResultAction,
+			domain: "example.com",
+		},
+		{
+			name:   "result action over domain action",
+			cfg:    func(c *Config) { c.ResultActions = map[string]Action{"fail": Quarantine} },
+			ar:     "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: Quarantine,
+			code:   ReasonResultAction,
+			domain: "gmail.com",
+		},
+		{
+			name: "result action over published policy",
+			cfg: func(c *Config) {
+				c.RespectPublishedPolicy = true
+				c.ResultActions = map[string]Action{"fail/reject": Tag}
+			},
+			ar:     "mail.club1.fr; dmarc=fail (p=reject dis=reject) header.from=example.com",
+			action: Tag,
+			code:   ReasonResultAction,
+			domain: "example.com",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := cfg
+			if c.cfg != nil {
+				c.cfg(&cfg)
+			}
+			action, reason := Decide(cfg, c.ar, c.from)
+			if action != c.action {
+				t.Errorf("expected action %v, got %v", c.action, action)
+			}
+			if reason.Code != c.code {
+				t.Errorf("expected code %q, got %q", c.code, reason.Code)
+			}
+			if reason.Domain != c.domain {
+				t.Errorf("expected domain %q, got %q", c.domain, reason.Domain)
+			}
+			if reason.Message != c.message {
+				t.Errorf("expected message %q, got %q", c.message, reason.Message)
+			}
+			if c.details != "" && reason.Details != c.details {
+				t.Errorf("expected details:\n%s\ngot:\n%s", c.details, reason.Details)
+			}
+		})
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	cfg := Config{AuthservID: "mail.club1.fr"}
+	r, err := cfg.ParseResult("mail.club1.fr; spf=pass smtp.mailfrom=club1.fr; dmarc=fail (p=reject dis=none) header.from=club1.fr")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected := Result{Value: authres.ResultFail, From: "club1.fr", Policy: "reject", Rule: "AuthservID", SPF: authres.ResultPass}
+	if r == nil || !reflect.DeepEqual(*r, expected) {
+		t.Errorf("expected %#v, got %#v", expected, r)
+	}
+	for _, value := range []string{
+		"example.com; dmarc=fail header.from=club1.fr",
+		"mail.club1.fr; spf=pass smtp.mailfrom=club1.fr",
+	} {
+		if r, err := cfg.ParseResult(value); r != nil || err != nil {
+			t.Errorf("%q: expected no result, got %#v, %v", value, r, err)
+		}
+	}
+	if _, err := cfg.ParseResult("mail.club1.fr; dmarc header.from=club1.fr"); err == nil {
+		t.Error("expected parse error")
+	}
+	cfg.StripTrailingDot = true
+	r, err = cfg.ParseResult("mail.club1.fr; dmarc=fail header.from=Club1.fr.")
+	if err != nil || r == nil || r.From != "Club1.fr" {
+		t.Errorf("expected header.from without trailing dot, got %#v, %v", r, err)
+	}
+}
+
+func TestResultMethods(t *testing.T) {
+	cfg := Config{AuthservID: "mail.club1.fr"}
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"mail.club1.fr; spf=pass smtp.mailfrom=club1.fr; dkim=fail header.d=club1.fr; dkim=pass header.d=gmail.com; dmarc=fail header.from=club1.fr", "spf=pass dkim=fail,pass"},
+		{"mail.club1.fr; dkim=none; dmarc=none header.from=club1.fr", "dkim=none"},
+		{"mail.club1.fr; dmarc=pass header.from=club1.fr", ""},
+	}
+	for _, c := range cases {
+		r, err := cfg.ParseResult(c.value)
+		if err != nil || r == nil {
+			t.Fatalf("%q: unexpected result %#v, %v", c.value, r, err)
+		}
+		if actual := r.Methods(); actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.value, c.expected, actual)
+		}
+	}
+}
+
+func TestValidateResultKey(t *testing.T) {
+	for _, key := range []string{"none", "pass/reject", "fail/quarantine", "temperror", "permerror/none"} {
+		if err := ValidateResultKey(key); err != nil {
+			t.Errorf("%q: unexpected error: %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "softfail", "none/", "fail/discard", "FAIL"} {
+		if err := ValidateResultKey(key); err == nil {
+			t.Errorf("%q: expected error", key)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"mail.club1.fr; dmarc=fail (p=none dis=none) header.from=gmail.com", "none"},
+		{"mx.google.com; dkim=pass header.i=@club1.fr; dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=club1.fr", "reject"},
+		{"mail.club1.fr; dmarc=fail policy.published-domain-policy=quarantine header.from=example.com", "quarantine"},
+		{"mail.club1.fr; spf=fail (p=reject) smtp.mailfrom=example.com; dmarc=fail header.from=example.com", ""},
+		{"mail.club1.fr; dmarc=fail header.from=gmail.com", ""},
+	}
+	for _, c := range cases {
+		if actual := ParsePolicy(c.value); actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.value, c.expected, actual)
+		}
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected string
+	}{
+		{"coucou@gmail.com", "gmail.com"},
+		{"Coucou <coucou@gmail.com>", "gmail.com"},
+		{"Aurélien COUDERC <libre@coucou.fr>", "coucou.fr"},
+		{`"Coucou @ home" <coucou@gmail.com>`, "gmail.com"},
+		{"Broken <coucou@broken.com", "broken.com"},
+		{"coucou@broken.com>, ", "broken.com"},
+		{"undisclosed-recipients:;", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if actual := AddressDomain(c.address); actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.address, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"golang.org/x/net/idna"
+)
+
+// Rule is the handling of the DMARC results of a domain.
+type Rule struct {
+	// Action is the action to take when the DMARC result is not "pass".
+	Action Action
+	// Message is the reason of reject at SMTP level, a format with a single
+	// "%s" replaced by the domain, or an empty string to use the default.
+	Message string
+	// Results restricts Action to these result values, and the other
+	// results are accepted. If empty, Action is taken for all the results
+	// that are not "pass", except for the errors, see Config.
+	Results []authres.ResultValue
+	// Tag also tags the messages that are quarantined by Action.
+	Tag bool
+	// Log also logs the decisions in full, whatever Action.
+	Log bool
+}
+
+// Domains maps domains to rules, stored as a tree of their labels, from the
+// rightmost one. It allows to match a domain exactly, or as a subdomain
+// of a wildcard entry, in a single traversal.
+type Domains struct {
+	children map[string]*Domains
+	// exact is set if the domain of this node is in the trie.
+	exact     bool
+	exactRule Rule
+	// wildcard is set if all the subdomains of this node are in the trie.
+	wildcard     bool
+	wildcardRule Rule
+}
+
+// NewDomains returns an empty mapping of domains.
+func NewDomains() *Domains {
+	return &Domains{}
+}
+
+// Insert maps a domain to action. If the domain starts with "*.", all its
+// subdomains are mapped instead. The domain is matched case-insensitively.
+func (t *Domains) Insert(domain string, action Action) {
+	t.InsertRule(domain, Rule{Action: action})
+}
+
+// InsertRule is like Insert, with a full rule.
+func (t *Domains) InsertRule(domain string, rule Rule) {
+	domain = strings.ToLower(domain)
+	wildcard := strings.HasPrefix(domain, "*.")
+	if wildcard {
+		domain = domain[2:]
+	}
+	node := t
+	for domain != "" {
+		var label string
+		domain, label = lastLabel(domain)
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*Domains)
+			}
+			child = &Domains{}
+			node.children[label] = child
+		}
+		node = child
+	}
+	if wildcard {
+		node.wildcard = true
+		node.wildcardRule = rule
+	} else {
+		node.exact = true
+		node.exactRule = rule
+	}
+}
+
+// Match returns the action of domain and whether it is in the trie, either
+// exactly or as the subdomain of a wildcard entry. An exact entry takes
+// precedence over the wildcard ones, and the most specific wildcard entry
+// wins. The domain is matched case-insensitively.
+func (t *Domains) Match(domain string) (Action, bool) {
+	rule, ok := t.MatchRule(domain)
+	return rule.Action, ok
+}
+
+// MatchRule is like Match, but returns the full rule.
+func (t *Domains) MatchRule(domain string) (Rule, bool) {
+	domain = strings.ToLower(domain)
+	var rule Rule
+	found := false
+	node := t
+	for domain != "" {
+		if node.wildcard {
+			rule, found = node.wildcardRule, true
+		}
+		var label string
+		domain, label = lastLabel(domain)
+		node = node.children[label]
+		if node == nil {
+			return rule, found
+		}
+	}
+	if node.exact {
+		return node.exactRule, true
+	}
+	return rule, found
+}
+
+// Each calls fn for each entry of the trie, with its domain, prefixed by "*."
+// for the wildcard entries, in no particular order.
+func (t *Domains) Each(fn func(domain string, rule Rule)) {
+	t.each("", fn)
+}
+
+// each is like Each, for the node of the given domain.
+func (t *Domains) each(domain string, fn func(domain string, rule Rule)) {
+	if t.exact {
+		fn(domain, t.exactRule)
+	}
+	if t.wildcard {
+		fn("*."+domain, t.wildcardRule)
+	}
+	for label, child := range t.children {
+		if domain != "" {
+			label += "." + domain
+		}
+		child.each(label, fn)
+	}
+}
+
+// domainProfile is the IDNA profile used to validate the configured domains.
+// It checks the allowed characters and the length of the labels, and accepts
+// internationalized domain names.
+var domainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.VerifyDNSLength(true),
+	idna.BidiRule(),
+	idna.StrictDomainName(true),
+)
+
+// ValidateDomain returns an error if domain is not a valid host name. It can
+// be prefixed by "*." like the entries of Domains.
+func ValidateDomain(domain string) error {
+	name := strings.TrimPrefix(domain, "*.")
+	if strings.HasSuffix(name, ".") {
+		return errors.New("trailing dot")
+	}
+	_, err := domainProfile.ToASCII(name)
+	return err
+}
+
+// TrimTrailingDot returns domain without a single trailing dot, the root of
+// the fully qualified domain names, if any.
+func TrimTrailingDot(domain string) string {
+	return strings.TrimSuffix(domain, ".")
+}
+
+// lastLabel splits domain into its rightmost label and the rest.
+func lastLabel(domain string) (rest, label string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return "", domain
+	}
+	return domain[:i], domain[i+1:]
+}
@@ -0,0 +1,167 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDomains(t *testing.T) {
+	trie := NewDomains()
+	entries := []struct {
+		domain string
+		action Action
+	}{
+		{"gmail.com", Reject},
+		{"Hotmail.FR", Tag},
+		{"*.example.com", Quarantine},
+		{"*.mail.example.com", Reject},
+		{"www.example.com", Accept},
+		{"co.uk", Reject},
+	}
+	for _, e := range entries {
+		trie.Insert(e.domain, e.action)
+	}
+	cases := []struct {
+		domain   string
+		expected bool
+		action   Action
+	}{
+		{"gmail.com", true, Reject},
+		{"GMAIL.com", true, Reject},
+		{"hotmail.fr", true, Tag},
+		{"mail.gmail.com", false, Accept},
+		{"com", false, Accept},
+		{"mail.com", false, Accept},
+		{"example.com", false, Accept},
+		{"mail.example.com", true, Quarantine},
+		{"a.b.example.com", true, Quarantine},
+		{"a.mail.example.com", true, Reject},
+		{"www.example.com", true, Accept},
+		{"co.uk", true, Reject},
+		{"example.co.uk", false, Accept},
+		{"", false, Accept},
+	}
+	for _, c := range cases {
+		action, found := trie.Match(c.domain)
+		if found != c.expected || action != c.action {
+			t.Errorf("%q: expected %v %v, got %v %v", c.domain, c.expected, c.action, found, action)
+		}
+	}
+
+	entered := make(map[string]Action)
+	trie.Each(func(domain string, rule Rule) {
+		if _, ok := entered[domain]; ok {
+			t.Errorf("%q: entered twice", domain)
+		}
+		entered[domain] = rule.Action
+	})
+	expected := map[string]Action{
+		"gmail.com":          Reject,
+		"hotmail.fr":         Tag,
+		"*.example.com":      Quarantine,
+		"*.mail.example.com": Reject,
+		"www.example.com":    Accept,
+		"co.uk":              Reject,
+	}
+	if !reflect.DeepEqual(expected, entered) {
+		t.Errorf("expected %v, got %v", expected, entered)
+	}
+}
+
+// benchDomains returns n distinct domains.
+func benchDomains(n int) []string {
+	domains := make([]string, n)
+	for i := range domains {
+		domains[i] = "domain" + strconv.Itoa(i) + ".example" + strconv.Itoa(i%100) + ".com"
+	}
+	return domains
+}
+
+func BenchmarkDomainMatch(b *testing.B) {
+	domains := benchDomains(50000)
+	trie := NewDomains()
+	set := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		trie.Insert(domain, Reject)
+		set[strings.ToLower(domain)] = true
+	}
+	lookups := map[string]string{
+		"hit":  "Domain4242.example42.com",
+		"miss": "coucou.example42.com",
+	}
+	for name, domain := range lookups {
+		b.Run("trie/"+name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.Match(domain)
+			}
+		})
+		b.Run("map/"+name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = set[strings.ToLower(domain)]
+			}
+		})
+		// Equivalent of the trie with a map, walking the labels to
+		// match wildcard entries.
+		b.Run("map-wildcard/"+name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d := strings.ToLower(domain)
+				if set[d] {
+					continue
+				}
+				for j := strings.IndexByte(d, '.'); j >= 0; j = strings.IndexByte(d, '.') {
+					d = d[j+1:]
+					if set["*."+d] {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	cases := []struct {
+		domain string
+		valid  bool
+	}{
+		{"gmail.com", true},
+		{"GMAIL.com", true},
+		{"*.example.com", true},
+		{"co.uk", true},
+		{"bücher.de", true},
+		{"xn--bcher-kva.de", true},
+		{"gmail,com", false},
+		{"", false},
+		{"*.", false},
+		{"gmail..com", false},
+		{"gmail.com.", false},
+		{"-gmail.com", false},
+		{"gmail com", false},
+		{"*.*.example.com", false},
+		{strings.Repeat("a", 64) + ".com", false},
+	}
+	for _, c := range cases {
+		if err := ValidateDomain(c.domain); (err == nil) != c.valid {
+			t.Errorf("%q: expected valid %v, got error %v", c.domain, c.valid, err)
+		}
+	}
+}
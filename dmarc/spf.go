@@ -0,0 +1,219 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// ReceivedSPF is the SPF result of a Received-SPF header field, as defined by
+// RFC 7208, section 9.1.
+type ReceivedSPF struct {
+	Value authres.ResultValue
+	// Comment is the text of the comment following the result, if any.
+	Comment string
+	// Params are the key-value pairs, like "receiver" or "identity", with
+	// their key in lowercase.
+	Params map[string]string
+}
+
+// spfResults are the valid results of a Received-SPF header field.
+var spfResults = map[authres.ResultValue]bool{
+	authres.ResultPass:      true,
+	authres.ResultFail:      true,
+	authres.ResultSoftFail:  true,
+	authres.ResultNeutral:   true,
+	authres.ResultNone:      true,
+	authres.ResultTempError: true,
+	authres.ResultPermError: true,
+}
+
+// ParseSPF returns the SPF result of the value of a Received-SPF header
+// field. It returns nil if its receiver is not a trusted authserv-id, or if
+// the result is not about the MAIL FROM identity, like the one of an
+// Authentication-Results header field.
+func (c Config) ParseSPF(value string) (*ReceivedSPF, error) {
+	spf, err := ParseSPFField(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.MatchAuthservID(spf.Params["receiver"]); !ok {
+		return nil, nil
+	}
+	if identity, ok := spf.Params["identity"]; ok && !strings.EqualFold(identity, "mailfrom") {
+		return nil, nil
+	}
+	return spf, nil
+}
+
+// ParseSPFField parses the value of a Received-SPF header field, regardless
+// of whether it is trusted.
+func ParseSPFField(value string) (*ReceivedSPF, error) {
+	p := spfParser{s: value}
+	p.skipSpace()
+	spf := &ReceivedSPF{Value: authres.ResultValue(strings.ToLower(p.token()))}
+	if !spfResults[spf.Value] {
+		return nil, fmt.Errorf("invalid result %q", spf.Value)
+	}
+	p.skipSpace()
+	if p.peek() == '(' {
+		comment, err := p.comment()
+		if err != nil {
+			return nil, err
+		}
+		spf.Comment = comment
+	}
+	spf.Params = make(map[string]string)
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if p.done() {
+			return spf, nil
+		}
+		key := strings.ToLower(p.token())
+		if key == "" {
+			return nil, fmt.Errorf("expected key at %q", p.s)
+		}
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if p.peek() != '=' {
+			return nil, fmt.Errorf("expected \"=\" after key %q", key)
+		}
+		p.s = p.s[1:]
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		spf.Params[key] = val
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		switch p.peek() {
+		case ';':
+			p.s = p.s[1:]
+		case 0:
+		default:
+			return nil, fmt.Errorf("expected \";\" after the value of %q", key)
+		}
+	}
+}
+
+// spfParser is a parser of the Received-SPF grammar, consuming s.
+type spfParser struct {
+	s string
+}
+
+func (p *spfParser) done() bool {
+	return p.s == ""
+}
+
+// peek returns the next byte, or 0 at the end.
+func (p *spfParser) peek() byte {
+	if p.s == "" {
+		return 0
+	}
+	return p.s[0]
+}
+
+func (p *spfParser) skipSpace() {
+	p.s = strings.TrimLeft(p.s, " \t\r\n")
+}
+
+// skipCFWS skips the spaces and the comments.
+func (p *spfParser) skipCFWS() error {
+	for {
+		p.skipSpace()
+		if p.peek() != '(' {
+			return nil
+		}
+		if _, err := p.comment(); err != nil {
+			return err
+		}
+	}
+}
+
+// token returns the text up to the next space, comment, "=" or ";".
+func (p *spfParser) token() string {
+	i := strings.IndexAny(p.s, " \t\r\n(=;")
+	if i < 0 {
+		i = len(p.s)
+	}
+	tok := p.s[:i]
+	p.s = p.s[i:]
+	return tok
+}
+
+// comment returns the text of the comment starting at the current position,
+// which can contain nested comments and quoted pairs.
+func (p *spfParser) comment() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(p.s); i++ {
+		switch c := p.s[i]; c {
+		case '\\':
+			if i++; i < len(p.s) {
+				b.WriteByte(p.s[i])
+			}
+			continue
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				p.s = p.s[i+1:]
+				return b.String(), nil
+			}
+		}
+		b.WriteByte(p.s[i])
+	}
+	return "", errors.New("unterminated comment")
+}
+
+// value returns a dot-atom or the content of a quoted string.
+func (p *spfParser) value() (string, error) {
+	if p.peek() != '"' {
+		return p.token(), nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(p.s); i++ {
+		switch c := p.s[i]; c {
+		case '\\':
+			if i++; i < len(p.s) {
+				b.WriteByte(p.s[i])
+			}
+		case '"':
+			p.s = p.s[i+1:]
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
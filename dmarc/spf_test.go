@@ -0,0 +1,106 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package dmarc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+func TestParseSPFField(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected ReceivedSPF
+	}{
+		{
+			// policyd-spf
+			value: "Pass (mailfrom) identity=mailfrom; client-ip=192.0.2.1; helo=mail.example.com; envelope-from=alice@example.com; receiver=mail.club1.fr ",
+			expected: ReceivedSPF{Value: authres.ResultPass, Comment: "mailfrom", Params: map[string]string{
+				"identity": "mailfrom", "client-ip": "192.0.2.1", "helo": "mail.example.com", "envelope-from": "alice@example.com", "receiver": "mail.club1.fr",
+			}},
+		},
+		{
+			value: `softfail (mail.club1.fr: domain of transitioning alice@example.com does not designate 2001:db8::1 as permitted sender) client-ip=2001:db8::1; envelope-from="alice@example.com"; helo=mail.example.com;`,
+			expected: ReceivedSPF{Value: authres.ResultSoftFail, Comment: "mail.club1.fr: domain of transitioning alice@example.com does not designate 2001:db8::1 as permitted sender", Params: map[string]string{
+				"client-ip": "2001:db8::1", "envelope-from": "alice@example.com", "helo": "mail.example.com",
+			}},
+		},
+		{
+			value: "none (nested (comment) \\) ) receiver = mail.club1.fr (trailing) ; problem=\"no \\\"record\\\"; found\"",
+			expected: ReceivedSPF{Value: authres.ResultNone, Comment: "nested (comment) ) ", Params: map[string]string{
+				"receiver": "mail.club1.fr", "problem": `no "record"; found`,
+			}},
+		},
+		{
+			value:    "TempError",
+			expected: ReceivedSPF{Value: authres.ResultTempError, Params: map[string]string{}},
+		},
+	}
+	for _, c := range cases {
+		spf, err := ParseSPFField(c.value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(*spf, c.expected) {
+			t.Errorf("%q: expected %#v, got %#v", c.value, c.expected, *spf)
+		}
+	}
+	for _, value := range []string{
+		"",
+		"dkim=pass",
+		"pass (unterminated comment",
+		"pass receiver",
+		`pass problem="unterminated`,
+		"pass receiver=mail.club1.fr helo=mail.example.com",
+	} {
+		if spf, err := ParseSPFField(value); err == nil {
+			t.Errorf("%q: expected error, got %#v", value, spf)
+		}
+	}
+}
+
+func TestParseSPF(t *testing.T) {
+	cfg := Config{AuthservID: "mail.club1.fr"}
+	cases := []struct {
+		value    string
+		expected authres.ResultValue
+	}{
+		{"fail (mailfrom) identity=mailfrom; receiver=MAIL.club1.fr", authres.ResultFail},
+		{"fail receiver=mail.club1.fr", authres.ResultFail},
+		{"pass (helo) identity=helo; receiver=mail.club1.fr", ""},
+		{"pass (mailfrom) identity=mailfrom; receiver=mail.example.com", ""},
+		{"pass (mailfrom) identity=mailfrom", ""},
+	}
+	for _, c := range cases {
+		spf, err := cfg.ParseSPF(c.value)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.value, err)
+			continue
+		}
+		var actual authres.ResultValue
+		if spf != nil {
+			actual = spf.Value
+		}
+		if actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.value, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/club-1/dmarcator/dmarc"
+)
+
+const (
+	// dmarcPolicyTTL is the duration for which the DMARC policies looked up
+	// by the DNS fallback are cached.
+	dmarcPolicyTTL = 5 * time.Minute
+	// maxCachedPolicies is the number of cached policies above which the
+	// cache is emptied, to bound its memory usage.
+	maxCachedPolicies = 10000
+)
+
+// lookupTXT is the function used to look up TXT records, replaced in tests.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+type cachedPolicy struct {
+	policy  string
+	expires time.Time
+}
+
+// policyCache caches the DMARC policies of the domains, to avoid querying the
+// DNS for each message. It is safe for concurrent use.
+type policyCache struct {
+	mu       sync.Mutex
+	policies map[string]cachedPolicy
+}
+
+var dmarcPolicies = &policyCache{policies: make(map[string]cachedPolicy)}
+
+// lookup returns the DMARC policy published by domain, or by its
+// organizational domain if it does not publish any, as defined by RFC 7489.
+// It returns an empty string if there is no DMARC record. The lookup is
+// bounded by the given timeout, and the results are cached for a while,
+// except in case of error.
+func (c *policyCache) lookup(domain string, timeout time.Duration) (string, error) {
+	domain = strings.ToLower(domain)
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.policies[domain]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.policy, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	policy, found, err := lookupDMARCRecord(ctx, domain, "p")
+	if err == nil && !found {
+		if org := dmarc.OrgDomain(domain); org != domain {
+			policy, _, err = lookupDMARCRecord(ctx, org, "sp", "p")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if len(c.policies) >= maxCachedPolicies {
+		c.policies = make(map[string]cachedPolicy)
+	}
+	c.policies[domain] = cachedPolicy{policy: policy, expires: now.Add(dmarcPolicyTTL)}
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// lookupDMARCRecord queries the DMARC record of domain, and returns the
+// value of the first of tags present in it, and whether there is a record.
+func lookupDMARCRecord(ctx context.Context, domain string, tags ...string) (string, bool, error) {
+	records, err := lookupTXT(ctx, "_dmarc."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	for _, record := range records {
+		if values, ok := parseDMARCRecord(record); ok {
+			for _, tag := range tags {
+				if v, ok := values[tag]; ok {
+					return v, true, nil
+				}
+			}
+			return "", true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// parseDMARCRecord parses the tags of a DMARC TXT record, with their values
+// lowercased. It reports whether the record is a DMARC one.
+func parseDMARCRecord(record string) (map[string]string, bool) {
+	values := make(map[string]string)
+	for i, part := range strings.Split(record, ";") {
+		tag, value, _ := strings.Cut(part, "=")
+		tag = strings.TrimSpace(tag)
+		value = strings.TrimSpace(value)
+		if i == 0 && (tag != "v" || value != "DMARC1") {
+			return nil, false
+		}
+		if tag != "" {
+			values[tag] = strings.ToLower(value)
+		}
+	}
+	return values, true
+}
@@ -0,0 +1,217 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/emersion/go-milter"
+)
+
+// fakeTXT replaces lookupTXT with a lookup in records for the duration of
+// the test, and returns the names that were queried.
+func fakeTXT(t *testing.T, records map[string][]string) *[]string {
+	prevLookup, prevPolicies := lookupTXT, dmarcPolicies
+	t.Cleanup(func() { lookupTXT, dmarcPolicies = prevLookup, prevPolicies })
+	dmarcPolicies = &policyCache{policies: make(map[string]cachedPolicy)}
+	var mu sync.Mutex
+	var queries []string
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		mu.Lock()
+		queries = append(queries, name)
+		mu.Unlock()
+		if name == "_dmarc.slow.example" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		txt, ok := records[name]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return txt, nil
+	}
+	return &queries
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	cases := []struct {
+		record   string
+		expected map[string]string
+		ok       bool
+	}{
+		{"v=DMARC1; p=reject; sp=none", map[string]string{"v": "dmarc1", "p": "reject", "sp": "none"}, true},
+		{"v=DMARC1;p=Quarantine;", map[string]string{"v": "dmarc1", "p": "quarantine"}, true},
+		{"v=spf1 -all", nil, false},
+		{"p=reject; v=DMARC1", nil, false},
+	}
+	for _, c := range cases {
+		values, ok := parseDMARCRecord(c.record)
+		if ok != c.ok || !reflect.DeepEqual(values, c.expected) {
+			t.Errorf("%q: expected %v %v, got %v %v", c.record, c.expected, c.ok, values, ok)
+		}
+	}
+}
+
+func TestPolicyCacheLookup(t *testing.T) {
+	queries := fakeTXT(t, map[string][]string{
+		"_dmarc.example.com":    {"v=spf1 -all", "v=DMARC1; p=reject"},
+		"_dmarc.example.org":    {"v=DMARC1; p=none; sp=quarantine"},
+		"_dmarc.broken.example": {"not dmarc"},
+	})
+	cases := []struct {
+		domain   string
+		expected string
+		queries  []string
+	}{
+		{"example.com", "reject", []string{"_dmarc.example.com"}},
+		{"EXAMPLE.com", "reject", nil},
+		{"mail.example.org", "quarantine", []string{"_dmarc.mail.example.org", "_dmarc.example.org"}},
+		{"example.net", "", []string{"_dmarc.example.net"}},
+		{"broken.example", "", []string{"_dmarc.broken.example"}},
+	}
+	for _, c := range cases {
+		*queries = nil
+		policy, err := dmarcPolicies.lookup(c.domain, time.Second)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.domain, err)
+		}
+		if policy != c.expected {
+			t.Errorf("%q: expected policy %q, got %q", c.domain, c.expected, policy)
+		}
+		if !reflect.DeepEqual(c.queries, *queries) {
+			t.Errorf("%q: expected queries %q, got %q", c.domain, c.queries, *queries)
+		}
+	}
+
+	start := time.Now()
+	_, err := dmarcPolicies.lookup("slow.example", 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected lookup to be bounded by the timeout, took %v", d)
+	}
+}
+
+func TestFallbackDNS(t *testing.T) {
+	fakeTXT(t, map[string][]string{
+		"_dmarc.example.com":      {"v=DMARC1; p=reject"},
+		"_dmarc.example.org":      {"v=DMARC1; p=quarantine"},
+		"_dmarc.example.net":      {"v=DMARC1; p=none"},
+		"_dmarc.example.info":     {"v=DMARC1; p=reject"},
+		"_dmarc.unlisted.example": {"v=DMARC1; p=reject"},
+	})
+	cases := []struct {
+		name   string
+		from   string
+		action *milter.Action
+		reason Reason
+		// listed is set if fallbackDecision takes the decision.
+		listed bool
+		output []string
+	}{
+		{
+			name: "reject policy",
+			from: "sender@example.com",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy",
+			},
+			reason: ReasonFallbackPolicy,
+			listed: true,
+			output: []string{"QUEUEID: reject dmarc=unknown from=unknown fallback_policy=reject"},
+		},
+		{
+			name: "quarantine policy",
+			from: "sender@example.org",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.org overriding policy",
+			},
+			reason: ReasonFallbackPolicy,
+			listed: true,
+			output: []string{"QUEUEID: reject dmarc=unknown from=unknown fallback_policy=quarantine"},
+		},
+		{
+			name:   "action of the domain",
+			from:   "sender@example.info",
+			action: &milter.Action{Code: milter.ActContinue},
+			reason: ReasonFallbackPolicy,
+			listed: true,
+			output: []string{"QUEUEID: quarantine dmarc=unknown from=unknown fallback_policy=reject"},
+		},
+		{
+			name:   "none policy",
+			from:   "sender@example.net",
+			action: &milter.Action{Code: milter.ActAccept},
+			reason: ReasonFallbackPolicy,
+			listed: true,
+		},
+		{
+			name:   "no record",
+			from:   "sender@club1.fr",
+			action: &milter.Action{Code: milter.ActAccept},
+			reason: ReasonNoRecord,
+			listed: true,
+			output: []string{"QUEUEID: accept dmarc=unknown from=unknown fallback_policy= "},
+		},
+		{
+			name:   "timeout",
+			from:   "sender@slow.example",
+			action: &milter.Action{Code: milter.ActAccept},
+			reason: ReasonFallbackError,
+			listed: true,
+			output: []string{`QUEUEID: accept dmarc=unknown from=unknown fallback_error="context deadline exceeded"`},
+		},
+		{
+			name:   "unlisted domain",
+			from:   "sender@unlisted.example",
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`QUEUEID: accept dmarc=unknown from=unknown addr="sender@unlisted.example" header_from_domain=unlisted.example reason=no-trusted-authres`},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+FallbackDNS = true
+FallbackDNSTimeout = "10ms"
+LogAccept = true
+RejectDomains = ["example.com", "example.org", "example.net", "club1.fr", "slow.example"]
+DomainActions = { "example.info" = "quarantine" }
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, []string{"From", c.from}, c.action, c.output...)
+			confMu.RLock()
+			d, _, listed := fallbackDecision(c.from, dmarc.AddressDomain(c.from))
+			confMu.RUnlock()
+			if listed != c.listed || d.Reason != c.reason {
+				t.Errorf("expected reason %q and listed %v, got %q and %v", c.reason, c.listed, d.Reason, listed)
+			}
+		})
+	}
+}
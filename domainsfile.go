@@ -0,0 +1,63 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// domainLists holds the lists of domains loaded from RejectDomainsURL and
+// RejectDomainsFile, so that the current domains can be rebuilt when only one
+// of them changes.
+var domainLists struct {
+	mu     sync.Mutex
+	remote []string
+	file   []string
+}
+
+// storeDomainLists replaces the current domains with the ones of the config
+// and of the lists. The caller must hold domainLists.mu, and confMu before
+// it.
+func storeDomainLists() {
+	currentDomains.Store(buildDomains(domainLists.remote, domainLists.file))
+}
+
+// loadDomainsFile reads RejectDomainsFile and replaces its domains in the
+// current ones, leaving the other sources untouched. It returns the number
+// of domains of the file before and after. In case of error, the previous
+// list is kept.
+func loadDomainsFile() (before, after int, err error) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	f, err := os.Open(conf.RejectDomainsFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	domains, err := parseDomainList(f, conf.StripTrailingDot)
+	if err != nil {
+		return 0, 0, err
+	}
+	domainLists.mu.Lock()
+	defer domainLists.mu.Unlock()
+	before = len(domainLists.file)
+	domainLists.file = domains
+	storeDomainLists()
+	return before, len(domains), nil
+}
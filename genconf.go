@@ -0,0 +1,137 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	_ "embed"
+	"encoding"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exampleConf is the documented example config, from which the comments of
+// the generated config are taken.
+//
+//go:embed dmarcator.conf
+var exampleConf string
+
+// confKeyRe matches the first line of the value of an option or of a table
+// in the example config, commented or not.
+var confKeyRe = regexp.MustCompile(`^#?(?:([A-Z][A-Za-z0-9]*) =|\[\[([A-Z][A-Za-z0-9]*)\]\])`)
+
+// confDocs parses the example config into the comment of each option, and
+// the commented example of each table.
+func confDocs() (comments map[string]string, tables map[string]string) {
+	comments = make(map[string]string)
+	tables = make(map[string]string)
+	for _, block := range strings.Split(strings.TrimSpace(exampleConf), "\n\n") {
+		lines := strings.Split(block, "\n")
+		for i, line := range lines {
+			m := confKeyRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			comment := strings.Join(lines[:i], "\n")
+			if m[1] != "" {
+				comments[m[1]] = comment
+			} else {
+				comments[m[2]] = comment
+				tables[m[2]] = strings.Join(lines[i:], "\n")
+			}
+			break
+		}
+	}
+	return comments, tables
+}
+
+// generateConf writes a config documenting every field of Conf, with the
+// comments of the example config, and with all the options commented out
+// with their default value, so that the config has no effect until edited.
+// The tables are written last, with their commented example, as TOML
+// requires.
+func generateConf(w io.Writer) error {
+	comments, tables := confDocs()
+	defaults := reflect.ValueOf(defaultConf())
+	var options, arrays []string
+	for i := 0; i < defaults.NumField(); i++ {
+		field := defaults.Type().Field(i)
+		value := defaults.Field(i)
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct {
+			arrays = append(arrays, comments[field.Name]+"\n"+tables[field.Name])
+			continue
+		}
+		options = append(options, fmt.Sprintf("%s\n#%s = %s", comments[field.Name], field.Name, confValue(field.Name, value)))
+	}
+	_, err := fmt.Fprintf(w, "# Generated by dmarcator %s. All the options are commented out with\n# their default value.\n\n%s\n",
+		version, strings.Join(append(options, arrays...), "\n\n"))
+	return err
+}
+
+// confValue formats v, the value of the option name, in TOML.
+func confValue(name string, v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Duration:
+		return strconv.Quote(confDuration(x))
+	case encoding.TextMarshaler:
+		text, _ := x.MarshalText()
+		return strconv.Quote(string(text))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		values := make([]string, v.Len())
+		for i := range values {
+			values[i] = confValue(name, v.Index(i))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case reflect.Map:
+		if v.Len() == 0 {
+			return "{}"
+		}
+		pairs := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			pairs = append(pairs, strconv.Quote(k.String())+" = "+confValue(name, v.MapIndex(k)))
+		}
+		sort.Strings(pairs)
+		return "{ " + strings.Join(pairs, ", ") + " }"
+	}
+	if name == "UMask" {
+		return fmt.Sprintf("0o%03o", v.Int())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// confDuration formats d without its trailing zero units, as in "1h"
+// instead of "1h0m0s".
+func confDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
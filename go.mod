@@ -6,6 +6,10 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/emersion/go-milter v0.4.1
 	github.com/emersion/go-msgauth v0.7.0
+	golang.org/x/net v0.35.0
 )
 
-require github.com/emersion/go-message v0.18.1 // indirect
+require (
+	github.com/emersion/go-message v0.18.1 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
@@ -0,0 +1,159 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// learnFlushInterval is the interval at which the learned domains are saved
+// in LearnFile.
+const learnFlushInterval = time.Minute
+
+// learnedDomains counts the messages with a DMARC result of "fail" or "none"
+// by domain, when LearnFile is set.
+var learnedDomains learner
+
+// learner accumulates counts of domains and saves them in a file, with one
+// domain per line followed by its count as a comment, so that the file can
+// be used as a list of RejectDomainsURL once reviewed.
+type learner struct {
+	mu     sync.Mutex
+	path   string
+	counts map[string]int64
+	dirty  bool
+}
+
+// load resets the learner to save the counts in path, starting from the
+// ones already saved in it, if it exists. An empty path disables it.
+func (ln *learner) load(path string) error {
+	counts := make(map[string]int64)
+	f, err := os.Open(path)
+	switch {
+	case path == "":
+	case err == nil:
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			domain, comment, _ := strings.Cut(line, "#")
+			domain = strings.TrimSpace(domain)
+			count, err := strconv.ParseInt(strings.TrimSpace(comment), 10, 64)
+			if domain == "" || err != nil {
+				return fmt.Errorf("line %d: invalid entry %q", n, line)
+			}
+			counts[domain] += count
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.path = path
+	ln.counts = counts
+	ln.dirty = false
+	return nil
+}
+
+// add records an occurrence of domain, if the learner is loaded.
+func (ln *learner) add(domain string) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.path == "" {
+		return
+	}
+	ln.counts[domain]++
+	ln.dirty = true
+}
+
+// flush saves the counts in the file, by decreasing count, if they changed
+// since the last call. The file is replaced atomically, so that it is never
+// seen partially written.
+func (ln *learner) flush() error {
+	ln.mu.Lock()
+	if !ln.dirty {
+		ln.mu.Unlock()
+		return nil
+	}
+	path := ln.path
+	counts := make([]domainCount, 0, len(ln.counts))
+	for domain, count := range ln.counts {
+		counts = append(counts, domainCount{domain, count})
+	}
+	ln.dirty = false
+	ln.mu.Unlock()
+
+	sortDomainCounts(counts)
+	var b strings.Builder
+	for _, dc := range counts {
+		fmt.Fprintf(&b, "%s # %d\n", dc.Domain, dc.Count)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		ln.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.markDirty()
+		return err
+	}
+	return nil
+}
+
+// markDirty makes the next flush save the counts again, after a failure.
+func (ln *learner) markDirty() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.dirty = true
+}
+
+// flushLearned saves the learned domains, logging the failures.
+func flushLearned() {
+	if err := learnedDomains.flush(); err != nil {
+		l.Print("Failed to save LearnFile: ", err)
+	}
+}
+
+// flushLearnedEvery saves the learned domains at the given interval, until
+// done is closed.
+func flushLearnedEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flushLearned()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/club-1/dmarcator/miltertest"
+)
+
+func TestLearner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned.txt")
+	if err := os.WriteFile(path, []byte("gmail.com # 2\n\nhotmail.fr # 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var ln learner
+	if err := ln.load(path); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	for _, domain := range []string{"hotmail.fr", "example.com", "hotmail.fr", "hotmail.fr"} {
+		ln.add(domain)
+	}
+	if err := ln.flush(); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hotmail.fr # 4\ngmail.com # 2\nexample.com # 1\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+	// The file is a valid list of domains.
+	domains, err := parseDomainList(strings.NewReader(string(content)), false)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if expected := []string{"hotmail.fr", "gmail.com", "example.com"}; !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	os.WriteFile(path, []byte("gmail.com # 2\nhotmail.fr\n"), 0o644)
+	err = ln.load(path)
+	if err == nil || !strings.Contains(err.Error(), `line 2: invalid entry "hotmail.fr"`) {
+		t.Errorf("expected invalid entry error, got %v", err)
+	}
+
+	if err := ln.load(filepath.Join(t.TempDir(), "missing.txt")); err != nil {
+		t.Error("unexpected error for missing file: ", err)
+	}
+}
+
+func TestLearnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned.txt")
+	// Registered before the setup, to run once the server is stopped.
+	t.Cleanup(func() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "gmail.com # 2\nexample.com # 1\n"; string(content) != expected {
+			t.Errorf("expected %q, got %q", expected, content)
+		}
+	})
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LearnFile = "` + path + `"
+`
+	network, address, _ := setup(t, config)
+	for _, result := range []string{"fail header.from=gmail.com", "none header.from=Gmail.com", "fail header.from=example.com", "pass header.from=hotmail.fr", "temperror header.from=hotmail.fr"} {
+		session := miltertest.Session(t, network, address)
+		miltertest.Headers(t, session, []string{"i", "QUEUEID"}, "Authentication-Results", "mail.club1.fr; dmarc="+result)
+	}
+}
@@ -0,0 +1,620 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-milter"
+)
+
+// listen creates a listener from an URI of the form "network://address". If
+// reusePort is set, SO_REUSEPORT is set on TCP sockets.
+func listen(uri string, reusePort bool) (net.Listener, error) {
+	network, address, err := parseListenURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && !isAbstractUnix(uri) {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	var lc net.ListenConfig
+	if reusePort && network != "unix" {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// removeStaleSocket removes the unix socket at path if no process listens on
+// it anymore, like the one left by a crash, or by a chroot, which prevents it
+// from being removed on stop. Other files are left to make listen fail.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSocket == 0 {
+		return nil
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	l.Printf("Removed stale socket %s", path)
+	return nil
+}
+
+// setBacklog sets the maximum number of pending connections of the socket of
+// ln. The backlog cannot be given to the net package, which uses the limit of
+// the system, or set in the Control hook of a net.ListenConfig, which runs
+// before listen(2), so listen(2) is called again on the listening socket,
+// which updates its backlog.
+func setBacklog(ln net.Listener, backlog int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unsupported listener %T", ln)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// listenNetworks are the networks supported in the listen URIs.
+var listenNetworks = []string{"unix", "tcp", "tcp4", "tcp6"}
+
+// parseListenURI splits an URI of the form "network://address" and checks
+// that the address is valid for the network, so that malformed addresses,
+// like an IPv6 literal without brackets, are reported clearly, with an
+// example of the correct form when possible.
+func parseListenURI(uri string) (network, address string, err error) {
+	network, address, found := strings.Cut(uri, "://")
+	if !found {
+		// Like "unix:/run/dmarcator.sock", with a known network.
+		if network, rest, ok := strings.Cut(uri, ":"); ok && isListenNetwork(network) {
+			return "", "", fmt.Errorf("invalid listen URI %q: the network must be followed by \"://\", as in %q", uri, exampleListenURI(network, rest))
+		}
+		return "", "", fmt.Errorf("invalid listen URI %q: missing \"://\", as in \"unix:///run/dmarcator/dmarcator.sock\" or \"tcp://127.0.0.1:8891\"", uri)
+	}
+	if !isListenNetwork(network) {
+		return "", "", fmt.Errorf("invalid listen URI %q: unsupported network %q, must be one of %s", uri, network, strings.Join(listenNetworks, ", "))
+	}
+	if network == "unix" {
+		if address == "" {
+			return "", "", fmt.Errorf("invalid listen URI %q: empty socket path, as in \"unix://\" followed by a path like \"/run/dmarcator/dmarcator.sock\"", uri)
+		}
+		return network, address, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return "", "", fmt.Errorf("invalid listen URI %q: IPv6 addresses must be enclosed in brackets, as in \"[::1]:8891\"", uri)
+		}
+		example := network + "://127.0.0.1:8891"
+		if network == "tcp6" {
+			example = network + "://[::1]:8891"
+		}
+		return "", "", fmt.Errorf("invalid listen URI %q: %v, expected host:port as in %q", uri, err, example)
+	}
+	ipHost, _, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(ipHost)
+	switch {
+	case ip == nil:
+	case network == "tcp4" && ip.To4() == nil:
+		return "", "", fmt.Errorf("invalid listen URI %q: IPv6 address %q with network tcp4", uri, host)
+	case network == "tcp6" && ip.To4() != nil && !strings.Contains(host, ":"):
+		return "", "", fmt.Errorf("invalid listen URI %q: IPv4 address %q with network tcp6", uri, host)
+	}
+	return network, address, nil
+}
+
+// isListenNetwork reports whether network is one of listenNetworks.
+func isListenNetwork(network string) bool {
+	for _, n := range listenNetworks {
+		if network == n {
+			return true
+		}
+	}
+	return false
+}
+
+// exampleListenURI returns the listen URI probably meant by an address given
+// after network with a wrong separator. The paths of unix sockets are shown
+// as absolute, which they usually are.
+func exampleListenURI(network, address string) string {
+	address = strings.TrimLeft(address, "/")
+	if network == "unix" {
+		address = "/" + address
+	}
+	return network + "://" + address
+}
+
+// isAbstractUnix reports whether uri designates a Linux abstract unix socket,
+// whose address starts with "@" or a null byte. Such sockets have no path in
+// the filesystem, so file permissions do not apply to them.
+func isAbstractUnix(uri string) bool {
+	network, address, _ := strings.Cut(uri, "://")
+	return network == "unix" && (strings.HasPrefix(address, "@") || strings.HasPrefix(address, "\x00"))
+}
+
+// timeoutListener wraps a listener so that the accepted connections time out
+// when no data has been received from the client for the given duration.
+type timeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (ln timeoutListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: c, timeout: ln.timeout, probe: probeOf(c)}, nil
+}
+
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	// probe is the underlying probeConn, that knows the queue ID.
+	probe *probeConn
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// The queue ID of the current message, if any, is followed by the
+		// probeConn, as the session is not reachable from the connection.
+		if c.probe != nil && c.probe.queueID != "" {
+			l.Printf("%s: session timeout after %v: client=%q", c.probe.queueID, c.timeout, c.RemoteAddr().String())
+		} else {
+			l.Printf("session timeout after %v: client=%q", c.timeout, c.RemoteAddr().String())
+		}
+	}
+	return n, err
+}
+
+// probeOf returns the probeConn wrapped by c, or nil if there is none.
+func probeOf(c net.Conn) *probeConn {
+	switch c := c.(type) {
+	case *probeConn:
+		return c
+	case *limitConn:
+		return probeOf(c.Conn)
+	}
+	return nil
+}
+
+// limitListener wraps a listener to limit the number of simultaneously
+// accepted connections. When the limit is reached, the new connection is
+// held until one of the others is closed.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (ln *limitListener) acquire() bool {
+	select {
+	case ln.sem <- struct{}{}:
+		return true
+	default:
+	}
+	l.Printf("Max connections reached (%d), new connection waiting for a session to end", cap(ln.sem))
+	select {
+	case ln.sem <- struct{}{}:
+		return true
+	case <-ln.done:
+		return false
+	}
+}
+
+func (ln *limitListener) release() {
+	<-ln.sem
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ln.acquire() {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	return &limitConn{Conn: c, release: ln.release}, nil
+}
+
+func (ln *limitListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	release     func()
+	releaseOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// probeListener wraps a listener to detect the connections that are closed
+// without the MTA sending any message, like the ones made by monitoring
+// systems to check that the milter is alive.
+type probeListener struct {
+	net.Listener
+	// protocol are the protocol steps requested by the server of the
+	// listener, to be logged.
+	protocol milter.OptProtocol
+}
+
+func (ln probeListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	pc := &probeConn{Conn: c, protocol: ln.protocol}
+	sessions.add(pc)
+	return pc, nil
+}
+
+type probeConn struct {
+	net.Conn
+	protocol  milter.OptProtocol
+	scanner   commandScanner
+	closeOnce sync.Once
+	// pending is the rest of the last packet read from the MTA, not yet
+	// read by the server.
+	pending []byte
+	// offered are the actions and protocol steps offered by the MTA, to
+	// which the answer of the negotiation is restricted if onError is set.
+	offeredActions  milter.OptAction
+	offeredProtocol milter.OptProtocol
+	// onError is the OnProtocolError action taken for the messages of the
+	// connection, if its negotiation is incompatible.
+	onError string
+	// queueID is the value of the "i" macro of the current message, empty
+	// between messages.
+	queueID string
+	// clientAddr is the address of the SMTP client, from the Connect stage
+	// or the {client_addr} macro, given to every message of the connection,
+	// as the server renews its session for each of them.
+	clientAddr string
+	// mailMacros is set once the macros of the MAIL FROM stage of the
+	// current message are read.
+	mailMacros bool
+}
+
+// Read reads the packets of the MTA one at a time, so that they can be
+// followed, completed with the client address and, if the negotiation is
+// incompatible, answered without being passed to the server.
+func (c *probeConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		packet, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.handle(packet)
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readPacket reads the next packet of the MTA, with its length.
+func (c *probeConn) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return nil, errors.New("empty milter packet")
+	}
+	packet := make([]byte, 4+int(length))
+	copy(packet, header)
+	if _, err := io.ReadFull(c.Conn, packet[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	negotiated := c.scanner.negotiated()
+	c.scanner.scan(packet)
+	if !negotiated && c.scanner.negotiated() {
+		c.negotiate(c.scanner.optNeg[1:])
+	}
+	return packet, nil
+}
+
+// handle follows a packet of the MTA and returns the packets to pass to the
+// server instead, which are none if it was answered.
+func (c *probeConn) handle(packet []byte) []byte {
+	data := packet[4:]
+	switch milter.Code(data[0]) {
+	case milter.CodeConn:
+		if addr := connAddr(data[1:]); addr != "" {
+			c.clientAddr = addr
+		}
+	case milter.CodeMacro:
+		if len(data) < 2 {
+			break
+		}
+		macros := parseMacros(data[2:])
+		if addr := macros["{client_addr}"]; addr != "" {
+			c.clientAddr = addr
+		}
+		if milter.Code(data[1]) != milter.CodeMail {
+			// The queue ID may only be given by a later stage.
+			if id := macros["i"]; id != "" {
+				c.queueID = id
+			}
+			break
+		}
+		c.queueID = macros["i"]
+		c.mailMacros = true
+		if _, ok := macros["{client_addr}"]; !ok && c.clientAddr != "" {
+			return appendPacket(packet, "{client_addr}\x00"+c.clientAddr+"\x00")
+		}
+	case milter.CodeAbort:
+		c.queueID = ""
+	case milter.CodeMail:
+		mailMacros := c.mailMacros
+		c.mailMacros = false
+		if c.onError != "" {
+			c.protocolError()
+			return nil
+		}
+		if !mailMacros && c.clientAddr != "" {
+			// The macros replace the ones of the previous stage, which
+			// are not meant for this one anyway.
+			macros := milterPacket(milter.CodeMacro, string(milter.CodeMail)+"{client_addr}\x00"+c.clientAddr+"\x00")
+			return append(macros, packet...)
+		}
+	}
+	return packet
+}
+
+// connAddr returns the address of the data of a Connect packet, empty if
+// the family is unknown.
+func connAddr(data []byte) string {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || len(data) < i+2 {
+		return ""
+	}
+	family, rest := data[i+1], data[i+2:]
+	switch family {
+	case '4', '6':
+		if len(rest) < 2 {
+			return ""
+		}
+		rest = rest[2:]
+	default:
+		return ""
+	}
+	return strings.TrimSuffix(string(rest), "\x00")
+}
+
+// milterPacket returns the milter packet of a command with the given data.
+func milterPacket(code milter.Code, data string) []byte {
+	b := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(b, uint32(1+len(data)))
+	b[4] = byte(code)
+	copy(b[5:], data)
+	return b
+}
+
+// appendPacket returns packet with data appended, and its length updated.
+func appendPacket(packet []byte, data string) []byte {
+	packet = append(packet, data...)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	return packet
+}
+
+// protocolError answers the MAIL FROM of a message with the OnProtocolError
+// action, without evaluating it.
+func (c *probeConn) protocolError() {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	var action Action
+	resp := milter.RespAccept
+	switch c.onError {
+	case "defer":
+		action, resp = ActionDefer, milter.RespTempFail
+	case "reject":
+		action, resp = ActionReject, milter.RespReject
+	}
+	if action != ActionAccept || logAccept() {
+		logDecision(c.queueID, action.String(), fmt.Sprintf("reason=%s client=%q", ReasonProtocolError, c.RemoteAddr().String()))
+	}
+	countMessage(action, "", ReasonProtocolError)
+	msg := resp.Response()
+	c.Conn.Write(milterPacket(milter.Code(msg.Code), string(msg.Data)))
+}
+
+// Write restricts the answer of an incompatible negotiation to the options
+// offered by the MTA, if OnProtocolError is set.
+func (c *probeConn) Write(b []byte) (int, error) {
+	if c.onError != "" && len(b) >= 4+optNegLen && milter.Code(b[4]) == milter.CodeOptNeg {
+		b = append([]byte(nil), b...)
+		actions := milter.OptAction(binary.BigEndian.Uint32(b[9:13]))
+		protocol := milter.OptProtocol(binary.BigEndian.Uint32(b[13:17]))
+		binary.BigEndian.PutUint32(b[9:13], uint32(actions&c.offeredActions))
+		binary.BigEndian.PutUint32(b[13:17], uint32(protocol&c.offeredProtocol))
+	}
+	return c.Conn.Write(b)
+}
+
+// negotiate logs the milter version, actions and protocol steps offered by
+// the MTA in the data of its option negotiation packet, and warns if some of
+// the actions needed by dmarcator are missing, as the MTA then refuses them
+// when they are applied. The requested protocol steps are the ones of the
+// listener. If some actions or protocol steps are missing and
+// OnProtocolError is set, the messages of the connection are handled with
+// it.
+func (c *probeConn) negotiate(data []byte) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	client := c.RemoteAddr().String()
+	version := binary.BigEndian.Uint32(data[0:4])
+	c.offeredActions = milter.OptAction(binary.BigEndian.Uint32(data[4:8]))
+	c.offeredProtocol = milter.OptProtocol(binary.BigEndian.Uint32(data[8:12]))
+	debugf("Option negotiation from %q: version=%d actions=%#x protocol=%#x requested_actions=%#x requested_protocol=%#x",
+		client, version, c.offeredActions, c.offeredProtocol, milterActions, c.protocol)
+	missingActions := milterActions &^ c.offeredActions
+	missingProtocol := c.protocol &^ c.offeredProtocol
+	if conf.OnProtocolError != "" && (missingActions != 0 || missingProtocol != 0) {
+		c.onError = conf.OnProtocolError
+		l.Printf("Warning: incompatible option negotiation from MTA %q: missing_actions=%#x missing_protocol=%#x, its messages will be handled with OnProtocolError %q",
+			client, missingActions, missingProtocol, c.onError)
+		return
+	}
+	if missingActions != 0 {
+		l.Printf("Warning: MTA %q does not offer the milter actions %#x, the messages to quarantine, tag, stamp with AcceptHeader or strip of OwnedHeaders will be handled according to its default milter action", client, missingActions)
+	}
+}
+
+// parseMacros parses the null-terminated names and values of a macro
+// definition packet, after its command code.
+func parseMacros(data []byte) map[string]string {
+	macros := make(map[string]string)
+	fields := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		macros[fields[i]] = fields[i+1]
+	}
+	return macros
+}
+
+func (c *probeConn) Close() error {
+	c.closeOnce.Do(func() {
+		sessions.remove(c)
+		if !c.scanner.message {
+			metricProbes.Add(1)
+			confMu.RLock()
+			debugf("Health probe from %q: connection closed without message", c.RemoteAddr().String())
+			confMu.RUnlock()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// optNegLen is the length of the start of the option negotiation packet:
+// its code, followed by the version, the actions and the protocol steps.
+const optNegLen = 13
+
+// commandScanner follows the stream of milter packets sent by the MTA to
+// find out which commands were sent, without interpreting them, except for
+// the option negotiation.
+type commandScanner struct {
+	header    [4]byte
+	headerLen int
+	remaining uint32
+	atCode    bool
+	code      milter.Code
+	// message is set once a command other than option negotiation, macro
+	// definition, abort or quit has been seen.
+	message bool
+	// optNeg holds the start of the first option negotiation packet.
+	optNeg []byte
+}
+
+// negotiated reports whether the start of the option negotiation packet has
+// been entirely read.
+func (s *commandScanner) negotiated() bool {
+	return len(s.optNeg) == optNegLen
+}
+
+func (s *commandScanner) scan(b []byte) {
+	for len(b) > 0 {
+		if s.remaining == 0 {
+			n := copy(s.header[s.headerLen:], b)
+			s.headerLen += n
+			b = b[n:]
+			if s.headerLen == len(s.header) {
+				s.remaining = binary.BigEndian.Uint32(s.header[:])
+				s.headerLen = 0
+				s.atCode = true
+			}
+			continue
+		}
+		if s.atCode {
+			s.code = milter.Code(b[0])
+			s.command(s.code)
+			s.atCode = false
+		}
+		n := uint32(len(b))
+		if n > s.remaining {
+			n = s.remaining
+		}
+		if s.code == milter.CodeOptNeg && len(s.optNeg) < optNegLen {
+			take := optNegLen - len(s.optNeg)
+			if take > int(n) {
+				take = int(n)
+			}
+			s.optNeg = append(s.optNeg, b[:take]...)
+		}
+		b = b[n:]
+		s.remaining -= n
+	}
+}
+
+func (s *commandScanner) command(code milter.Code) {
+	switch code {
+	case milter.CodeOptNeg, milter.CodeMacro, milter.CodeAbort, milter.CodeQuit:
+	default:
+		s.message = true
+	}
+}
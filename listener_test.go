@@ -0,0 +1,543 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/club-1/dmarcator/miltertest"
+	"github.com/emersion/go-milter"
+)
+
+func TestSessionTimeout(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+SessionTimeout = "50ms"
+`
+	network, address, out := setup(t, config)
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal("expected connection to be closed by the server, got: ", err)
+	}
+	expected := "session timeout after 50ms"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected log contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+
+	// During a message, the timeout is logged with its queue ID.
+	conn, err = net.Dial(network, address)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(milterPacket(milter.CodeOptNeg, "\x00\x00\x00\x06\x00\x00\x01\xff\x00\x1f\xff\xff"))
+	if code, _ := readMilterPacket(t, conn); milter.Code(code) != milter.CodeOptNeg {
+		t.Fatalf("expected option negotiation, got %q", code)
+	}
+	conn.Write(milterPacket(milter.CodeMacro, "Mi\x00QUEUEID\x00"))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal("expected connection to be closed by the server, got: ", err)
+	}
+	expected = "QUEUEID: session timeout after 50ms: client="
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected log contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+MaxConnections = 1
+`
+	network, address, out := setup(t, config)
+
+	client := milter.NewClientWithOptions(network, address, milter.ClientOptions{
+		Dialer: &net.Dialer{},
+	})
+	defer client.Close()
+	first, err := client.Session()
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	// The second connection is queued until the first session ends.
+	second, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected second connection to time out, got: ", err)
+	}
+	second.Close()
+	expected := "Max connections reached (1)"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected log contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+
+	first.Close()
+	third, err := client.Session()
+	if err != nil {
+		t.Fatal("unexpected error after closing first session: ", err)
+	}
+	third.Close()
+}
+
+func TestHealthProbe(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+LogLevel = "debug"
+`
+	network, address, out := setup(t, config)
+	optneg := milterPacket(milter.CodeOptNeg, "\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00\x00")
+	mail := milterPacket(milter.CodeMail, "<nicolas@example.fr>\x00")
+	quit := milterPacket(milter.CodeQuit, "")
+
+	// send sends the packets, waits for the server to close the connection
+	// and returns the health probe log line about the connection, if any.
+	send := func(packets ...[]byte) string {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		defer conn.Close()
+		conn.Write(bytes.Join(packets, nil))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal("expected connection to be closed by the server, got: ", err)
+		}
+		addr := fmt.Sprintf("%q", conn.LocalAddr().String())
+		for i := 0; i < 50; i++ {
+			for _, line := range strings.Split(out.String(), "\n") {
+				if strings.Contains(line, addr) && strings.HasPrefix(line, "Health probe") {
+					return line
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return ""
+	}
+
+	probes := metricProbes.Value()
+	if line := send(optneg, quit); !strings.HasPrefix(line, "Health probe from") {
+		t.Errorf("expected health probe log line, got %q", line)
+	}
+	if line := send(quit); !strings.HasPrefix(line, "Health probe from") {
+		t.Errorf("expected health probe log line, got %q", line)
+	}
+	if line := send(optneg, mail, quit); line != "" {
+		t.Errorf("expected no health probe log line, got %q", line)
+	}
+	// Connections of previous tests can still be closing, so only a lower
+	// bound is checked.
+	if delta := metricProbes.Value() - probes; delta < 2 {
+		t.Errorf("expected probes_total to increase by at least 2, got %d", delta)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+LogLevel = "debug"
+`
+	network, address, out := setup(t, config)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer conn.Close()
+	// Offers only the add header action, in two writes.
+	optneg := milterPacket(milter.CodeOptNeg, "\x00\x00\x00\x06\x00\x00\x00\x01\x00\x00\x00\x00")
+	conn.Write(optneg[:7])
+	time.Sleep(time.Millisecond)
+	conn.Write(optneg[7:])
+	conn.Write(milterPacket(milter.CodeQuit, ""))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(conn)
+
+	addr := fmt.Sprintf("%q", conn.LocalAddr().String())
+	expected := []string{
+		"Option negotiation from " + addr + ": version=6 actions=0x1 protocol=0x0 requested_actions=0x31 requested_protocol=0x1a",
+		"Warning: MTA " + addr + " does not offer the milter actions 0x30",
+	}
+	for _, e := range expected {
+		if !waitForLog(out, e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+		}
+	}
+}
+
+// readMilterPacket reads a milter packet from conn, and returns its code and
+// data.
+func readMilterPacket(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatal("unexpected error reading packet: ", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal("unexpected error reading packet: ", err)
+	}
+	return data[0], data[1:]
+}
+
+func TestOnProtocolError(t *testing.T) {
+	cases := []struct {
+		name     string
+		onError  string
+		actions  milter.OptAction
+		protocol milter.OptProtocol
+		response milter.ActionCode
+		log      string
+	}{
+		{"disabled", "", milterActions, milterProtocol, milter.ActContinue, "Warning: MTA "},
+		{"accept", "accept", milter.OptAddHeader, 0, milter.ActAccept, "QUEUEID: accept reason=protocol-error client="},
+		{"defer", "defer", milter.OptAddHeader, 0, milter.ActTempFail, "QUEUEID: defer reason=protocol-error client="},
+		{"reject", "reject", milter.OptAddHeader, 0, milter.ActReject, "QUEUEID: reject reason=protocol-error client="},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+OnProtocolError = "` + c.onError + `"
+`
+			network, address, out := setup(t, config)
+			conn, err := net.Dial(network, address)
+			if err != nil {
+				t.Fatal("unexpected error: ", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// Offers only the add header action, and no protocol step to
+			// skip.
+			conn.Write(milterPacket(milter.CodeOptNeg, "\x00\x00\x00\x06\x00\x00\x00\x01\x00\x00\x00\x00"))
+			code, data := readMilterPacket(t, conn)
+			if milter.Code(code) != milter.CodeOptNeg || len(data) != 12 {
+				t.Fatalf("expected option negotiation, got %q %q", code, data)
+			}
+			if actions := milter.OptAction(binary.BigEndian.Uint32(data[4:8])); actions != c.actions {
+				t.Errorf("expected actions %#x, got %#x", c.actions, actions)
+			}
+			if protocol := milter.OptProtocol(binary.BigEndian.Uint32(data[8:12])); protocol != c.protocol {
+				t.Errorf("expected protocol %#x, got %#x", c.protocol, protocol)
+			}
+
+			// Two messages, to check that the whole connection is handled.
+			for i := 0; i < 2; i++ {
+				conn.Write(milterPacket(milter.CodeMacro, "Mi\x00QUEUEID\x00"))
+				conn.Write(milterPacket(milter.CodeMail, "<nicolas@example.fr>\x00"))
+				if code, _ := readMilterPacket(t, conn); milter.ActionCode(code) != c.response {
+					t.Errorf("message %d: expected response %q, got %q", i, c.response, code)
+				}
+				conn.Write(milterPacket(milter.CodeAbort, ""))
+			}
+			if !waitForLog(out, c.log) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.log, out.String())
+			}
+		})
+	}
+}
+
+func TestAdditionalListener(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dmarcator.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogLevel = "debug"
+
+[[Listener]]
+uri = "unix://` + sock + `"
+skip = ["connect", "helo", "rcpt", "body"]
+`
+	_, _, out := setup(t, config)
+	session := miltertest.Session(t, "unix", sock)
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	miltertest.AssertHeaders(t, session, expected, []string{"i", "QUEUEID"},
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com")
+	if e := "requested_protocol=0x1b\n"; !waitForLog(out, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+	}
+}
+
+func TestListenerProtocol(t *testing.T) {
+	cases := []struct {
+		skip     []string
+		expected milter.OptProtocol
+		err      bool
+	}{
+		{nil, milterProtocol, false},
+		{[]string{}, 0, false},
+		{[]string{"connect", "body"}, milter.OptNoConnect | milter.OptNoBody, false},
+		{[]string{"headers"}, 0, true},
+	}
+	for _, c := range cases {
+		protocol, err := ListenerConf{URI: "tcp://127.0.0.1:8891", Skip: c.skip}.protocol()
+		if (err != nil) != c.err || protocol != c.expected {
+			t.Errorf("%q: expected %#x, error %v, got %#x, %v", c.skip, c.expected, c.err, protocol, err)
+		}
+	}
+}
+
+func TestCommandScanner(t *testing.T) {
+	packet := milterPacket
+	cases := []struct {
+		name     string
+		packets  [][]byte
+		expected bool
+	}{
+		{"optneg quit", [][]byte{packet(milter.CodeOptNeg, "012345678901"), packet(milter.CodeQuit, "")}, false},
+		{"macro containing code", [][]byte{packet(milter.CodeMacro, "MM\x00M"), packet(milter.CodeAbort, "")}, false},
+		{"mail", [][]byte{packet(milter.CodeOptNeg, "012345678901"), packet(milter.CodeMail, "<a@b.c>\x00")}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stream := bytes.Join(c.packets, nil)
+			// Feed byte by byte to check that packet boundaries are
+			// followed across reads.
+			var s commandScanner
+			for i := range stream {
+				s.scan(stream[i : i+1])
+			}
+			if s.message != c.expected {
+				t.Errorf("expected message %v, got %v", c.expected, s.message)
+			}
+			if c.packets[0][4] == byte(milter.CodeOptNeg) && (!s.negotiated() || string(s.optNeg[1:]) != "012345678901") {
+				t.Errorf("expected option negotiation data, got %q", s.optNeg)
+			}
+		})
+	}
+}
+
+func TestIsAbstractUnix(t *testing.T) {
+	cases := []struct {
+		uri      string
+		expected bool
+	}{
+		{"unix://@dmarcator", true},
+		{"unix://\x00dmarcator", true},
+		{"unix:///run/dmarcator/dmarcator.sock", false},
+		{"unix://dmarcator.sock", false},
+		{"tcp://@dmarcator", false},
+		{"tcp://127.0.0.1:8080", false},
+	}
+	for _, c := range cases {
+		if actual := isAbstractUnix(c.uri); actual != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.uri, c.expected, actual)
+		}
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	prevLogOut := l.Writer()
+	t.Cleanup(func() { l.SetOutput(prevLogOut) })
+	var out bytes.Buffer
+	l.SetOutput(&out)
+	path := filepath.Join(t.TempDir(), "dmarcator.sock")
+	uri := "unix://" + path
+
+	// A socket left behind, as when chrooted, is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := listen(uri, false)
+	if err != nil {
+		t.Fatal("expected stale socket to be removed, got: ", err)
+	}
+	if expected := "Removed stale socket " + path; !strings.Contains(out.String(), expected) {
+		t.Errorf("expected log contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+
+	// A socket still listened on is kept.
+	if _, err := listen(uri, false); err == nil {
+		t.Error("expected error listening on an active socket")
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Error("expected active socket to be kept, got: ", err)
+	} else {
+		c.Close()
+	}
+	ln.Close()
+
+	// Other files are never removed.
+	if err := os.WriteFile(path, nil, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(uri, false); err == nil {
+		t.Error("expected error listening on a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("expected regular file to be kept, got: ", err)
+	}
+}
+
+func TestParseListenURI(t *testing.T) {
+	valid := []struct {
+		uri     string
+		network string
+		address string
+	}{
+		{"tcp://127.0.0.1:8891", "tcp", "127.0.0.1:8891"},
+		{"tcp://:8891", "tcp", ":8891"},
+		{"tcp://[::1]:8891", "tcp", "[::1]:8891"},
+		{"tcp://[fe80::1%eth0]:8891", "tcp", "[fe80::1%eth0]:8891"},
+		{"tcp4://127.0.0.1:", "tcp4", "127.0.0.1:"},
+		{"tcp6://[::1]:0", "tcp6", "[::1]:0"},
+		{"tcp6://[::ffff:127.0.0.1]:0", "tcp6", "[::ffff:127.0.0.1]:0"},
+		{"tcp6://localhost:8891", "tcp6", "localhost:8891"},
+		{"unix:///run/dmarcator/dmarcator.sock", "unix", "/run/dmarcator/dmarcator.sock"},
+	}
+	for _, c := range valid {
+		network, address, err := parseListenURI(c.uri)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.uri, err)
+			continue
+		}
+		if network != c.network || address != c.address {
+			t.Errorf("%q: expected %q, %q, got %q, %q", c.uri, c.network, c.address, network, address)
+		}
+	}
+	invalid := []struct {
+		uri      string
+		expected string
+	}{
+		{"127.0.0.1:8891", `missing "://", as in "unix:///run/dmarcator/dmarcator.sock" or "tcp://127.0.0.1:8891"`},
+		{"/run/dmarcator/dmarcator.sock", `missing "://"`},
+		{"unix:/run/dmarcator.sock", `the network must be followed by "://", as in "unix:///run/dmarcator.sock"`},
+		{"unix:run/dmarcator.sock", `as in "unix:///run/dmarcator.sock"`},
+		{"tcp:127.0.0.1:8891", `as in "tcp://127.0.0.1:8891"`},
+		{"tcp:/127.0.0.1:8891", `as in "tcp://127.0.0.1:8891"`},
+		{"udp://127.0.0.1:8891", `unsupported network "udp", must be one of unix, tcp, tcp4, tcp6`},
+		{"TCP://127.0.0.1:8891", `unsupported network "TCP"`},
+		{"unix://", "empty socket path"},
+		{"tcp://::1:8891", "IPv6 addresses must be enclosed in brackets"},
+		{"tcp://[::1]", "missing port in address"},
+		{"tcp://127.0.0.1", `missing port in address, expected host:port as in "tcp://127.0.0.1:8891"`},
+		{"tcp6://", `expected host:port as in "tcp6://[::1]:8891"`},
+		{"tcp4://[::1]:8891", `IPv6 address "::1" with network tcp4`},
+		{"tcp6://127.0.0.1:8891", `IPv4 address "127.0.0.1" with network tcp6`},
+	}
+	for _, c := range invalid {
+		_, _, err := parseListenURI(c.uri)
+		if err == nil {
+			t.Errorf("%q: expected error", c.uri)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%q: expected error contains %q, got: %v", c.uri, c.expected, err)
+		}
+	}
+}
+
+func TestIPv6Listener(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available: ", err)
+	}
+	ln.Close()
+	for _, uri := range []string{"tcp://[::1]:", "tcp6://[::1]:0"} {
+		t.Run(uri, func(t *testing.T) {
+			config := fmt.Sprintf(`
+ListenURI = %q
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`, uri)
+			network, address, _ := setup(t, config)
+			if !strings.HasPrefix(address, "[::1]:") {
+				t.Fatalf("expected listener on [::1], got %s://%s", network, address)
+			}
+			session := miltertest.Session(t, network, address)
+			act, err := session.Mail("coucou@gmail.com", nil)
+			if err != nil {
+				t.Fatal("unexpected error: ", err)
+			}
+			if act.Code != milter.ActContinue {
+				t.Errorf("expected continue, got %#v", act)
+			}
+		})
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+	first, err := listen("tcp://127.0.0.1:", true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer first.Close()
+	uri := "tcp://" + first.Addr().String()
+	second, err := listen(uri, true)
+	if err != nil {
+		t.Fatal("expected second listener to share the port, got: ", err)
+	}
+	defer second.Close()
+	if third, err := listen(uri, false); err == nil {
+		third.Close()
+		t.Error("expected listener without ReusePort to fail")
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dmarcator.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ListenBacklog = 16
+
+[[Listener]]
+uri = "unix://` + sock + `"
+`
+	network, address, _ := setup(t, config)
+	for _, addr := range [][2]string{{network, address}, {"unix", sock}} {
+		session := miltertest.Session(t, addr[0], addr[1])
+		miltertest.AssertHeaders(t, session, &milter.Action{Code: milter.ActAccept}, []string{"i", "QUEUEID"},
+			"From", "coucou@example.com",
+		)
+	}
+
+	if err := setBacklog(probeListener{}, 16); err == nil {
+		t.Error("expected error for a listener without socket")
+	}
+}
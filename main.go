@@ -18,135 +18,898 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
-	"mime"
 	"net"
+	"net/http"
 	"net/textproto"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
+	"github.com/club-1/dmarcator/dmarc"
 	"github.com/emersion/go-milter"
 	"github.com/emersion/go-msgauth/authres"
 )
 
+// DomainRule is an entry of the Domain array of tables of the config, that
+// specifies the handling of a domain.
+type DomainRule struct {
+	Name string `toml:"name"`
+	// Action defaults to DefaultDomainAction if not set.
+	Action *Action `toml:"action,omitempty"`
+	// Actions combines a terminal action with the non-terminal actions,
+	// "tag" and "log", instead of Action. Tag cannot be combined with the
+	// actions that do not deliver the message.
+	Actions []RuleAction `toml:"actions,omitempty"`
+	Message string       `toml:"message,omitempty"`
+	Results []string     `toml:"results,omitempty"`
+}
+
+// logAction is the name of the non-terminal action that logs the decisions
+// in full. Unlike "tag", it is not an Action, as it is only valid in the
+// actions of a Domain table.
+const logAction = "log"
+
+// RuleAction is an entry of the actions of a Domain table: an Action, or
+// logAction if Log is set.
+type RuleAction struct {
+	Action Action
+	Log    bool
+}
+
+func (a RuleAction) MarshalText() ([]byte, error) {
+	if a.Log {
+		return []byte(logAction), nil
+	}
+	return a.Action.MarshalText()
+}
+
+func (a *RuleAction) UnmarshalText(text []byte) error {
+	if string(text) == logAction {
+		*a = RuleAction{Log: true}
+		return nil
+	}
+	*a = RuleAction{}
+	return a.Action.UnmarshalText(text)
+}
+
+// rule returns the rule of the trie of the domains.
+func (r DomainRule) rule() dmarc.Rule {
+	rule := dmarc.Rule{Action: conf.DefaultDomainAction, Message: r.Message}
+	if r.Action != nil {
+		rule.Action = *r.Action
+	}
+	for _, action := range r.Actions {
+		switch {
+		case action.Log:
+			rule.Log = true
+		case action.Action == ActionTag:
+			rule.Tag = true
+		default:
+			rule.Action = action.Action
+		}
+	}
+	if rule.Tag && rule.Action == ActionAccept {
+		// Tagging an accepted message is just tagging it.
+		rule.Action, rule.Tag = ActionTag, false
+	}
+	for _, value := range r.Results {
+		rule.Results = append(rule.Results, authres.ResultValue(value))
+	}
+	return rule
+}
+
+// ListenerConf is an entry of the Listener array of tables of the config,
+// that specifies an additional milter listener.
+type ListenerConf struct {
+	URI string `toml:"uri"`
+	// Skip defaults to the stages skipped by the listener of ListenURI if
+	// not set.
+	Skip []string `toml:"skip,omitempty"`
+}
+
+// skippableStages are the protocol stages that a listener can ask the MTA
+// not to send, as they are not needed to take the decision.
+var skippableStages = map[string]milter.OptProtocol{
+	"connect": milter.OptNoConnect,
+	"helo":    milter.OptNoHelo,
+	"rcpt":    milter.OptNoRcptTo,
+	"data":    milter.OptNoData,
+	"unknown": milter.OptNoUnknown,
+	"body":    milter.OptNoBody,
+}
+
+// protocol returns the protocol steps requested to the MTA by the listener.
+func (c ListenerConf) protocol() (milter.OptProtocol, error) {
+	if c.Skip == nil {
+		return milterProtocol, nil
+	}
+	var protocol milter.OptProtocol
+	for _, stage := range c.Skip {
+		opt, ok := skippableStages[stage]
+		if !ok {
+			return 0, fmt.Errorf("unknown stage %q, must be one of connect, helo, rcpt, data, unknown and body", stage)
+		}
+		protocol |= opt
+	}
+	return protocol, nil
+}
+
+// DomainList is a list of domains of the config, that can be given either as
+// an array of strings, or as a single string of domains separated by commas
+// or white space, which are then lowercased.
+type DomainList []string
+
+func (d *DomainList) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		fields := strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		list := make(DomainList, len(fields))
+		for i, field := range fields {
+			list[i] = strings.ToLower(field)
+		}
+		*d = list
+	case []any:
+		list := make(DomainList, len(v))
+		for i, item := range v {
+			domain, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("invalid domain %v: must be a string", item)
+			}
+			list[i] = domain
+		}
+		*d = list
+	default:
+		return fmt.Errorf("invalid domain list %v: must be an array or a string", v)
+	}
+	return nil
+}
+
 type Conf struct {
-	AuthservID    string
-	ListenURI     string
-	RejectDomains []string
-	RejectFmt     string
-	UMask         int
+	AcceptHeader            string
+	AcceptHeaderFmt         string
+	AuditFile               string
+	AuthResHeaders          []string
+	AuthservID              string
+	AuthservIDCheckMessages int
+	AuthservIDFallback      string
+	CaseSensitiveAuthservID bool
+	Chroot                  string
+	ControlListenURI        string
+	DebugQueueIDs           []string
+	DefaultDomainAction     Action
+	Domain                  []DomainRule
+	DomainActions           map[string]Action
+	ExemptReasons           []string
+	ExpvarListenURI         string
+	FallbackDNS             bool
+	FallbackDNSTimeout      time.Duration
+	InternalErrorAction     Action
+	LearnFile               string
+	ListenBacklog           int
+	ListenURI               string
+	Listener                []ListenerConf
+	LogAccepts              string
+	LogAcceptsInterval      time.Duration
+	LogAcceptsRate          int
+	LogFields               []string
+	LogFormat               string
+	LogLevel                string
+	LogSubject              bool
+	LogSubjectLength        int
+	LogUntrustedResults     bool
+	MailingListHeaders      []string
+	MatchHeaderFromDomain   bool
+	MaxConnections          int
+	MaxReplyLength          int
+	MetricsListenURI        string
+	MultiResultPolicy       string
+	NoAuthResultAction      Action
+	OnProtocolError         string
+	OverrideHeader          string
+	OverrideMacro           string
+	OwnedHeaders            []string
+	PermErrorAction         Action
+	ReadReceivedSPF         bool
+	RejectDelay             time.Duration
+	RejectDomains           DomainList
+	RejectDomainsFile       string
+	RejectDomainsRefresh    time.Duration
+	RejectDomainsURL        string
+	RejectEnvelopeMismatch  bool
+	RejectFmt               string
+	RejectFmtByResult       map[string]string
+	RejectMissingFrom       bool
+	RejectMultipleFrom      bool
+	RejectOnFromMismatch    bool
+	RequireFromHeader       bool
+	RespectPublishedPolicy  bool
+	ResultActions           map[string]Action
+	ReusePort               bool
+	SessionTimeout          time.Duration
+	ShutdownTimeout         time.Duration
+	SkipAuthenticated       bool
+	SkipMailingLists        bool
+	StrictConfig            bool
+	StrictMechanismCheck    bool
+	StripTrailingDot        bool
+	TempErrorAction         Action
+	TopRejectedDomains      int
+	TrustedAuthservIDs      []string
+	TrustedNetworks         []string
+	TrustedRelays           []string
+	TrustedSubmitterIPs     []string
+	UMask                   int
 }
 
-// Default values
-var conf = Conf{
-	ListenURI: "unix:///run/dmarcator/dmarcator.sock",
-	RejectFmt: "rejected because of DMARC failure for %s overriding policy",
-	UMask:     0o002,
+// defaultConf returns the default values of the config. A new value is
+// returned each time, as decoding a config file can modify the content of
+// the slices in place.
+func defaultConf() Conf {
+	return Conf{
+		AcceptHeaderFmt:         "dmarc=%s",
+		AuthResHeaders:          []string{"Authentication-Results"},
+		AuthservIDCheckMessages: 100,
+		DefaultDomainAction:     ActionReject,
+		FallbackDNSTimeout:      2 * time.Second,
+		ShutdownTimeout:         10 * time.Second,
+		InternalErrorAction:     ActionAccept,
+		ListenURI:               "unix:///run/dmarcator/dmarcator.sock",
+		LogAccepts:              "all",
+		LogAcceptsInterval:      5 * time.Minute,
+		LogAcceptsRate:          100,
+		LogFormat:               "text",
+		LogLevel:                "info",
+		LogSubjectLength:        80,
+		MailingListHeaders:      []string{"List-Id", "List-Unsubscribe"},
+		MaxReplyLength:          510,
+		MultiResultPolicy:       "first",
+		NoAuthResultAction:      ActionAccept,
+		PermErrorAction:         ActionReject,
+		RejectDomainsRefresh:    time.Hour,
+		RejectFmt:               "rejected because of DMARC failure for %s overriding policy",
+		SkipAuthenticated:       true,
+		StripTrailingDot:        true,
+		TempErrorAction:         ActionDefer,
+		UMask:                   0o002,
+	}
 }
 
+var conf = defaultConf()
+
 // Set by the compiler
-var version = "unknown"
+var (
+	version = "unknown"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// versionString returns the version of dmarcator, along with details about
+// the build.
+func versionString() string {
+	return fmt.Sprintf("dmarcator %s (commit %s, built %s, go %s)", version, commit, date, runtime.Version())
+}
+
+// currentDomains holds the *dmarc.Domains of the actions of the domains. It is
+// replaced atomically when the remote list of domains is refreshed, or when
+// RejectDomainsFile is reloaded.
+var currentDomains atomic.Value
+
+func init() {
+	currentDomains.Store(dmarc.NewDomains())
+}
+
+// domainActions returns the current trie of the actions of the domains.
+func domainActions() *dmarc.Domains {
+	return currentDomains.Load().(*dmarc.Domains)
+}
+
+// hostname returns the name of the host, replaced in tests.
+var hostname = os.Hostname
 
-var rejectDomains = make(map[string]bool)
+// trustedAuthservIDs is the list of the rules of TrustedAuthservIDs.
+var trustedAuthservIDs []dmarc.AuthservRule
+
+// trustedNetworks, trustedRelays and trustedSubmitters are the parsed
+// TrustedNetworks, TrustedRelays and TrustedSubmitterIPs.
+var trustedNetworks, trustedRelays, trustedSubmitters ipNets
+
+// decisionConfig returns the configuration of the dmarc package built from
+// the config.
+func decisionConfig() dmarc.Config {
+	return dmarc.Config{
+		AuthservID:              conf.AuthservID,
+		CaseSensitiveAuthservID: conf.CaseSensitiveAuthservID,
+		TrustedAuthservIDs:      trustedAuthservIDs,
+		Domains:                 domainActions(),
+		ExemptReasons:           conf.ExemptReasons,
+		NoAuthResultAction:      conf.NoAuthResultAction,
+		PermErrorAction:         conf.PermErrorAction,
+		MatchHeaderFromDomain:   conf.MatchHeaderFromDomain,
+		RejectOnFromMismatch:    conf.RejectOnFromMismatch,
+		ResultActions:           conf.ResultActions,
+		RespectPublishedPolicy:  conf.RespectPublishedPolicy,
+		StrictMechanismCheck:    conf.StrictMechanismCheck,
+		StripTrailingDot:        conf.StripTrailingDot,
+		TempErrorAction:         conf.TempErrorAction,
+	}
+}
 
 var l *log.Logger = log.New(os.Stderr, "", 0)
 
-const (
-	fieldAuthres = 1 << iota
-	fieldFrom
+// debugf logs a message only if LogLevel is "debug".
+func debugf(format string, v ...any) {
+	if conf.LogLevel == "debug" {
+		l.Printf(format, v...)
+	}
+}
 
-	// Keep last
-	fieldLast
-	fieldAll = fieldLast - 1
-)
+// configProblem logs a problem found in the config, which is fatal if
+// StrictConfig is set.
+func configProblem(format string, v ...any) {
+	if conf.StrictConfig {
+		l.Fatalf("Invalid config: "+format, v...)
+	}
+	l.Printf("Warning: "+format, v...)
+}
 
-type Session struct {
-	milter.NoOpMilter
-	fieldsFound  uint
-	dmarcResult  *authres.DMARCResult
-	shouldReject bool
-	headerFrom   string
+// confChecker reports the problems found while validating a config, which
+// may not be the running one.
+type confChecker struct {
+	c *Conf
+	// err is the first problem found if StrictConfig is set.
+	err error
 }
 
-func shouldRejectDMARCRes(result *authres.DMARCResult) bool {
-	return result.Value != authres.ResultPass &&
-		rejectDomains[strings.ToLower(result.From)]
+// problem logs a problem found in the config, or records it as an error if
+// StrictConfig is set.
+func (k *confChecker) problem(format string, v ...any) {
+	if k.c.StrictConfig {
+		if k.err == nil {
+			k.err = fmt.Errorf(format, v...)
+		}
+		return
+	}
+	l.Printf("Warning: "+format, v...)
 }
 
-func newRejectResponse(domain string) milter.Response {
-	return milter.NewResponseStr(byte(milter.ActReplyCode), "550 5.7.1 "+fmt.Sprintf(conf.RejectFmt, domain))
+// checkDomains checks the domains of RejectDomains and DomainActions, and
+// removes the duplicates from RejectDomains.
+func (k *confChecker) checkDomains() {
+	seen := make(map[string]bool, len(k.c.RejectDomains))
+	unique := k.c.RejectDomains[:0]
+	for _, domain := range k.c.RejectDomains {
+		if err := dmarc.ValidateDomain(k.c.confDomain(domain)); err != nil {
+			k.problem("invalid domain %q in RejectDomains: %v", domain, err)
+		}
+		key := strings.ToLower(k.c.confDomain(domain))
+		if seen[key] {
+			k.problem("duplicate domain %q in RejectDomains", domain)
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, domain)
+	}
+	if removed := len(k.c.RejectDomains) - len(unique); removed > 0 && k.err == nil {
+		l.Printf("Removed %d duplicate domains from RejectDomains", removed)
+	}
+	k.c.RejectDomains = unique
+
+	seenActions := make(map[string]bool, len(k.c.DomainActions))
+	for _, domain := range sortedDomainActions(k.c.DomainActions) {
+		if err := dmarc.ValidateDomain(k.c.confDomain(domain)); err != nil {
+			k.problem("invalid domain %q in DomainActions: %v", domain, err)
+		}
+		key := strings.ToLower(k.c.confDomain(domain))
+		if seenActions[key] {
+			k.problem("duplicate domain %q in DomainActions", domain)
+		}
+		seenActions[key] = true
+		if seen[key] {
+			k.problem("domain %q of RejectDomains is shadowed by DomainActions", domain)
+		}
+	}
+
+	seenRules := make(map[string]bool, len(k.c.Domain))
+	for i, r := range k.c.Domain {
+		if err := dmarc.ValidateDomain(k.c.confDomain(r.Name)); err != nil {
+			k.problem("invalid name %q of Domain %d: %v", r.Name, i+1, err)
+		}
+		for _, value := range r.Results {
+			if err := dmarc.ValidateResultKey(value); err != nil || value == "pass" || strings.Contains(value, "/") {
+				k.problem("invalid result %q of Domain %q", value, r.Name)
+			}
+		}
+		if len(r.Actions) > 0 {
+			k.checkDomainActions(r)
+		}
+		if r.Message != "" && strings.Count(r.Message, "%s") != 1 {
+			k.problem("message of Domain %q must contain \"%%s\" once", r.Name)
+		}
+		key := strings.ToLower(k.c.confDomain(r.Name))
+		if seenRules[key] {
+			k.problem("duplicate name %q in Domain", r.Name)
+		}
+		seenRules[key] = true
+		if seen[key] {
+			k.problem("domain %q of RejectDomains is shadowed by Domain", r.Name)
+		}
+		if seenActions[key] {
+			k.problem("domain %q of DomainActions is shadowed by Domain", r.Name)
+		}
+	}
+}
+
+// checkDomainActions reports the invalid combinations of actions of a Domain
+// table: exactly one terminal action, optionally with the non-terminal ones,
+// "tag", which cannot apply to a message that is not delivered, and "log".
+func (k *confChecker) checkDomainActions(r DomainRule) {
+	if r.Action != nil {
+		k.problem("action and actions of Domain %q are exclusive", r.Name)
+	}
+	var terminal []Action
+	tag := false
+	for _, action := range r.Actions {
+		switch {
+		case action.Log:
+		case action.Action == ActionTag:
+			tag = true
+		default:
+			terminal = append(terminal, action.Action)
+		}
+	}
+	if len(terminal) != 1 {
+		k.problem("actions of Domain %q must contain exactly one of accept, defer, quarantine and reject", r.Name)
+		return
+	}
+	if tag && (terminal[0] == ActionReject || terminal[0] == ActionDefer) {
+		k.problem("actions of Domain %q cannot combine tag with %v, as the message is not delivered, use \"log\" to record it instead", r.Name, terminal[0])
+	}
 }
 
-func (s *Session) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
-	// Skip emails from authenticated clients, e.g. SASL authenticated in Postfix.
-	if m.Macros["{auth_authen}"] != "" {
-		return milter.RespAccept, nil
+// checkResultActions reports the invalid keys of ResultActions.
+func (k *confChecker) checkResultActions() {
+	keys := make([]string, 0, len(k.c.ResultActions))
+	for key := range k.c.ResultActions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := dmarc.ValidateResultKey(key); err != nil {
+			k.problem("invalid key %q in ResultActions: %v", key, err)
+		}
+	}
+}
+
+// checkRejectFmtByResult reports the invalid keys of RejectFmtByResult.
+func (k *confChecker) checkRejectFmtByResult() {
+	keys := make([]string, 0, len(k.c.RejectFmtByResult))
+	for key := range k.c.RejectFmtByResult {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := dmarc.ValidateResultKey(key); err != nil || strings.Contains(key, "/") {
+			k.problem("invalid DMARC result %q in RejectFmtByResult", key)
+		}
 	}
-	return milter.RespContinue, nil
 }
 
-func (s *Session) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
-	if s.fieldsFound == fieldAll {
-		return milter.RespContinue, nil
+// sortedDomainActions returns the domains of DomainActions sorted, so that
+// the entries that only differ by case are handled in a stable order.
+func sortedDomainActions(actions map[string]Action) []string {
+	domains := make([]string, 0, len(actions))
+	for domain := range actions {
+		domains = append(domains, domain)
 	}
+	sort.Strings(domains)
+	return domains
+}
 
-	if s.fieldsFound&fieldFrom == 0 && strings.EqualFold(name, "From") {
-		s.fieldsFound |= fieldFrom
-		decoder := new(mime.WordDecoder)
-		if v, err := decoder.DecodeHeader(value); err == nil {
-			s.headerFrom = v
-		} else {
-			s.headerFrom = value
+// buildDomains returns the trie of the actions of the configured domains,
+// along with the ones of the lists, like RejectDomainsURL, which are
+// overridden by the config.
+func buildDomains(lists ...[]string) *dmarc.Domains {
+	trie := dmarc.NewDomains()
+	for _, list := range lists {
+		for _, domain := range list {
+			trie.Insert(conf.confDomain(domain), conf.DefaultDomainAction)
 		}
-		return milter.RespContinue, nil
 	}
+	for _, domain := range conf.RejectDomains {
+		trie.Insert(conf.confDomain(domain), conf.DefaultDomainAction)
+	}
+	for _, domain := range sortedDomainActions(conf.DomainActions) {
+		trie.Insert(conf.confDomain(domain), conf.DomainActions[domain])
+	}
+	for _, r := range conf.Domain {
+		trie.InsertRule(conf.confDomain(r.Name), r.rule())
+	}
+	return trie
+}
+
+// confDomain returns a configured domain, of RejectDomains, DomainActions,
+// Domain or of the lists, as it is matched, without its trailing dot if
+// StripTrailingDot is set.
+func (c *Conf) confDomain(domain string) string {
+	if c.StripTrailingDot {
+		return dmarc.TrimTrailingDot(domain)
+	}
+	return domain
+}
 
-	if s.fieldsFound&fieldAuthres == 0 && strings.EqualFold(name, "Authentication-Results") {
-		queueID := m.Macros["i"]
-		id, results, err := authres.Parse(value)
+// readConf reads the config files at paths over the default config, in order,
+// and reports whether they were all found. A path can also be a directory,
+// whose *.conf files are read in lexical order. A missing file is only an
+// error if mustExist is set.
+//
+// The files are decoded in the same Conf, so that a later file overrides the
+// scalar options of the earlier ones and adds to their tables, key by key.
+// A list set by several files is the concatenation of their values, while
+// a list set by a single file replaces the default.
+func readConf(paths []string, mustExist bool) (c Conf, found bool, err error) {
+	c = defaultConf()
+	found = true
+	// lists are the list options set by the files read so far.
+	lists := make(map[string]bool)
+	for _, path := range paths {
+		files, err := confFiles(path, mustExist)
 		if err != nil {
-			// Simply log in case we can't parse an AR header, because we cannot
-			// handle it better than that.
-			l.Printf("%s: failed to parse header: %v: %q", queueID, err, name+": "+value)
-			return milter.RespContinue, nil
+			return c, false, err
+		}
+		if files == nil {
+			found = false
 		}
+		for _, file := range files {
+			if err := decodeConfFile(&c, file, lists); err != nil {
+				return c, false, err
+			}
+		}
+	}
+	return c, found, nil
+}
 
-		if !strings.EqualFold(id, conf.AuthservID) {
-			// Not our Authentication-Results, ignore the field
-			return milter.RespContinue, nil
+// confFiles returns the config files of path: itself, or the *.conf files it
+// contains if it is a directory. It returns nil if the path is missing and
+// mustExist is not set.
+func confFiles(path string, mustExist bool) ([]string, error) {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+	case !mustExist && errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("open conf file: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.conf"))
+	if err != nil {
+		return nil, fmt.Errorf("list conf files of %s: %w", path, err)
+	}
+	return append([]string{}, files...), nil
+}
+
+// decodeConfFile decodes the config file at path into c, appending to the
+// list options that are already in lists, which is updated.
+func decodeConfFile(c *Conf, path string, lists map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open conf file: %w", err)
+	}
+	defer f.Close()
+	// The decoder reuses the array of a list, so the lists are decoded in
+	// empty ones, and merged afterwards.
+	rv := reflect.ValueOf(c).Elem()
+	prev := make(map[int]reflect.Value)
+	for i := 0; i < rv.NumField(); i++ {
+		if fv := rv.Field(i); fv.Kind() == reflect.Slice {
+			prev[i] = reflect.ValueOf(fv.Interface())
+			fv.Set(reflect.Zero(fv.Type()))
+		}
+	}
+	md, err := toml.NewDecoder(f).Decode(c)
+	if err != nil {
+		return fmt.Errorf("parse conf file %s: %w", path, err)
+	}
+	// The keys are matched case insensitively, as by the decoder.
+	defined := make(map[string]bool)
+	for _, key := range md.Keys() {
+		if len(key) == 1 {
+			defined[strings.ToLower(key[0])] = true
 		}
+	}
+	for i, p := range prev {
+		name := rv.Type().Field(i).Name
+		fv := rv.Field(i)
+		switch {
+		case !defined[strings.ToLower(name)]:
+			fv.Set(p)
+		case lists[name]:
+			fv.Set(reflect.AppendSlice(p, fv))
+		default:
+			lists[name] = true
+		}
+	}
+	return nil
+}
 
-		for _, result := range results {
-			if r, ok := result.(*authres.DMARCResult); ok {
-				s.fieldsFound |= fieldAuthres
-				s.dmarcResult = r
-				s.shouldReject = shouldRejectDMARCRes(r)
-			}
+// preparedConf is a validated config along with the structures built from it,
+// ready to replace the running one.
+type preparedConf struct {
+	conf        Conf
+	authservIDs []dmarc.AuthservRule
+	networks    ipNets
+	relays      ipNets
+	submitters  ipNets
+	logFields   logFieldList
+}
+
+// prepareConf validates c and builds its structures, without changing the
+// running config, so that an invalid config is rejected as a whole.
+func prepareConf(c Conf) (*preparedConf, error) {
+	if c.LogLevel != "info" && c.LogLevel != "debug" {
+		return nil, fmt.Errorf("invalid LogLevel %q, must be \"info\" or \"debug\"", c.LogLevel)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "logfmt" {
+		return nil, fmt.Errorf("invalid LogFormat %q, must be \"text\" or \"logfmt\"", c.LogFormat)
+	}
+	if _, _, err := parseListenURI(c.ListenURI); err != nil {
+		return nil, fmt.Errorf("invalid ListenURI: %w", err)
+	}
+	for i, lc := range c.Listener {
+		if _, _, err := parseListenURI(lc.URI); err != nil {
+			return nil, fmt.Errorf("invalid uri of Listener %d: %w", i+1, err)
+		}
+		if _, err := lc.protocol(); err != nil {
+			return nil, fmt.Errorf("invalid skip of Listener %q: %w", lc.URI, err)
+		}
+	}
+	if c.ControlListenURI != "" {
+		// The control API has no authentication, so it is restricted to
+		// the local users allowed by the permissions of the socket.
+		if network, _, err := parseListenURI(c.ControlListenURI); err != nil || network != "unix" {
+			return nil, fmt.Errorf("invalid ControlListenURI %q, must be a unix socket like %q", c.ControlListenURI, exampleControlURI)
+		}
+	}
+	if c.ListenBacklog < 0 {
+		return nil, fmt.Errorf("invalid ListenBacklog %d, must be positive or 0", c.ListenBacklog)
+	}
+	if c.RejectDelay < 0 || c.RejectDelay > maxRejectDelay {
+		return nil, fmt.Errorf("invalid RejectDelay %v, must be between 0 and %v", c.RejectDelay, maxRejectDelay)
+	}
+	if c.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("invalid ShutdownTimeout %v, must be positive or 0", c.ShutdownTimeout)
+	}
+	if c.MaxReplyLength < minReplyLength {
+		return nil, fmt.Errorf("invalid MaxReplyLength %d, must be at least %d", c.MaxReplyLength, minReplyLength)
+	}
+	if c.LogSubject && c.LogSubjectLength < 1 {
+		return nil, fmt.Errorf("invalid LogSubjectLength %d, must be at least 1", c.LogSubjectLength)
+	}
+	switch c.LogAccepts {
+	case "all", "sampled", "none", "summary":
+	default:
+		return nil, fmt.Errorf("invalid LogAccepts %q, must be \"all\", \"sampled\", \"none\" or \"summary\"", c.LogAccepts)
+	}
+	if c.LogAccepts == "sampled" && c.LogAcceptsRate < 1 {
+		return nil, fmt.Errorf("invalid LogAcceptsRate %d, must be at least 1", c.LogAcceptsRate)
+	}
+	if c.LogAccepts == "summary" && c.LogAcceptsInterval <= 0 {
+		return nil, fmt.Errorf("invalid LogAcceptsInterval %v, must be positive", c.LogAcceptsInterval)
+	}
+	if strings.IndexFunc(c.AcceptHeader, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+		return nil, fmt.Errorf("invalid AcceptHeader %q, must be a header field name", c.AcceptHeader)
+	}
+	switch c.MultiResultPolicy {
+	case "first", "worst", "last":
+	default:
+		return nil, fmt.Errorf("invalid MultiResultPolicy %q, must be \"first\", \"worst\" or \"last\"", c.MultiResultPolicy)
+	}
+	switch c.OnProtocolError {
+	case "", "accept", "defer", "reject":
+	default:
+		return nil, fmt.Errorf("invalid OnProtocolError %q, must be \"\", \"accept\", \"defer\" or \"reject\"", c.OnProtocolError)
+	}
+	if c.AuthservIDCheckMessages < 0 {
+		return nil, fmt.Errorf("invalid AuthservIDCheckMessages %d, must be positive or 0", c.AuthservIDCheckMessages)
+	}
+	if len(c.AuthResHeaders) == 0 {
+		return nil, errors.New("invalid AuthResHeaders, must contain at least one header field name")
+	}
+
+	k := confChecker{c: &c}
+	authservIDs := c.TrustedAuthservIDs
+	if c.AuthservID == "" {
+		var err error
+		c.AuthservID, err = hostname()
+		if err != nil {
+			return nil, fmt.Errorf("AuthservID is not set and the hostname cannot be read: %w", err)
+		}
+		if !strings.Contains(c.AuthservID, ".") {
+			k.problem("AuthservID is not set and defaults to the hostname %q, which is not a fully qualified domain name and is unlikely to match the authserv-id of the upstream milter", c.AuthservID)
+		}
+		if c.AuthservIDFallback != "" {
+			authservIDs = append([]string{c.AuthservIDFallback}, authservIDs...)
+		}
+	} else if c.AuthservIDFallback != "" {
+		k.problem("AuthservIDFallback is ignored because AuthservID is set")
+	}
+	if c.OverrideHeader != "" && len(c.TrustedNetworks) == 0 && len(c.TrustedRelays) == 0 {
+		k.problem("OverrideHeader is never honored without TrustedNetworks nor TrustedRelays")
+	}
+
+	p := &preparedConf{}
+	var err error
+	if p.authservIDs, err = dmarc.CompileAuthservRules(authservIDs); err != nil {
+		return nil, fmt.Errorf("invalid TrustedAuthservIDs: %w", err)
+	}
+	if p.networks, err = parseIPNets(c.TrustedNetworks); err != nil {
+		return nil, fmt.Errorf("invalid TrustedNetworks: %w", err)
+	}
+	if p.relays, err = parseIPNets(c.TrustedRelays); err != nil {
+		return nil, fmt.Errorf("invalid TrustedRelays: %w", err)
+	}
+	if p.submitters, err = parseIPNets(c.TrustedSubmitterIPs); err != nil {
+		return nil, fmt.Errorf("invalid TrustedSubmitterIPs: %w", err)
+	}
+	if p.logFields, err = parseLogFields(c.LogFields); err != nil {
+		return nil, fmt.Errorf("invalid LogFields: %w", err)
+	}
+
+	k.checkDomains()
+	k.checkResultActions()
+	k.checkRejectFmtByResult()
+	if k.err != nil {
+		return nil, k.err
+	}
+	p.conf = c
+	return p, nil
+}
+
+// apply replaces the running config and its structures with the prepared
+// ones, and rebuilds the current domains. Once the milter is serving, the
+// caller must hold confMu for writing.
+func (p *preparedConf) apply() {
+	conf = p.conf
+	trustedAuthservIDs = p.authservIDs
+	trustedNetworks = p.networks
+	trustedRelays = p.relays
+	trustedSubmitters = p.submitters
+	logFields = p.logFields
+	authservCheck.reset()
+	domainLists.mu.Lock()
+	storeDomainLists()
+	domainLists.mu.Unlock()
+}
+
+// evalFile reads an RFC 5322 message from the file at path, or from stdin if
+// path is "-", evaluates it and prints the decision to w.
+func evalFile(w io.Writer, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	fields, err := readHeader(r)
+	if err != nil {
+		return fmt.Errorf("read message: %w", err)
+	}
+	d := evaluate("eval", fields)
+	return printDecision(w, d)
+}
+
+// readHeader reads the fields of the header of an RFC 5322 message from r,
+// in their order in the message, with their continuation lines unfolded.
+func readHeader(r io.Reader) ([]headerField, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	var fields []headerField
+	for {
+		line, err := tp.ReadContinuedLine()
+		if err == io.EOF && len(fields) > 0 {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return fields, nil
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.TrimRight(name, " \t") != name {
+			return nil, fmt.Errorf("malformed header line: %q", line)
+		}
+		fields = append(fields, headerField{name, strings.TrimSpace(value)})
+	}
+}
+
+// checkHeader prints the DMARC result extracted from the value of an
+// Authentication-Results header field, and the decision that would be taken
+// for a message with this single field.
+func checkHeader(w io.Writer, value string) error {
+	id, result, err := dmarc.ParseField(value)
+	if err != nil {
+		return err
+	}
+	if rule, ok := decisionConfig().MatchAuthservID(id); ok {
+		fmt.Fprintf(w, "authserv-id %q trusted by %s\n", id, rule)
+	} else {
+		fmt.Fprintf(w, "authserv-id %q not trusted\n", id)
+	}
+	if result != nil {
+		fmt.Fprintf(w, "dmarc=%v from=%s", result.Value, result.From)
+		if result.Policy != "" {
+			fmt.Fprintf(w, " policy=%s", result.Policy)
 		}
+		if methods := result.Methods(); methods != "" {
+			fmt.Fprintf(w, " %s", methods)
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintln(w, "no DMARC result")
 	}
+	d := evaluate("check-header", []headerField{{conf.AuthResHeaders[0], value}})
+	return printDecision(w, d)
+}
 
-	return milter.RespContinue, nil
+// checkChroot checks that dir can be used as Chroot: an absolute path to an
+// existing directory. It is called before any socket is bound, as chroot(2)
+// is only called once they are.
+func checkChroot(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%q is not an absolute path", dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	return nil
 }
 
-func (s *Session) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
-	queueID := m.Macros["i"]
-	if s.dmarcResult == nil {
-		l.Printf("%s: accept dmarc=unknown from=unknown addr=%q", queueID, s.headerFrom)
-		return milter.RespAccept, nil
+// chroot changes the root directory of the process to dir, and the working
+// directory to the new root.
+func chroot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
 	}
-	r := s.dmarcResult
-	if s.shouldReject {
-		l.Printf("%s: reject dmarc=%v from=%s addr=%q", queueID, r.Value, r.From, s.headerFrom)
-		return newRejectResponse(r.From), nil
+	return os.Chdir("/")
+}
+
+// printDecision prints the action of a decision, followed by its SMTP reply,
+// if any.
+func printDecision(w io.Writer, d Decision) error {
+	var err error
+	if reply := d.Reply(); reply != "" {
+		_, err = fmt.Fprintf(w, "%s: %s\n", d.actions(), reply)
 	} else {
-		l.Printf("%s: accept dmarc=%v from=%s addr=%q", queueID, r.Value, r.From, s.headerFrom)
-		return milter.RespAccept, nil
+		_, err = fmt.Fprintln(w, d.actions())
 	}
+	return err
 }
 
 const (
@@ -156,24 +919,108 @@ Milter server that rejects mails based on the DMARC Authentication-Results
 header added by a previous milter (e.g. OpenDMARC).
 
 Options:
-  -c FILE       Read config from FILE. (default %q)
+  -c FILE       Read config from FILE, or from the *.conf files of the
+                directory FILE in lexical order. Can be repeated to merge
+                several files, the later ones overriding the earlier ones.
+                (default %q, the default config is used if this
+                file does not exist)
+  --dump-config Print the effective config and exit.
+  --generate-config
+                Print a commented config with all the options set to their
+                default value and exit.
+  --check-header VALUE
+                Parse VALUE as an Authentication-Results header field, print
+                its DMARC result and the decision, and exit.
+  --eval FILE   Evaluate the message in FILE ("-" for stdin), print the
+                decision and exit.
   -h, --help    Show this help and exit.
   --version     Show version and exit.
 `
-	flagConfDef = "/etc/dmarcator.conf"
 )
 
+// The actions and protocol steps requested to the MTA during the option
+// negotiation.
+const (
+	milterActions  = milter.OptQuarantine | milter.OptAddHeader | milter.OptChangeHeader
+	milterProtocol = milter.OptNoHelo | milter.OptNoRcptTo | milter.OptNoBody
+)
+
+// newMilterServer returns a milter server requesting the given protocol
+// steps to the MTA.
+func newMilterServer(protocol milter.OptProtocol) *milter.Server {
+	return &milter.Server{
+		NewMilter: func() milter.Milter {
+			return newSession()
+		},
+		Actions:  milterActions,
+		Protocol: protocol,
+	}
+}
+
+// listenMilter creates a milter listener from an URI of the form
+// "network://address", wrapped to detect the health probes, limit the number
+// of connections and time out the sessions, according to the config.
+func listenMilter(uri string, protocol milter.OptProtocol) (net.Listener, error) {
+	ln, err := listen(uri, conf.ReusePort)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ListenBacklog > 0 {
+		if err := setBacklog(ln, conf.ListenBacklog); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("set ListenBacklog: %w", err)
+		}
+	}
+	ln = probeListener{Listener: ln, protocol: protocol}
+	if conf.MaxConnections > 0 {
+		ln = newLimitListener(ln, conf.MaxConnections)
+	}
+	if conf.SessionTimeout > 0 {
+		ln = timeoutListener{Listener: ln, timeout: conf.SessionTimeout}
+	}
+	return ln, nil
+}
+
+// readyPrefix starts the line logged once the milter is ready to accept
+// connections, which is followed by the listener URI, in the form of
+// ListenURI. It is part of the stable interface, for the supervisors that
+// wait for dmarcator to be ready.
+const readyPrefix = "Milter listening at "
+
+// flagConfDef is the default path of the config file, that can be missing.
+var flagConfDef = "/etc/dmarcator.conf"
+
+// confPathsFlag is the value of the -c flag, which can be repeated.
+type confPathsFlag []string
+
+func (f *confPathsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *confPathsFlag) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
 func main() {
 	cli := flag.NewFlagSet("dmarcator", flag.ExitOnError)
 	cli.Usage = func() {
 		fmt.Fprintf(cli.Output(), usageFmt, flagConfDef)
 	}
 	var (
-		flagConf    string
-		flagHelp    bool
-		flagVersion bool
+		flagCheck      string
+		flagConf       confPathsFlag
+		flagDumpConfig bool
+		flagEval       string
+		flagGenerate   bool
+		flagHelp       bool
+		flagVersion    bool
 	)
-	cli.StringVar(&flagConf, "c", flagConfDef, "")
+	cli.Var(&flagConf, "c", "")
+	cli.StringVar(&flagCheck, "check-header", "", "")
+	cli.BoolVar(&flagDumpConfig, "dump-config", false, "")
+	cli.StringVar(&flagEval, "eval", "", "")
+	cli.BoolVar(&flagGenerate, "generate-config", false, "")
 	cli.BoolVar(&flagHelp, "h", false, "")
 	cli.BoolVar(&flagHelp, "help", false, "")
 	cli.BoolVar(&flagVersion, "version", false, "")
@@ -186,63 +1033,269 @@ func main() {
 	}
 
 	if flagVersion {
-		fmt.Println("dmarcator", version)
+		fmt.Println(versionString())
 		os.Exit(0)
 	}
 
-	conffile, err := os.Open(flagConf)
+	if flagGenerate {
+		if err := generateConf(os.Stdout); err != nil {
+			l.Fatal("Failed to generate config: ", err)
+		}
+		return
+	}
+
+	confPaths, confMustExist = flagConf, true
+	if len(confPaths) == 0 {
+		confPaths, confMustExist = []string{flagConfDef}, false
+	}
+	next, found, err := readConf(confPaths, confMustExist)
+	if err != nil {
+		l.Fatal("Failed to ", err)
+	}
+	if !found {
+		// A missing default conf file is not an error, to allow running
+		// with the default config only.
+		l.Printf("Conf file %s not found, using the default config", flagConfDef)
+	}
+	prepared, err := prepareConf(next)
 	if err != nil {
-		l.Fatal("Failed to open conf file: ", err)
+		l.Fatal("Invalid config: ", err)
 	}
-	decoder := toml.NewDecoder(conffile)
-	if _, err := decoder.Decode(&conf); err != nil {
-		l.Fatalf("Failed to parse conf file %s: %v", flagConf, err)
+	domainLists.mu.Lock()
+	domainLists.remote, domainLists.file = nil, nil
+	domainLists.mu.Unlock()
+	prepared.apply()
+	atomic.StoreUint64(&acceptsSeen, 0)
+	atomic.StoreUint64(&acceptsUnlogged, 0)
+	if found {
+		debugf("Loaded conf file %s", strings.Join(confPaths, ", "))
 	}
+	rejectedDomains.reset(conf.TopRejectedDomains * rejectedDomainsFactor)
+	recordReload(nil)
 
-	if conf.AuthservID == "" {
-		var err error
-		conf.AuthservID, err = os.Hostname()
+	if flagDumpConfig {
+		if err := toml.NewEncoder(os.Stdout).Encode(conf); err != nil {
+			l.Fatal("Failed to dump config: ", err)
+		}
+		return
+	}
+	if conf.LogLevel == "debug" {
+		var buf strings.Builder
+		toml.NewEncoder(&buf).Encode(conf)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			debugf("Config: %s", line)
+		}
+	}
+
+	if conf.RejectDomainsFile != "" {
+		_, n, err := loadDomainsFile()
 		if err != nil {
-			l.Fatal("Failed to read hostname: ", err)
+			l.Fatal("Failed to load RejectDomainsFile: ", err)
 		}
+		l.Printf("Loaded %d domains from RejectDomainsFile", n)
 	}
 
-	network, address, found := strings.Cut(conf.ListenURI, "://")
-	if !found {
-		l.Fatal("Invalid listen URI")
+	var remote *remoteList
+	if conf.RejectDomainsURL != "" {
+		remote = newRemoteList(conf.RejectDomainsURL)
+		refreshDomains(remote)
 	}
 
-	for _, domain := range conf.RejectDomains {
-		rejectDomains[strings.ToLower(domain)] = true
+	if flagEval != "" {
+		if err := evalFile(os.Stdout, flagEval); err != nil {
+			l.Fatal("Failed to evaluate message: ", err)
+		}
+		return
+	}
+	if flagCheck != "" {
+		if err := checkHeader(os.Stdout, flagCheck); err != nil {
+			l.Fatal("Failed to parse header: ", err)
+		}
+		return
 	}
 
-	s := milter.Server{
-		NewMilter: func() milter.Milter {
-			return &Session{}
-		},
-		Protocol: milter.OptNoConnect | milter.OptNoHelo | milter.OptNoRcptTo | milter.OptNoBody,
+	if conf.Chroot != "" {
+		if err := checkChroot(conf.Chroot); err != nil {
+			l.Fatal("Invalid Chroot: ", err)
+		}
 	}
 
+	// Registered before any socket is bound, so that a stop signal received
+	// during the startup is handled once the server is set up, instead of
+	// killing the process without removing the unix socket.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	s := newMilterServer(milterProtocol)
+
 	// Allows to set the permissions of the created unix socket
-	syscall.Umask(conf.UMask)
+	if !isAbstractUnix(conf.ListenURI) {
+		syscall.Umask(conf.UMask)
+	}
 
-	ln, err := net.Listen(network, address)
+	if conf.ReusePort && strings.HasPrefix(conf.ListenURI, "unix://") {
+		configProblem("ReusePort is ignored for the unix socket of ListenURI")
+	}
+	ln, err := listenMilter(conf.ListenURI, milterProtocol)
 	if err != nil {
 		l.Fatal("Failed to setup listener: ", err)
 	}
+	listenerSrvs := make([]*milter.Server, len(conf.Listener))
+	listenerLns := make([]net.Listener, len(conf.Listener))
+	for i, c := range conf.Listener {
+		protocol, _ := c.protocol()
+		listenerSrvs[i] = newMilterServer(protocol)
+		listenerLns[i], err = listenMilter(c.URI, protocol)
+		if err != nil {
+			l.Fatalf("Failed to setup listener %s: %v", c.URI, err)
+		}
+	}
 
-	// Closing the listener will unlink the unix socket, if any
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	var metricsSrvs []*http.Server
+	if conf.ExpvarListenURI != "" {
+		eln, err := listen(conf.ExpvarListenURI, false)
+		if err != nil {
+			l.Fatal("Failed to setup expvar listener: ", err)
+		}
+		srv := newMetricsServer(true, conf.MetricsListenURI == conf.ExpvarListenURI)
+		metricsSrvs = append(metricsSrvs, srv)
+		l.Printf("Expvar listening at %s://%v", eln.Addr().Network(), eln.Addr())
+		go serveMetrics(srv, eln)
+	}
+	if conf.MetricsListenURI != "" && conf.MetricsListenURI != conf.ExpvarListenURI {
+		mln, err := listen(conf.MetricsListenURI, false)
+		if err != nil {
+			l.Fatal("Failed to setup metrics listener: ", err)
+		}
+		srv := newMetricsServer(false, true)
+		metricsSrvs = append(metricsSrvs, srv)
+		l.Printf("Metrics listening at %s://%v", mln.Addr().Network(), mln.Addr())
+		go serveMetrics(srv, mln)
+	}
+
+	var controlSrv *http.Server
+	if conf.ControlListenURI != "" {
+		cln, err := listen(conf.ControlListenURI, false)
+		if err != nil {
+			l.Fatal("Failed to setup control listener: ", err)
+		}
+		controlSrv = newControlServer()
+		l.Printf("Control API listening at %s://%v", cln.Addr().Network(), cln.Addr())
+		go serveControl(controlSrv, cln)
+	}
+
+	// Confine the process once all the sockets are bound
+	if conf.Chroot != "" {
+		if err := chroot(conf.Chroot); err != nil {
+			l.Fatal("Failed to chroot: ", err)
+		}
+		l.Printf("Chrooted to %s", conf.Chroot)
+	}
+	if err := learnedDomains.load(conf.LearnFile); err != nil {
+		l.Fatal("Failed to load LearnFile: ", err)
+	}
+	if err := auditLog.open(conf.AuditFile); err != nil {
+		l.Fatal("Failed to open AuditFile: ", err)
+	}
+
+	// Log a summary of the counters and reopen AuditFile on SIGUSR1, log
+	// the parse failures on SIGUSR2, and reload the config on SIGHUP
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		for sig := range usr {
+			switch sig {
+			case syscall.SIGUSR1:
+				l.Print("Counters since startup: ", countersSummary())
+				confMu.RLock()
+				if conf.TopRejectedDomains > 0 {
+					l.Print("Top rejected domains since startup: ", topRejectedSummary())
+				}
+				confMu.RUnlock()
+				if err := auditLog.reopen(); err != nil {
+					l.Print("Failed to reopen AuditFile: ", err)
+				}
+			case syscall.SIGUSR2:
+				l.Printf("Parse errors since startup: %d", metricParseErrors.Value())
+			case syscall.SIGHUP:
+				reload()
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	shutdown = done
+	if remote != nil && conf.RejectDomainsRefresh > 0 {
+		go refreshDomainsEvery(remote, conf.RejectDomainsRefresh, done)
+	}
+	if conf.LogAccepts == "summary" {
+		go logAcceptsEvery(conf.LogAcceptsInterval, done)
+	}
+	if conf.LearnFile != "" {
+		go flushLearnedEvery(learnFlushInterval, done)
+	}
+	if conf.AuditFile != "" {
+		go flushAuditEvery(auditFlushInterval, done)
+	}
+
+	// Closing the listener will unlink the unix socket, if any. Then the
+	// active sessions are given ShutdownTimeout to end.
+	forced := make(chan bool, 1)
 	go func() {
 		<-sigs
+		signal.Stop(usr)
+		close(usr)
+		close(done)
+		for _, srv := range metricsSrvs {
+			if err := srv.Close(); err != nil {
+				l.Fatal("Failed to close metrics server: ", err)
+			}
+		}
+		if controlSrv != nil {
+			if err := controlSrv.Close(); err != nil {
+				l.Fatal("Failed to close control server: ", err)
+			}
+		}
 		if err := s.Close(); err != nil {
 			l.Fatal("Failed to close server: ", err)
 		}
+		for i, srv := range listenerSrvs {
+			if err := srv.Close(); err != nil {
+				l.Fatal("Failed to close server: ", err)
+			}
+			listenerLns[i].Close()
+		}
+		// The server only knows the listener once serving, so it is also
+		// closed here in case the signal was received before. It makes
+		// Serve return right away, and the error of a second close is
+		// irrelevant.
+		ln.Close()
+		forced <- !drainSessions()
 	}()
 
-	l.Printf("Milter listening at %s://%v", ln.Addr().Network(), ln.Addr())
+	// The additional listeners are served first, so that the milter is
+	// fully ready once the line of ListenURI is logged.
+	for i, srv := range listenerSrvs {
+		eln := listenerLns[i]
+		l.Printf("Milter also listening at %s://%v", eln.Addr().Network(), eln.Addr())
+		go func(srv *milter.Server) {
+			if err := srv.Serve(eln); err != nil && err != milter.ErrServerClosed {
+				l.Fatal("Failed to serve: ", err)
+			}
+		}(srv)
+	}
+	l.Print(readyPrefix + ln.Addr().Network() + "://" + ln.Addr().String())
 	if err := s.Serve(ln); err != nil && err != milter.ErrServerClosed {
 		l.Fatal("Failed to serve: ", err)
 	}
+	wasForced := <-forced
+	if conf.LearnFile != "" {
+		flushLearned()
+	}
+	if err := auditLog.close(); err != nil {
+		l.Print("Failed to write AuditFile: ", err)
+	}
+	if wasForced {
+		exit(exitForcedShutdown)
+	}
 }
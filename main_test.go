@@ -20,19 +20,29 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
-	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
-	"sync"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/club-1/dmarcator/miltertest"
 	"github.com/emersion/go-milter"
 )
 
+// mainDone is closed when the main started by the last setup returns.
+var mainDone <-chan struct{}
+
 func setup(t *testing.T, config string) (string, string, *bytes.Buffer) {
 	tmp := t.TempDir()
 
@@ -54,15 +64,21 @@ func setup(t *testing.T, config string) (string, string, *bytes.Buffer) {
 	prevConf := conf
 	t.Cleanup(func() { conf = prevConf })
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
+	done := make(chan struct{})
+	mainDone = done
 	go func() {
 		main()
-		wg.Done()
+		close(done)
 	}()
 	t.Cleanup(func() {
-		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-		wg.Wait()
+		// A test may have stopped main itself, a second signal would
+		// then be received by the main of the next test.
+		select {
+		case <-done:
+		default:
+			syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+			<-done
+		}
 	})
 
 	listener := readListener(t, r)
@@ -78,8 +94,8 @@ func readListener(t *testing.T, r io.Reader) string {
 	read := &bytes.Buffer{}
 	for scanner.Scan() {
 		line := scanner.Bytes()
-		if bytes.HasPrefix(line, []byte("Milter listening")) {
-			return string(line[20:])
+		if bytes.HasPrefix(line, []byte(readyPrefix)) {
+			return string(line[len(readyPrefix):])
 		}
 		read.Write(line)
 	}
@@ -181,6 +197,40 @@ RejectDomains = ["gmail.com"]
 	testHeaders(t, config, []string{"Authentication-Results", header}, expected)
 }
 
+func TestAuthservIDFallback(t *testing.T) {
+	prevHostname := hostname
+	t.Cleanup(func() { hostname = prevHostname })
+	hostname = func() (string, error) { return "3f2a9c1b7d4e", nil }
+
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+RejectDomains = ["gmail.com"]
+AuthservIDFallback = "mail.club1.fr"
+`
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	for _, id := range []string{"3f2a9c1b7d4e", "mail.club1.fr"} {
+		t.Run(id, func(t *testing.T) {
+			header := id + "; dmarc=fail header.from=gmail.com"
+			testHeaders(t, config, []string{"Authentication-Results", header}, expected)
+		})
+	}
+
+	_, log := runMain(t, config, "--dump-config")
+	warning := `Warning: AuthservID is not set and defaults to the hostname "3f2a9c1b7d4e", which is not a fully qualified domain name`
+	if !strings.Contains(log, warning) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", warning, log)
+	}
+	_, log = runMain(t, config+`AuthservID = "mx.club1.fr"`, "--dump-config")
+	warning = "Warning: AuthservIDFallback is ignored because AuthservID is set"
+	if !strings.Contains(log, warning) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", warning, log)
+	}
+}
+
 func TestUNIXSocket(t *testing.T) {
 	config := `
 ListenURI = "unix:///tmp/dmarcator.sock"
@@ -196,6 +246,71 @@ RejectDomains = ["gmail.com"]
 	testHeaders(t, config, []string{"Authentication-Results", header}, expected)
 }
 
+func TestStopDuringStartup(t *testing.T) {
+	tmp := t.TempDir()
+	sock := filepath.Join(tmp, "dmarcator.sock")
+	configPath := filepath.Join(tmp, "dmarcator.conf")
+	config := fmt.Sprintf("ListenURI = \"unix://%s\"\nAuthservID = \"mail.club1.fr\"\n", sock)
+	if err := os.WriteFile(configPath, []byte(config), 0664); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = []string{"dmarcator", "-c", configPath}
+
+	prevLogOut := l.Writer()
+	t.Cleanup(func() { l.SetOutput(prevLogOut) })
+	l.SetOutput(io.Discard)
+	prevConf := conf
+	t.Cleanup(func() { conf = prevConf })
+
+	// Prevents SIGTERM from killing the test before main handles it.
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGTERM)
+	defer signal.Stop(ignored)
+
+	done := make(chan struct{})
+	go func() {
+		main()
+		close(done)
+	}()
+	// The signal is sent right away and repeated, as the ones received
+	// before main handles them are lost.
+	timeout := time.After(5 * time.Second)
+	for {
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		select {
+		case <-done:
+			if _, err := os.Stat(sock); !os.IsNotExist(err) {
+				t.Errorf("expected socket to be removed, got %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("main did not return after SIGTERM")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestAbstractUNIXSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are only supported on Linux")
+	}
+	config := `
+ListenURI = "unix://@dmarcator-test"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	header := "mail.club1.fr; dmarc=fail header.from=gmail.com"
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testHeaders(t, config, []string{"Authentication-Results", header}, expected)
+	if _, err := os.Stat("@dmarcator-test"); !os.IsNotExist(err) {
+		t.Errorf("expected no socket file to be created, got %v", err)
+	}
+}
+
 func TestMultipleFields(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -210,7 +325,7 @@ func TestMultipleFields(t *testing.T) {
 				"Subject", "Hello world!",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=unknown from=unknown addr="hello@example.com"`},
+			output: []string{`accept dmarc=unknown from=unknown addr="hello@example.com" header_from_domain=example.com reason=no-trusted-authres`},
 		},
 		{
 			name: "multiple dmarc",
@@ -223,7 +338,20 @@ func TestMultipleFields(t *testing.T) {
 				SMTPCode: 550,
 				SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
 			},
-			output: []string{`reject dmarc=fail from=gmail.com addr=""`},
+			output: []string{`reject dmarc=fail from=gmail.com addr="" header_from_domain= dur=`},
+		},
+		{
+			name: "spf and dkim results",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; spf=pass smtp.mailfrom=gmail.com; dkim=fail header.d=gmail.com; dkim=pass header.d=example.com; dmarc=fail header.from=gmail.com",
+				"From", "coucou@gmail.com",
+			},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+			},
+			output: []string{`reject dmarc=fail from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com spf=pass dkim=fail,pass dur=`},
 		},
 		{
 			name: "from bare address",
@@ -232,7 +360,7 @@ func TestMultipleFields(t *testing.T) {
 				"From", "coucou@gmail.com",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=pass from=gmail.com addr="coucou@gmail.com"`},
+			output: []string{`accept dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com`},
 		},
 		{
 			name: "from mime encoded address",
@@ -241,7 +369,7 @@ func TestMultipleFields(t *testing.T) {
 				"From", "=?ISO-8859-1?Q?Aur=E9lien_COUDERC?= <libre@coucou.fr>",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=pass from=coucou.fr addr="Aurélien COUDERC <libre@coucou.fr>"`},
+			output: []string{`accept dmarc=pass from=coucou.fr addr="Aurélien COUDERC <libre@coucou.fr>" header_from_domain=coucou.fr`},
 		},
 		{
 			name: "from broken mime encoded",
@@ -250,7 +378,7 @@ func TestMultipleFields(t *testing.T) {
 				"From", "=?UTF-42?Q?Broken?= <coucou@broken.com>",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=pass from=broken.com addr="=?UTF-42?Q?Broken?= <coucou@broken.com>"`},
+			output: []string{`accept dmarc=pass from=broken.com addr="=?UTF-42?Q?Broken?= <coucou@broken.com>" header_from_domain=broken.com`},
 		},
 		{
 			name: "multiple from",
@@ -260,7 +388,7 @@ func TestMultipleFields(t *testing.T) {
 				"From", "second@gmail.com",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=pass from=gmail.com addr="first@gmail.com"`},
+			output: []string{`accept dmarc=pass from=gmail.com addr="first@gmail.com" header_from_domain=gmail.com`},
 		},
 		{
 			name: "more fields than needed",
@@ -270,7 +398,7 @@ func TestMultipleFields(t *testing.T) {
 				"Subject", "Hello world!",
 			},
 			action: &milter.Action{Code: milter.ActAccept},
-			output: []string{`accept dmarc=pass from=gmail.com addr="Coucou <coucou@gmail.com>"`},
+			output: []string{`accept dmarc=pass from=gmail.com addr="Coucou <coucou@gmail.com>" header_from_domain=gmail.com`},
 		},
 	}
 	config := `
@@ -285,47 +413,20 @@ RejectDomains = ["gmail.com"]
 	}
 }
 
-func testHeaders(t *testing.T, config string, headers []string, expectedAct *milter.Action, expectedOut ...string) {
-	if len(headers)%2 != 0 {
-		panic("headers varargs must be pairs")
-	}
-	network, address, out := setup(t, config)
-
-	client := milter.NewClientWithOptions(network, address, milter.ClientOptions{
-		Dialer: &net.Dialer{},
-	})
-	defer client.Close()
-	session, err := client.Session()
-	if err != nil {
-		t.Fatal("unexpected error: ", err)
-	}
-	defer session.Close()
-
-	// Send a dummy MAIL FROM, without authentication macro.
-	res, err := session.Mail("nicolas@example.fr", []string{})
-	if err != nil {
-		t.Fatal("unexpected err sending MAIL FROM: ", err)
-	}
-	if !reflect.DeepEqual(&milter.Action{Code: milter.ActContinue}, res) {
-		t.Fatalf("expected %#v, got %#v", expectedAct, res)
-	}
+// testHeaders sends the given header fields in a new milter session and
+// checks the action returned at the end of headers and the log output. The
+// session is returned to allow further checks, it is closed at the end of
+// the test.
+func testHeaders(t *testing.T, config string, headers []string, expectedAct *milter.Action, expectedOut ...string) *milter.ClientSession {
+	return testMessage(t, config, []string{"i", "QUEUEID"}, headers, expectedAct, expectedOut...)
+}
 
-	if err := session.Macros(milter.CodeHeader, "i", "QUEUEID"); err != nil {
-		t.Fatal("unexpected err setting queue id macro: ", err)
-	}
-	for i := 0; i < len(headers); i += 2 {
-		_, err := session.HeaderField(headers[i], headers[i+1])
-		if err != nil {
-			t.Error("unexpected err sending header: ", err)
-		}
-	}
-	res, err = session.HeaderEnd()
-	if err != nil {
-		t.Error("unexpected err sending EOH: ", err)
-	}
-	if !reflect.DeepEqual(res, expectedAct) {
-		t.Errorf("expected %#v, got %#v", expectedAct, res)
-	}
+// testMessage is like testHeaders, but with the given header stage macros,
+// that must include the queue ID.
+func testMessage(t *testing.T, config string, macros []string, headers []string, expectedAct *milter.Action, expectedOut ...string) *milter.ClientSession {
+	network, address, out := setup(t, config)
+	session := miltertest.Session(t, network, address)
+	miltertest.AssertHeaders(t, session, expectedAct, macros, headers...)
 	for _, expected := range expectedOut {
 		if !bytes.Contains(out.Bytes(), []byte(expected)) {
 			t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
@@ -337,39 +438,2852 @@ func testHeaders(t *testing.T, config string, headers []string, expectedAct *mil
 	scanner := bufio.NewScanner(out)
 	for scanner.Scan() {
 		line := string(scanner.Bytes())
+		// The option negotiation happens before the queue ID is known.
+		if strings.HasPrefix(line, "Option negotiation from ") {
+			continue
+		}
 		if !strings.HasPrefix(line, expectedPrefix) {
 			t.Errorf("expected log lines to be prefixed with: %q\nactual:\n%s", expectedPrefix, line)
 		}
 	}
+	return session
 }
 
-func TestAuthenticatedClient(t *testing.T) {
-	config := `ListenURI = "tcp://127.0.0.1:"`
+func TestMultiResultPolicy(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	deferAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 451,
+		SMTPText: "4.7.1 temporary DMARC error for gmail.com, try again later",
+	}
+	headers := []string{
+		"Authentication-Results", "mail.club1.fr; dmarc=temperror header.from=gmail.com",
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+		"Authentication-Results", "untrusted.example.com; dmarc=pass header.from=gmail.com",
+		"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+	}
+	cases := []struct {
+		policy string
+		action *milter.Action
+		output []string
+	}{
+		{
+			policy: "first",
+			action: deferAct,
+			output: []string{
+				`QUEUEID: duplicate authres for authserv="mail.club1.fr" ignored dmarc=fail from=gmail.com`,
+				`QUEUEID: defer dmarc=temperror from=gmail.com `,
+			},
+		},
+		{
+			policy: "worst",
+			action: rejectAct,
+			output: []string{
+				"QUEUEID: multiple DMARC results, kept the worst one dmarc=fail from=gmail.com\n",
+				`QUEUEID: reject dmarc=fail from=gmail.com `,
+			},
+		},
+		{
+			policy: "last",
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{
+				"QUEUEID: multiple DMARC results, kept the last one dmarc=pass from=gmail.com\n",
+				`QUEUEID: accept dmarc=pass from=gmail.com `,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogLevel = "debug"
+MultiResultPolicy = "` + c.policy + `"
+`
+			testHeaders(t, config, headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestRejectEnvelopeMismatch(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+DomainActions = { "example.org" = "accept" }
+RejectEnvelopeMismatch = true
+`
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	cases := []struct {
+		name     string
+		mailFrom string
+		from     string
+		action   *milter.Action
+		expected string
+	}{
+		{
+			name:     "mismatch",
+			mailFrom: "phisher@attacker.example.net",
+			from:     "Support <support@gmail.com>",
+			action:   rejectAct,
+			expected: `QUEUEID: reject reason=envelope-mismatch envelope_from_domain=attacker.example.net header_from_domain=gmail.com mail_from="phisher@attacker.example.net" addr="Support <support@gmail.com>" `,
+		},
+		{
+			name:     "same organizational domain",
+			mailFrom: "bounces@mail.gmail.com",
+			from:     "support@gmail.com",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: accept dmarc=pass from=gmail.com ",
+		},
+		{
+			name:     "not listed",
+			mailFrom: "phisher@attacker.example.net",
+			from:     "support@example.com",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: accept dmarc=pass from=example.com ",
+		},
+		{
+			name:     "accepted domain",
+			mailFrom: "phisher@attacker.example.net",
+			from:     "support@example.org",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: accept dmarc=pass from=example.org ",
+		},
+		{
+			name:     "bounce",
+			mailFrom: "",
+			from:     "mailer-daemon@gmail.com",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: accept dmarc=pass from=gmail.com ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+			session := miltertest.Session(t, network, address)
+			if _, err := session.Mail(c.mailFrom, []string{}); err != nil {
+				t.Fatal("unexpected err sending MAIL FROM: ", err)
+			}
+			if err := session.Macros(milter.CodeHeader, "i", "QUEUEID"); err != nil {
+				t.Fatal("unexpected err setting macros: ", err)
+			}
+			domain := dmarc.AddressDomain(c.from)
+			for _, h := range [][2]string{
+				{"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=" + domain},
+				{"From", c.from},
+			} {
+				if _, err := session.HeaderField(h[0], h[1]); err != nil {
+					t.Fatal("unexpected err sending header: ", err)
+				}
+			}
+			res, err := session.HeaderEnd()
+			if err != nil {
+				t.Fatal("unexpected err sending EOH: ", err)
+			}
+			if !reflect.DeepEqual(c.action, res) {
+				t.Errorf("expected %#v, got %#v", c.action, res)
+			}
+			if !strings.Contains(out.String(), c.expected) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestRequireFromHeader(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RequireFromHeader = true
+`
+	authres := "mail.club1.fr; dmarc=fail header.from=gmail.com"
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	cases := []struct {
+		name     string
+		config   string
+		headers  []string
+		action   *milter.Action
+		expected string
+	}{
+		{
+			name:     "AR without From",
+			headers:  []string{"Authentication-Results", authres},
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: `QUEUEID: accept reason=no-from-to-confirm dmarc=fail from=gmail.com addr="" header_from_domain= `,
+		},
+		{
+			name:     "misaligned From",
+			headers:  []string{"Authentication-Results", authres, "From", "coucou@example.com"},
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: `QUEUEID: accept reason=no-from-to-confirm dmarc=fail from=gmail.com addr="coucou@example.com" header_from_domain=example.com `,
+		},
+		{
+			name:     "misaligned From with RejectOnFromMismatch",
+			config:   "RejectOnFromMismatch = true\nDomainActions = { \"example.com\" = \"reject\" }\n",
+			headers:  []string{"Authentication-Results", authres, "From", "coucou@example.com"},
+			action:   &milter.Action{Code: milter.ActReplyCode, SMTPCode: 550, SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy"},
+			expected: `QUEUEID: reject reason=from-mismatch header_from=example.com ar_from=gmail.com `,
+		},
+		{
+			name:     "aligned From",
+			headers:  []string{"Authentication-Results", authres, "From", "coucou@mail.gmail.com"},
+			action:   rejectAct,
+			expected: `QUEUEID: reject dmarc=fail from=gmail.com addr="coucou@mail.gmail.com" `,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config+c.config, c.headers, c.action, c.expected)
+		})
+	}
+}
+
+func TestRejectDelay(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RejectDelay = "50ms"
+`
+	network, address, out := setup(t, config)
+	for _, c := range []struct {
+		domain  string
+		action  *milter.Action
+		delayed bool
+	}{
+		{"hotmail.fr", &milter.Action{Code: milter.ActAccept}, false},
+		{"gmail.com", &milter.Action{Code: milter.ActReplyCode, SMTPCode: 550, SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy"}, true},
+	} {
+		session := miltertest.Session(t, network, address)
+		start := time.Now()
+		miltertest.AssertHeaders(t, session, c.action, []string{"i", "QUEUEID"},
+			"Authentication-Results", "mail.club1.fr; dmarc=fail header.from="+c.domain,
+		)
+		if elapsed := time.Since(start); (elapsed >= 50*time.Millisecond) != c.delayed {
+			t.Errorf("expected %s to be delayed %v, got %v", c.domain, c.delayed, elapsed)
+		}
+	}
+	if e := "QUEUEID: tarpit delay=50ms applied before the reject\n"; strings.Count(out.String(), e) != 1 {
+		t.Errorf("expected contains once:\n%s\nactual:\n%s", e, out.String())
+	}
+}
+
+func TestTarpitShutdown(t *testing.T) {
+	prevLogOut := l.Writer()
+	t.Cleanup(func() { l.SetOutput(prevLogOut) })
+	out := &bytes.Buffer{}
+	l.SetOutput(out)
+	prevShutdown := shutdown
+	t.Cleanup(func() { shutdown = prevShutdown })
+	done := make(chan struct{})
+	close(done)
+	shutdown = done
+
+	start := time.Now()
+	tarpit("QUEUEID", 20*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the tarpit to be interrupted, waited %v", elapsed)
+	}
+	if e := "QUEUEID: tarpit delay=20s interrupted by the shutdown after "; !strings.Contains(out.String(), e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+	}
+}
+
+func TestAuthservIDCheck(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+AuthservIDCheckMessages = 3
+`
+	untrusted := []string{"Authentication-Results", "mx.club1.fr; dmarc=fail header.from=gmail.com"}
+	trusted := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}
+	expected := `Warning: none of the last 3 messages with Authentication-Results header fields had a trusted authserv-id, AuthservID "mail.club1.fr" probably does not match`
+	cases := []struct {
+		name     string
+		messages [][]string
+		warning  bool
+	}{
+		{"mismatch", [][]string{untrusted, {"From", "coucou@gmail.com"}, untrusted, untrusted}, true},
+		{"incomplete window", [][]string{untrusted, untrusted}, false},
+		{"one trusted", [][]string{untrusted, trusted, untrusted}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+			for _, headers := range c.messages {
+				session := miltertest.Session(t, network, address)
+				miltertest.Headers(t, session, []string{"i", "QUEUEID"}, headers...)
+			}
+			if warned := strings.Contains(out.String(), expected); warned != c.warning {
+				t.Errorf("expected warning %v, got:\n%s", c.warning, out.String())
+			}
+		})
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogFormat = "logfmt"
+`
 	network, address, out := setup(t, config)
+	session := miltertest.Session(t, network, address)
+	miltertest.Headers(t, session, []string{"i", "QUEUE ID"},
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+		"From", "Coucou <coucou@gmail.com>",
+	)
+	session = miltertest.Session(t, network, address)
+	miltertest.Headers(t, session, []string{"i", "QUEUEID"},
+		"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+	)
 
-	client := milter.NewClientWithOptions(network, address, milter.ClientOptions{
-		Dialer: &net.Dialer{},
+	pair := regexp.MustCompile(`^[a-z_]+=("(?:[^"\\]|\\.)*"|[^ "=]*)( |$)`)
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^ts=\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z queue_id="QUEUE ID" action=reject dmarc=fail from=gmail.com addr="Coucou <coucou@gmail.com>" .* dur=[0-9.]+ms$`),
+		regexp.MustCompile(`^ts=\S+ queue_id=QUEUEID action=accept dmarc=pass from=gmail.com addr="" .* reason=pass dur=[0-9.]+ms$`),
+	}
+	waitForLog(out, "queue_id=QUEUEID")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got:\n%s", len(expected), out.String())
+	}
+	for i, line := range lines {
+		if !expected[i].MatchString(line) {
+			t.Errorf("expected line matching %s, got:\n%s", expected[i], line)
+		}
+		for rest := line; rest != ""; {
+			m := pair.FindString(rest)
+			if m == "" {
+				t.Errorf("expected key=value pairs, got %q in line:\n%s", rest, line)
+				break
+			}
+			rest = rest[len(m):]
+		}
+	}
+}
+
+func TestLogFieldsFormats(t *testing.T) {
+	headers := []string{
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+		"From", "Coucou <coucou@gmail.com>",
+	}
+	reject := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogFields = ["from=sender_domain", "queue_id=id"]
+`
+	t.Run("text", func(t *testing.T) {
+		testHeaders(t, config, headers, reject,
+			`QUEUEID: reject sender_domain=gmail.com dmarc=fail addr="Coucou <coucou@gmail.com>" header_from_domain=gmail.com dur=`)
 	})
-	defer client.Close()
-	session, err := client.Session()
-	if err != nil {
-		t.Fatal("unexpected error: ", err)
+	t.Run("logfmt", func(t *testing.T) {
+		network, address, out := setup(t, config+`LogFormat = "logfmt"`+"\n")
+		session := miltertest.Session(t, network, address)
+		miltertest.AssertHeaders(t, session, reject, []string{"i", "QUEUEID"}, headers...)
+		expected := regexp.MustCompile(`^sender_domain=gmail.com id=QUEUEID ts=\S+ action=reject dmarc=fail addr="Coucou <coucou@gmail.com>" header_from_domain=gmail.com dur=[0-9.]+ms$`)
+		if line := strings.TrimSpace(out.String()); !expected.MatchString(line) {
+			t.Errorf("expected line matching %s, got:\n%s", expected, line)
+		}
+	})
+}
+
+func TestAbort(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogLevel = "debug"
+`
+	network, address, out := setup(t, config)
+	session := miltertest.Session(t, network, address)
+	if _, err := session.Conn("mx.example.com", milter.FamilyInet, 25, "203.0.113.25"); err != nil {
+		t.Fatal("unexpected err sending CONNECT: ", err)
+	}
+	if _, err := session.Mail("coucou@gmail.com", []string{}); err != nil {
+		t.Fatal("unexpected err sending MAIL FROM: ", err)
+	}
+	if err := session.Macros(milter.CodeHeader, "i", "ABORTED"); err != nil {
+		t.Fatal("unexpected err setting macros: ", err)
+	}
+	if _, err := session.HeaderField("Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"); err != nil {
+		t.Fatal("unexpected err sending header: ", err)
+	}
+	if err := session.Abort(); err != nil {
+		t.Fatal("unexpected err sending ABORT: ", err)
 	}
-	defer session.Close()
 
-	if err := session.Macros(milter.CodeMail, "{auth_authen}", "nicolas"); err != nil {
-		t.Fatal("unexpected err setting auth macro: ", err)
+	// The result of the aborted message is not kept for the next one.
+	if _, err := session.Mail("coucou@gmail.com", []string{}); err != nil {
+		t.Fatal("unexpected err sending MAIL FROM: ", err)
 	}
-	res, err := session.Mail("nicolas@example.fr", []string{})
-	if err != nil {
-		t.Error("unexpected err sending MAIL FROM: ", err)
+	miltertest.AssertHeaders(t, session, &milter.Action{Code: milter.ActAccept}, []string{"i", "QUEUEID"},
+		"From", "coucou@gmail.com")
+	expected := []string{
+		"ABORTED: message aborted by the MTA\n",
+		"QUEUEID: accept dmarc=unknown from=unknown ",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+		}
+	}
+
+	// The client IP address of the connection is kept.
+	session = miltertest.Session(t, network, address)
+	if _, err := session.Conn("mx.example.com", milter.FamilyInet, 25, "203.0.113.25"); err != nil {
+		t.Fatal("unexpected err sending CONNECT: ", err)
 	}
-	expectedAct := &milter.Action{Code: milter.ActAccept}
-	if !reflect.DeepEqual(expectedAct, res) {
-		t.Errorf("expected %#v, got %#v", expectedAct, res)
+	if err := session.Abort(); err != nil {
+		t.Fatal("unexpected err sending ABORT: ", err)
 	}
+	if _, err := session.Mail("coucou@gmail.com", []string{}); err != nil {
+		t.Fatal("unexpected err sending MAIL FROM: ", err)
+	}
+	miltertest.Headers(t, session, []string{"i", "REJECTED"},
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com")
+	for _, e := range []string{
+		"Message aborted by the MTA before its queue ID was known\n",
+		"REJECTED: reject dmarc=fail from=gmail.com addr=\"\" header_from_domain= client_ip=203.0.113.25 ",
+	} {
+		if !strings.Contains(out.String(), e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, out.String())
+		}
+	}
+}
 
-	if out.Len() != 0 {
-		t.Errorf("expected empty log output, got %q", out.String())
+func TestAuthenticatedClient(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   string
+		mailAct  *milter.Action
+		eohAct   *milter.Action
+		expected string
+		skipped  int64
+	}{
+		{
+			name:    "skip by default",
+			mailAct: &milter.Action{Code: milter.ActAccept},
+			skipped: 1,
+		},
+		{
+			name:     "skip with debug",
+			config:   `LogLevel = "debug"`,
+			mailAct:  &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: skipping DMARC evaluation of authenticated client: auth_authen=\"nicolas\" mail_from=\"nicolas@example.fr\"\n",
+			skipped:  1,
+		},
+		{
+			name:    "no skip",
+			config:  "SkipAuthenticated = false\nLogLevel = \"debug\"",
+			mailAct: &milter.Action{Code: milter.ActContinue},
+			eohAct: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+			},
+			expected: "QUEUEID: not skipping authenticated client: auth_authen=\"nicolas\"\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+` + c.config
+			network, address, out := setup(t, config)
+
+			session := miltertest.Session(t, network, address)
+
+			skipped := metricAuthenticated.Value()
+			if err := session.Macros(milter.CodeMail, "i", "QUEUEID", "{auth_authen}", "nicolas"); err != nil {
+				t.Fatal("unexpected err setting auth macro: ", err)
+			}
+			res, err := session.Mail("nicolas@example.fr", []string{})
+			if err != nil {
+				t.Error("unexpected err sending MAIL FROM: ", err)
+			}
+			if !reflect.DeepEqual(c.mailAct, res) {
+				t.Errorf("expected %#v, got %#v", c.mailAct, res)
+			}
+
+			if c.eohAct != nil {
+				if err := session.Macros(milter.CodeHeader, "i", "QUEUEID"); err != nil {
+					t.Fatal("unexpected err setting macros: ", err)
+				}
+				if _, err := session.HeaderField("Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"); err != nil {
+					t.Error("unexpected err sending header: ", err)
+				}
+				res, err := session.HeaderEnd()
+				if err != nil {
+					t.Error("unexpected err sending EOH: ", err)
+				}
+				if !reflect.DeepEqual(c.eohAct, res) {
+					t.Errorf("expected %#v, got %#v", c.eohAct, res)
+				}
+			}
+
+			if delta := metricAuthenticated.Value() - skipped; delta != c.skipped {
+				t.Errorf("expected messages_authenticated to increase by %d, got %d", c.skipped, delta)
+			}
+			if c.expected == "" {
+				if out.Len() != 0 {
+					t.Errorf("expected empty log output, got %q", out.String())
+				}
+			} else if !strings.Contains(out.String(), c.expected) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+		})
+	}
+}
+
+// runMain runs main with the given config and extra arguments, for modes
+// that exit before serving, and returns what it wrote to stdout and the log.
+func runMain(t *testing.T, config string, args ...string) (string, string) {
+	tmp := t.TempDir()
+
+	// setup config file
+	configPath := filepath.Join(tmp, "dmarcator.conf")
+	err := os.WriteFile(configPath, []byte(config), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runMainArgs(t, append([]string{"-c", configPath}, args...)...)
+}
+
+// runMainArgs is like runMain, without a config file argument.
+func runMainArgs(t *testing.T, args ...string) (string, string) {
+	// setup logger
+	prevLogOut := l.Writer()
+	t.Cleanup(func() { l.SetOutput(prevLogOut) })
+	logBuf := &bytes.Buffer{}
+	l.SetOutput(logBuf)
+
+	os.Args = append([]string{"dmarcator"}, args...)
+
+	// save default conf
+	prevConf := conf
+	t.Cleanup(func() { conf = prevConf })
+
+	// capture stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = prevStdout }()
+	outCh := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		outCh <- out
+	}()
+
+	main()
+	w.Close()
+	return string(<-outCh), logBuf.String()
+}
+
+func TestMissingDefaultConf(t *testing.T) {
+	prevConfDef := flagConfDef
+	t.Cleanup(func() { flagConfDef = prevConfDef })
+	flagConfDef = filepath.Join(t.TempDir(), "dmarcator.conf")
+
+	stdout, log := runMainArgs(t, "--dump-config")
+	expected := fmt.Sprintf("Conf file %s not found, using the default config", flagConfDef)
+	if !strings.Contains(log, expected) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", expected, log)
+	}
+	if !strings.Contains(stdout, `ListenURI = "unix://`) {
+		t.Errorf("expected default ListenURI in dumped config, got:\n%s", stdout)
+	}
+}
+
+func TestEval(t *testing.T) {
+	cases := []struct {
+		name    string
+		message string
+		stdout  string
+		log     string
+	}{
+		{
+			name: "reject",
+			message: "Authentication-Results: mail.club1.fr; dmarc=fail header.from=gmail.com\r\n" +
+				"From: Coucou <coucou@gmail.com>\r\n" +
+				"Subject: Hello world!\r\n" +
+				"\r\n" +
+				"Body\r\n",
+			stdout: "reject: 550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy\n",
+			log:    `eval: reject dmarc=fail from=gmail.com addr="Coucou <coucou@gmail.com>"`,
+		},
+		{
+			name: "accept folded header",
+			message: "From: coucou@gmail.com\n" +
+				"Authentication-Results: mail.club1.fr;\n" +
+				"\tdmarc=pass header.from=gmail.com\n" +
+				"\n",
+			stdout: "accept\n",
+			log:    `eval: accept dmarc=pass from=gmail.com addr="coucou@gmail.com"`,
+		},
+		{
+			name:    "no authres",
+			message: "From: hello@example.com\n\n",
+			stdout:  "accept\n",
+			log:     `eval: accept dmarc=unknown from=unknown addr="hello@example.com"`,
+		},
+		{
+			name: "first result field",
+			message: "X-Authentication-Results: mail.club1.fr; dmarc=fail header.from=gmail.com\n" +
+				"Authentication-Results: mail.club1.fr; dmarc=pass header.from=gmail.com\n" +
+				"From: coucou@gmail.com\n" +
+				"\n",
+			stdout: "reject: 550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy\n",
+			log:    `eval: reject dmarc=fail from=gmail.com addr="coucou@gmail.com"`,
+		},
+		{
+			name: "first result field reversed",
+			message: "Authentication-Results: mail.club1.fr; dmarc=pass header.from=gmail.com\n" +
+				"X-Authentication-Results: mail.club1.fr; dmarc=fail header.from=gmail.com\n" +
+				"From: coucou@gmail.com\n" +
+				"\n",
+			stdout: "accept\n",
+			log:    `eval: accept dmarc=pass from=gmail.com addr="coucou@gmail.com"`,
+		},
+	}
+	config := `
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+AuthResHeaders = ["Authentication-Results", "X-Authentication-Results"]
+MultiResultPolicy = "first"
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msgPath := filepath.Join(t.TempDir(), "message.eml")
+			if err := os.WriteFile(msgPath, []byte(c.message), 0664); err != nil {
+				t.Fatal(err)
+			}
+			stdout, log := runMain(t, config, "--eval", msgPath)
+			if stdout != c.stdout {
+				t.Errorf("expected stdout %q, got %q", c.stdout, stdout)
+			}
+			if !strings.Contains(log, c.log) {
+				t.Errorf("expected log contains:\n%s\nactual:\n%s", c.log, log)
+			}
+		})
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		stdout string
+	}{
+		{
+			name:   "reject",
+			header: "mail.club1.fr; spf=pass smtp.mailfrom=gmail.com; dmarc=fail (p=none dis=none) header.from=gmail.com",
+			stdout: `authserv-id "mail.club1.fr" trusted by AuthservID
+dmarc=fail from=gmail.com policy=none spf=pass
+reject: 550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy
+`,
+		},
+		{
+			name:   "untrusted",
+			header: "mx.example.com; dmarc=fail header.from=gmail.com",
+			stdout: `authserv-id "mx.example.com" not trusted
+dmarc=fail from=gmail.com
+accept
+`,
+		},
+		{
+			name:   "no dmarc",
+			header: "mail.club1.fr; spf=fail smtp.mailfrom=gmail.com",
+			stdout: `authserv-id "mail.club1.fr" trusted by AuthservID
+no DMARC result
+accept
+`,
+		},
+	}
+	config := `
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stdout, _ := runMain(t, config, "--check-header", c.header)
+			if stdout != c.stdout {
+				t.Errorf("expected stdout:\n%s\ngot:\n%s", c.stdout, stdout)
+			}
+		})
+	}
+	if err := checkHeader(io.Discard, "mail.club1.fr; dmarc header.from=gmail.com"); err == nil {
+		t.Error("expected parse error")
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	prevVersion, prevCommit, prevDate := version, commit, date
+	t.Cleanup(func() { version, commit, date = prevVersion, prevCommit, prevDate })
+	version, commit, date = "v1.2.3", "abc1234", "2025-06-01T12:00:00Z"
+	expected := "dmarcator v1.2.3 (commit abc1234, built 2025-06-01T12:00:00Z, go " + runtime.Version() + ")"
+	if actual := versionString(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	config := `
+RejectDomains = ["gmail.com"]
+UMask = 0o022
+`
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected := conf
+	stdout, _ := runMain(t, config, "--dump-config")
+	var actual Conf
+	if _, err := toml.Decode(stdout, &actual); err != nil {
+		t.Fatalf("unexpected error decoding dumped config: %v\n%s", err, stdout)
+	}
+	expected.AuthservID = hostname
+	expected.RejectDomains = []string{"gmail.com"}
+	expected.UMask = 0o022
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %#v, got %#v", expected, actual)
+	}
+}
+
+func TestReadConf(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := write("base.conf", `
+LogLevel = "debug"
+RejectDomains = ["gmail.com"]
+DomainActions = { "example.com" = "quarantine", "example.org" = "tag" }
+MailingListHeaders = ["List-Id"]
+`)
+	write("conf.d/20-domains.conf", `RejectDomains = ["hotmail.fr"]`)
+	write("conf.d/10-log.conf", `
+LogLevel = "info"
+RejectDomains = "yahoo.fr"
+DomainActions = { "example.org" = "accept" }
+`)
+	write("conf.d/README", `not a conf file`)
+
+	c, found, err := readConf([]string{base, filepath.Join(dir, "conf.d")}, true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if !found {
+		t.Error("expected the files to be found")
+	}
+	expected := defaultConf()
+	expected.LogLevel = "info"
+	expected.RejectDomains = DomainList{"gmail.com", "yahoo.fr", "hotmail.fr"}
+	expected.DomainActions = map[string]Action{"example.com": ActionQuarantine, "example.org": ActionAccept}
+	expected.MailingListHeaders = []string{"List-Id"}
+	if !reflect.DeepEqual(expected, c) {
+		t.Errorf("expected %#v, got %#v", expected, c)
+	}
+
+	// A single file replaces the default lists.
+	c, _, err = readConf([]string{filepath.Join(dir, "conf.d", "10-log.conf")}, true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if !reflect.DeepEqual(DomainList{"yahoo.fr"}, c.RejectDomains) {
+		t.Errorf("expected only yahoo.fr, got %q", c.RejectDomains)
+	}
+	if !reflect.DeepEqual(defaultConf().MailingListHeaders, c.MailingListHeaders) {
+		t.Errorf("expected the default MailingListHeaders, got %q", c.MailingListHeaders)
+	}
+
+	missing := filepath.Join(dir, "missing.conf")
+	if _, found, err := readConf([]string{base, missing}, false); err != nil || found {
+		t.Errorf("expected a missing file without error, got %v, %v", found, err)
+	}
+	if _, _, err := readConf([]string{base, missing}, true); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	invalid := write("invalid.conf", `LogLevel = `)
+	if _, _, err := readConf([]string{base, invalid}, true); err == nil || !strings.Contains(err.Error(), invalid) {
+		t.Errorf("expected an error naming %s, got %v", invalid, err)
+	}
+}
+
+func TestReadConfKeyCase(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.conf")
+	if err := os.WriteFile(base, []byte(`
+rejectdomains = ["gmail.com"]
+MailingListHEADERS = ["X-List"]
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "extra.conf")
+	if err := os.WriteFile(extra, []byte(`REJECTDOMAINS = ["yahoo.fr"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := readConf([]string{base, extra}, true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if expected := (DomainList{"gmail.com", "yahoo.fr"}); !reflect.DeepEqual(expected, c.RejectDomains) {
+		t.Errorf("expected RejectDomains %q, got %q", expected, c.RejectDomains)
+	}
+	if expected := []string{"X-List"}; !reflect.DeepEqual(expected, c.MailingListHeaders) {
+		t.Errorf("expected MailingListHeaders %q, got %q", expected, c.MailingListHeaders)
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	stdout, _ := runMainArgs(t, "--generate-config")
+	var commented Conf
+	if _, err := toml.Decode(stdout, &commented); err != nil {
+		t.Fatalf("unexpected error decoding generated config: %v\n%s", err, stdout)
+	}
+	if !reflect.DeepEqual(Conf{}, commented) {
+		t.Errorf("expected all the options to be commented out, got %#v", commented)
+	}
+
+	typ := reflect.TypeOf(Conf{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		re := regexp.MustCompile(`\n# .*\n#(` + name + ` = |\[\[` + name + `\]\]\n)`)
+		if !re.MatchString(stdout) {
+			t.Errorf("expected a documented %s in generated config:\n%s", name, stdout)
+		}
+	}
+
+	uncommented := regexp.MustCompile(`(?m)^#([A-Z]\w* = )`).ReplaceAllString(stdout, "$1")
+	var actual Conf
+	if _, err := toml.Decode(uncommented, &actual); err != nil {
+		t.Fatalf("unexpected error decoding uncommented config: %v\n%s", err, uncommented)
+	}
+	expected := reflect.ValueOf(defaultConf())
+	for i := 0; i < typ.NumField(); i++ {
+		e, a := expected.Field(i), reflect.ValueOf(actual).Field(i)
+		if k := e.Kind(); (k == reflect.Slice || k == reflect.Map) && e.Len() == 0 && a.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(e.Interface(), a.Interface()) {
+			t.Errorf("expected default %s %#v, got %#v", typ.Field(i).Name, e.Interface(), a.Interface())
+		}
+	}
+}
+
+func TestInvalidDomains(t *testing.T) {
+	config := `
+RejectDomains = ["gmail.com", "gmail,com", ""]
+DomainActions = { "example..com" = "tag" }
+`
+	_, log := runMain(t, config, "--dump-config")
+	expected := []string{
+		`Warning: invalid domain "gmail,com" in RejectDomains: `,
+		`Warning: invalid domain "" in RejectDomains: `,
+		`Warning: invalid domain "example..com" in DomainActions: `,
+	}
+	for _, e := range expected {
+		if !strings.Contains(log, e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+		}
+	}
+	if strings.Contains(log, `"gmail.com"`) {
+		t.Errorf("expected valid domain not to be reported, got:\n%s", log)
+	}
+}
+
+func TestRejectDomainsString(t *testing.T) {
+	config := `
+RejectDomains = """gmail.com, Hotmail.fr ,
+  example.com,,"""
+`
+	stdout, _ := runMain(t, config, "--dump-config")
+	var actual Conf
+	if _, err := toml.Decode(stdout, &actual); err != nil {
+		t.Fatalf("unexpected error decoding dumped config: %v\n%s", err, stdout)
+	}
+	if expected := (DomainList{"gmail.com", "hotmail.fr", "example.com"}); !reflect.DeepEqual(expected, actual.RejectDomains) {
+		t.Errorf("expected %#v, got %#v", expected, actual.RejectDomains)
+	}
+}
+
+func TestDuplicateDomains(t *testing.T) {
+	config := `
+RejectDomains = ["gmail.com", "hotmail.fr", "GMAIL.com", "gmail.com"]
+DomainActions = { "example.com" = "tag", "Example.com" = "accept", "hotmail.fr" = "tag" }
+`
+	stdout, log := runMain(t, config, "--dump-config")
+	expected := []string{
+		`Warning: duplicate domain "GMAIL.com" in RejectDomains`,
+		`Warning: duplicate domain "gmail.com" in RejectDomains`,
+		"Removed 2 duplicate domains from RejectDomains",
+		`Warning: duplicate domain "example.com" in DomainActions`,
+		`Warning: domain "hotmail.fr" of RejectDomains is shadowed by DomainActions`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(log, e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+		}
+	}
+	var actual Conf
+	if _, err := toml.Decode(stdout, &actual); err != nil {
+		t.Fatalf("unexpected error decoding dumped config: %v\n%s", err, stdout)
+	}
+	if expected := (DomainList{"gmail.com", "hotmail.fr"}); !reflect.DeepEqual(expected, actual.RejectDomains) {
+		t.Errorf("expected %#v, got %#v", expected, actual.RejectDomains)
+	}
+}
+
+func TestRejectOnFromMismatch(t *testing.T) {
+	rejectAct := func(domain string) *milter.Action {
+		return &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+		}
+	}
+	cases := []struct {
+		name    string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name: "display name mismatch",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=attacker.com",
+				"From", "PayPal <service@paypal.com>",
+			},
+			action: rejectAct("paypal.com"),
+			output: []string{`reject reason=from-mismatch header_from=paypal.com ar_from=attacker.com`},
+		},
+		{
+			name: "bare address mismatch",
+			headers: []string{
+				"From", "coucou@gmail.com",
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=attacker.com",
+			},
+			action: rejectAct("gmail.com"),
+			output: []string{`reject reason=from-mismatch header_from=gmail.com ar_from=attacker.com`},
+		},
+		{
+			name: "unlisted domain",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=attacker.com",
+				"From", "coucou@example.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept dmarc=pass from=attacker.com addr="coucou@example.com" header_from_domain=example.com reason=pass`},
+		},
+		{
+			name: "same organizational domain",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=mail.example.co.uk",
+				"From", "Example <news@Example.co.uk>",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept dmarc=pass from=mail.example.co.uk`},
+		},
+		{
+			name: "aligned but failed for rejected domain",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+				"From", "coucou@gmail.com",
+			},
+			action: rejectAct("gmail.com"),
+			output: []string{`reject dmarc=fail from=gmail.com`},
+		},
+		{
+			name: "no from",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=attacker.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept dmarc=pass from=attacker.com`},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com", "paypal.com"]
+RejectOnFromMismatch = true
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestMatchHeaderFromDomain(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name:   "lookalike result",
+			config: "MatchHeaderFromDomain = true\n",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=login.paypa1.com",
+				"From", "PayPal <service@login.paypal.com>",
+			},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for login.paypal.com overriding policy",
+			},
+			output: []string{`reject reason=header-from-domain dmarc=fail from=login.paypa1.com from_org_domain=paypa1.com addr="PayPal <service@login.paypal.com>" header_from_domain=login.paypal.com header_from_org_domain=paypal.com`},
+		},
+		{
+			name: "lookalike result without MatchHeaderFromDomain",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=login.paypa1.com",
+				"From", "PayPal <service@login.paypal.com>",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept dmarc=fail from=login.paypa1.com`},
+		},
+		{
+			name:   "confirms RequireFromHeader",
+			config: "MatchHeaderFromDomain = true\nRequireFromHeader = true\n",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=paypa1.com",
+				"From", "service@paypal.com",
+			},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for paypal.com overriding policy",
+			},
+			output: []string{`reject reason=header-from-domain dmarc=pass from=paypa1.com`},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["paypal.com"]
+` + c.config
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestStripTrailingDot(t *testing.T) {
+	rejectAct := func(domain string) *milter.Action {
+		return &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+		}
+	}
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name: "result",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=Gmail.com.",
+				"From", "alice@gmail.com",
+			},
+			action: rejectAct("Gmail.com"),
+			output: []string{`reject dmarc=fail from=Gmail.com addr="alice@gmail.com" header_from_domain=gmail.com`},
+		},
+		{
+			name:   "configured domain",
+			config: `DomainActions = { "*.xn--bcher-kva.example." = "reject" }` + "\n",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=mail.xn--bcher-kva.example",
+				"From", "alice@mail.xn--bcher-kva.example.",
+			},
+			action: rejectAct("mail.xn--bcher-kva.example"),
+			output: []string{`reject dmarc=fail from=mail.xn--bcher-kva.example addr="alice@mail.xn--bcher-kva.example." header_from_domain=mail.xn--bcher-kva.example`},
+		},
+		{
+			name:   "organizational domain",
+			config: "RejectOnFromMismatch = true\n",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=mail.gmail.com.",
+				"From", "alice@gmail.com.",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "disabled",
+			config: "StripTrailingDot = false\n",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com.",
+				"From", "alice@gmail.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept dmarc=fail from=gmail.com. addr="alice@gmail.com" header_from_domain=gmail.com`},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+LogAccept = true
+RejectDomains = ["gmail.com"]
+` + c.config
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+
+	_, log := runMain(t, `
+RejectDomains = ["gmail.com.", "Gmail.com", "bücher.example."]
+`, "--dump-config")
+	if e := `Warning: duplicate domain "Gmail.com" in RejectDomains`; !strings.Contains(log, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+	}
+	if strings.Contains(log, "invalid domain") {
+		t.Errorf("expected the domains with a trailing dot to be valid, got:\n%s", log)
+	}
+	_, log = runMain(t, `
+StripTrailingDot = false
+RejectDomains = ["gmail.com."]
+`, "--dump-config")
+	if e := `Warning: invalid domain "gmail.com." in RejectDomains: trailing dot`; !strings.Contains(log, e) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+	}
+}
+
+func TestErrorActions(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	deferAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 451,
+		SMTPText: "4.7.1 temporary DMARC error for gmail.com, try again later",
+	}
+	acceptAct := &milter.Action{Code: milter.ActAccept}
+	cases := []struct {
+		name   string
+		config string
+		header string
+		action *milter.Action
+	}{
+		{
+			name:   "temperror default",
+			header: "mail.club1.fr; dmarc=temperror header.from=gmail.com",
+			action: deferAct,
+		},
+		{
+			name:   "permerror default",
+			header: "mail.club1.fr; dmarc=permerror header.from=gmail.com",
+			action: rejectAct,
+		},
+		{
+			name:   "temperror accept",
+			config: `TempErrorAction = "accept"`,
+			header: "mail.club1.fr; dmarc=temperror header.from=gmail.com",
+			action: acceptAct,
+		},
+		{
+			name:   "temperror reject",
+			config: `TempErrorAction = "reject"`,
+			header: "mail.club1.fr; dmarc=temperror header.from=gmail.com",
+			action: rejectAct,
+		},
+		{
+			name:   "permerror defer",
+			config: `PermErrorAction = "defer"`,
+			header: "mail.club1.fr; dmarc=permerror header.from=gmail.com",
+			action: deferAct,
+		},
+		{
+			name:   "temperror for non-rejected domain",
+			header: "mail.club1.fr; dmarc=temperror header.from=example.com",
+			action: acceptAct,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+` + c.config
+			testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+		})
+	}
+}
+
+func TestRejectMultipleFrom(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name: "AR then two From",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com",
+				"From", "first@example.com",
+				"From", "=?UTF-8?q?PayPal?= <service@paypal.com>",
+			},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy",
+			},
+			output: []string{`QUEUEID: reject reason=multiple-from addr="first@example.com" other_addr="PayPal <service@paypal.com>" header_from_domain=example.com`},
+		},
+		{
+			name: "single From",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com",
+				"From", "first@example.com",
+				"Subject", "coucou",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectMultipleFrom = true
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestBracedQueueIDMacro(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testMessage(t, config, []string{"{i}", "QUEUEID"}, headers, expected, "QUEUEID: reject dmarc=fail")
+}
+
+func TestRejectMissingFrom(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name:    "missing From",
+			config:  "RejectMissingFrom = true",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com"},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of missing From header field",
+			},
+			output: []string{"QUEUEID: reject reason=missing-from dur="},
+		},
+		{
+			name:   "From present",
+			config: "RejectMissingFrom = true",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com",
+				"From", "coucou@example.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:    "disabled by default",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com"},
+			action:  &milter.Action{Code: milter.ActAccept},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+` + c.config
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestNoAuthResultAction(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name:    "default",
+			headers: []string{"From", "sender@example.com"},
+			action:  &milter.Action{Code: milter.ActAccept},
+			output:  []string{"QUEUEID: accept dmarc=unknown from=unknown"},
+		},
+		{
+			name:    "defer",
+			config:  `NoAuthResultAction = "defer"`,
+			headers: []string{"From", "sender@example.com"},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 451,
+				SMTPText: "4.7.1 temporary DMARC error for example.com, try again later",
+			},
+			output: []string{"QUEUEID: defer dmarc=unknown from=unknown"},
+		},
+		{
+			name:    "reject",
+			config:  `NoAuthResultAction = "reject"`,
+			headers: []string{"From", "sender@example.com"},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy",
+			},
+			output: []string{"QUEUEID: reject dmarc=unknown from=unknown"},
+		},
+		{
+			name:   "reject with results from other authserv-id",
+			config: `NoAuthResultAction = "reject"`,
+			headers: []string{
+				"Authentication-Results", "example.com; dmarc=pass header.from=example.com",
+				"From", "sender@example.com",
+			},
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy",
+			},
+		},
+		{
+			name:   "reject with results",
+			config: `NoAuthResultAction = "reject"`,
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com",
+				"From", "sender@example.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+` + c.config
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestRespectPublishedPolicy(t *testing.T) {
+	rejectAct := func(domain string) *milter.Action {
+		return &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+		}
+	}
+	cases := []struct {
+		name       string
+		header     string
+		action     *milter.Action
+		quarantine string
+	}{
+		{
+			name:       "quarantine comment for non-rejected domain",
+			header:     "mail.club1.fr; dmarc=fail (p=quarantine dis=quarantine) header.from=example.com",
+			action:     &milter.Action{Code: milter.ActContinue},
+			quarantine: "DMARC failure for example.com with quarantine policy",
+		},
+		{
+			name:       "quarantine comment for rejected domain",
+			header:     "mail.club1.fr; dmarc=fail (p=QUARANTINE sp=NONE dis=NONE) header.from=gmail.com",
+			action:     &milter.Action{Code: milter.ActContinue},
+			quarantine: "DMARC failure for gmail.com with quarantine policy",
+		},
+		{
+			name:   "reject property",
+			header: "mail.club1.fr; dmarc=fail policy.published-domain-policy=reject header.from=example.com",
+			action: rejectAct("example.com"),
+		},
+		{
+			name:   "none policy for rejected domain",
+			header: "mail.club1.fr; dmarc=fail (p=none dis=none) header.from=gmail.com",
+			action: rejectAct("gmail.com"),
+		},
+		{
+			name:   "temperror with reject policy for rejected domain",
+			header: "mail.club1.fr; dmarc=temperror (p=reject dis=none) header.from=gmail.com",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 451,
+				SMTPText: "4.7.1 temporary DMARC error for gmail.com, try again later",
+			},
+		},
+		{
+			name:   "temperror with reject policy for non-rejected domain",
+			header: "mail.club1.fr; dmarc=temperror (p=reject dis=none) header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "pass with quarantine policy",
+			header: "mail.club1.fr; dmarc=pass (p=quarantine dis=none) header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "no policy",
+			header: "mail.club1.fr; dmarc=fail header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RespectPublishedPolicy = true
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			session := testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+			if c.action.Code != milter.ActContinue {
+				return
+			}
+			modifyActs, act, err := session.End()
+			if err != nil {
+				t.Fatal("unexpected err sending EOB: ", err)
+			}
+			expectedActs := []milter.ModifyAction{{Code: milter.ActQuarantine, Reason: c.quarantine}}
+			if !reflect.DeepEqual(expectedActs, modifyActs) {
+				t.Errorf("expected %#v, got %#v", expectedActs, modifyActs)
+			}
+			if expected := (&milter.Action{Code: milter.ActAccept}); !reflect.DeepEqual(expected, act) {
+				t.Errorf("expected %#v, got %#v", expected, act)
+			}
+		})
+	}
+}
+
+func TestDomainActions(t *testing.T) {
+	rejectAct := func(domain string) *milter.Action {
+		return &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+		}
+	}
+	cases := []struct {
+		name   string
+		config string
+		header string
+		action *milter.Action
+		modify []milter.ModifyAction
+	}{
+		{
+			name:   "simple form",
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: rejectAct("gmail.com"),
+		},
+		{
+			name:   "simple form with default action",
+			config: `DefaultDomainAction = "quarantine"`,
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: &milter.Action{Code: milter.ActContinue},
+			modify: []milter.ModifyAction{{Code: milter.ActQuarantine, Reason: "DMARC failure for gmail.com with quarantine policy"}},
+		},
+		{
+			name:   "tag",
+			header: "mail.club1.fr; dmarc=fail header.from=example.com",
+			action: &milter.Action{Code: milter.ActContinue},
+			modify: []milter.ModifyAction{{Code: milter.ActAddHeader, HeaderName: "X-Dmarcator", HeaderValue: "DMARC failure for example.com"}},
+		},
+		{
+			name:   "tag pass",
+			header: "mail.club1.fr; dmarc=pass header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "wildcard reject",
+			header: "mail.club1.fr; dmarc=fail header.from=mail.example.org",
+			action: rejectAct("mail.example.org"),
+		},
+		{
+			name:   "exact accept overrides wildcard",
+			header: "mail.club1.fr; dmarc=fail header.from=www.example.org",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "overrides simple form",
+			header: "mail.club1.fr; dmarc=fail header.from=hotmail.fr",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "temperror for tagged domain",
+			header: "mail.club1.fr; dmarc=temperror header.from=example.com",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 451,
+				SMTPText: "4.7.1 temporary DMARC error for example.com, try again later",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com", "hotmail.fr"]
+DomainActions = { "hotmail.fr" = "accept", "example.com" = "tag", "*.example.org" = "reject", "www.example.org" = "accept" }
+` + c.config
+			session := testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+			if c.action.Code != milter.ActContinue {
+				return
+			}
+			modifyActs, act, err := session.End()
+			if err != nil {
+				t.Fatal("unexpected err sending EOB: ", err)
+			}
+			if !reflect.DeepEqual(c.modify, modifyActs) {
+				t.Errorf("expected %#v, got %#v", c.modify, modifyActs)
+			}
+			if expected := (&milter.Action{Code: milter.ActAccept}); !reflect.DeepEqual(expected, act) {
+				t.Errorf("expected %#v, got %#v", expected, act)
+			}
+		})
+	}
+}
+
+func TestDomainRuleActions(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+
+[[Domain]]
+name = "gmail.com"
+actions = ["tag", "quarantine"]
+
+[[Domain]]
+name = "example.com"
+actions = ["tag", "accept"]
+`
+	cases := []struct {
+		domain string
+		modify []milter.ModifyAction
+	}{
+		{"gmail.com", []milter.ModifyAction{
+			{Code: milter.ActAddHeader, HeaderName: "X-Dmarcator", HeaderValue: "DMARC failure for gmail.com"},
+			{Code: milter.ActQuarantine, Reason: "DMARC failure for gmail.com with quarantine policy"},
+		}},
+		{"example.com", []milter.ModifyAction{
+			{Code: milter.ActAddHeader, HeaderName: "X-Dmarcator", HeaderValue: "DMARC failure for example.com"},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.domain, func(t *testing.T) {
+			header := "mail.club1.fr; dmarc=fail header.from=" + c.domain
+			session := testHeaders(t, config, []string{"Authentication-Results", header}, &milter.Action{Code: milter.ActContinue})
+			modifyActs, act, err := session.End()
+			if err != nil {
+				t.Fatal("unexpected err sending EOB: ", err)
+			}
+			if !reflect.DeepEqual(c.modify, modifyActs) {
+				t.Errorf("expected %#v, got %#v", c.modify, modifyActs)
+			}
+			if expected := (&milter.Action{Code: milter.ActAccept}); !reflect.DeepEqual(expected, act) {
+				t.Errorf("expected %#v, got %#v", expected, act)
+			}
+		})
+	}
+}
+
+func TestDomainRuleLog(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+
+[[Domain]]
+name = "gmail.com"
+actions = ["log", "reject"]
+
+[[Domain]]
+name = "example.com"
+actions = ["accept", "log"]
+
+[[Domain]]
+name = "hotmail.fr"
+actions = ["tag", "quarantine", "log"]
+`
+	cases := []struct {
+		domain   string
+		action   *milter.Action
+		expected string
+	}{
+		{
+			domain:   "gmail.com",
+			action:   &milter.Action{Code: milter.ActReplyCode, SMTPCode: 550, SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy"},
+			expected: "QUEUEID: reject+log dmarc=fail from=gmail.com ",
+		},
+		{
+			// Logged even if LogAccepts is not set.
+			domain:   "example.com",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "QUEUEID: accept+log dmarc=fail from=example.com ",
+		},
+		{
+			domain:   "hotmail.fr",
+			action:   &milter.Action{Code: milter.ActContinue},
+			expected: "QUEUEID: quarantine+tag+log dmarc=fail from=hotmail.fr ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.domain, func(t *testing.T) {
+			header := "mail.club1.fr; dmarc=fail header.from=" + c.domain
+			testHeaders(t, config, []string{"Authentication-Results", header}, c.action, c.expected)
+		})
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+AcceptHeader = "X-Dmarcator-Result"
+AcceptHeaderFmt = "checked by dmarcator, dmarc=%s"
+`
+	stamp := func(outcome string) []milter.ModifyAction {
+		return []milter.ModifyAction{{Code: milter.ActAddHeader, HeaderName: "X-Dmarcator-Result", HeaderValue: "checked by dmarcator, dmarc=" + outcome}}
+	}
+	cases := []struct {
+		name    string
+		headers []string
+		modify  []milter.ModifyAction
+	}{
+		{
+			name:    "pass",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com"},
+			modify:  stamp("pass"),
+		},
+		{
+			name:    "none",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=none header.from=example.com"},
+			modify:  stamp("none"),
+		},
+		{
+			name:    "fail not listed",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=example.com"},
+			modify:  stamp("fail-but-not-listed"),
+		},
+		{
+			name:    "no result",
+			headers: []string{"From", "coucou@example.com"},
+			modify:  stamp("unknown"),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			session := testHeaders(t, config, c.headers, &milter.Action{Code: milter.ActContinue})
+			modifyActs, act, err := session.End()
+			if err != nil {
+				t.Fatal("unexpected err sending EOB: ", err)
+			}
+			if !reflect.DeepEqual(c.modify, modifyActs) {
+				t.Errorf("expected %#v, got %#v", c.modify, modifyActs)
+			}
+			if expected := (&milter.Action{Code: milter.ActAccept}); !reflect.DeepEqual(expected, act) {
+				t.Errorf("expected %#v, got %#v", expected, act)
+			}
+		})
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		testHeaders(t, config, []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}, &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+		})
+	})
+}
+
+func TestResultActions(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		action *milter.Action
+	}{
+		{
+			name:   "none with reject policy",
+			header: "mail.club1.fr; dmarc=none (p=reject dis=none) header.from=example.com",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for example.com overriding policy",
+			},
+		},
+		{
+			name:   "none with quarantine policy",
+			header: "mail.club1.fr; dmarc=none (p=quarantine dis=none) header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "temperror",
+			header: "mail.club1.fr; dmarc=temperror header.from=example.com",
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 451,
+				SMTPText: "4.7.1 temporary DMARC error for example.com, try again later",
+			},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+ResultActions = { "none/reject" = "reject", "temperror" = "defer" }
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+		})
+	}
+}
+
+func TestInvalidResultActions(t *testing.T) {
+	config := `ResultActions = { "softfail" = "reject", "none/discard" = "tag", "fail/reject" = "reject" }`
+	_, log := runMain(t, config, "--dump-config")
+	expected := []string{
+		`Warning: invalid key "none/discard" in ResultActions: `,
+		`Warning: invalid key "softfail" in ResultActions: `,
+	}
+	for _, e := range expected {
+		if !strings.Contains(log, e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+		}
+	}
+	if strings.Contains(log, `"fail/reject"`) {
+		t.Errorf("expected valid key not to be reported, got:\n%s", log)
+	}
+}
+
+func TestUTF8RejectFmt(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RejectFmt = "refusé à cause d'un échec DMARC pour %s ✉"
+`
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 refusé à cause d'un échec DMARC pour gmail.com ✉",
+	}
+	testHeaders(t, config, headers, expected)
+}
+
+func TestMissingAuthres(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []string
+		delta   int64
+	}{
+		{"from without authres", []string{"From", "hello@example.com"}, 1},
+		{"untrusted authres", []string{"Authentication-Results", "other.example; dmarc=pass header.from=example.com", "From", "hello@example.com"}, 1},
+		{"trusted authres", []string{"Authentication-Results", "mail.club1.fr; dmarc=none header.from=example.com", "From", "hello@example.com"}, 0},
+		{"no from", []string{"Subject", "Hello world!"}, 0},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := metricMissingAuthres.Value()
+			testHeaders(t, config, c.headers, &milter.Action{Code: milter.ActAccept})
+			if delta := metricMissingAuthres.Value() - before; delta != c.delta {
+				t.Errorf("expected missing_authres to increase by %d, got %d", c.delta, delta)
+			}
+		})
+	}
+}
+
+func TestInternalErrorAction(t *testing.T) {
+	prevLookup, prevPolicies := lookupTXT, dmarcPolicies
+	t.Cleanup(func() { lookupTXT, dmarcPolicies = prevLookup, prevPolicies })
+	dmarcPolicies = &policyCache{policies: make(map[string]cachedPolicy)}
+	// Injects a bug in the DNS fallback.
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		panic("injected bug")
+	}
+	cases := []struct {
+		name   string
+		config string
+		action *milter.Action
+		output string
+	}{
+		{
+			name:   "fail open by default",
+			action: &milter.Action{Code: milter.ActAccept},
+			output: "QUEUEID: Error: internal error while taking the decision, falling back to accept: injected bug\n",
+		},
+		{
+			name:   "fail closed",
+			config: `InternalErrorAction = "defer"`,
+			action: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 451,
+				SMTPText: "4.7.1 temporary DMARC error for example.com, try again later",
+			},
+			output: "QUEUEID: Error: internal error while taking the decision, falling back to defer: injected bug\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+FallbackDNS = true
+RejectDomains = ["example.com"]
+` + c.config
+			internalErrors := metricInternalErrors.Value()
+			testHeaders(t, config, []string{"From", "sender@example.com"}, c.action, c.output)
+			if delta := metricInternalErrors.Value() - internalErrors; delta != 1 {
+				t.Errorf("expected 1 internal error, got %d", delta)
+			}
+		})
+	}
+}
+
+func TestMaxReplyLength(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RejectFmt = "refusé pour %s\nà cause d'un échec DMARC : réessayez plus tard"
+MaxReplyLength = 64
+`
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}
+	// The text is cut before the "é" that does not fit.
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 refusé pour gmail.com à cause d'un échec DMARC : r",
+	}
+	testHeaders(t, config, headers, expected, "QUEUEID: truncated the SMTP reply to MaxReplyLength=64\n")
+}
+
+func TestRejectFmtByResult(t *testing.T) {
+	rejectAct := func(text string) *milter.Action {
+		return &milter.Action{Code: milter.ActReplyCode, SMTPCode: 550, SMTPText: "5.7.1 " + text}
+	}
+	cases := []struct {
+		name   string
+		header string
+		action *milter.Action
+	}{
+		{
+			name:   "none",
+			header: "mail.club1.fr; dmarc=none header.from=gmail.com",
+			action: rejectAct("no DMARC record published for gmail.com"),
+		},
+		{
+			name:   "fail",
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: rejectAct("DMARC alignment failed for gmail.com"),
+		},
+		{
+			name:   "permerror falls back to RejectFmt",
+			header: "mail.club1.fr; dmarc=permerror header.from=gmail.com",
+			action: rejectAct("rejected because of DMARC failure for gmail.com overriding policy"),
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RejectFmtByResult = { "none" = "no DMARC record published for %s", "fail" = "DMARC alignment failed for %s" }
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+		})
+	}
+	_, log := runMain(t, `RejectFmtByResult = { "softfail" = "%s", "fail/reject" = "%s" }`, "--dump-config")
+	for _, key := range []string{"fail/reject", "softfail"} {
+		expected := fmt.Sprintf("Warning: invalid DMARC result %q in RejectFmtByResult", key)
+		if !strings.Contains(log, expected) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", expected, log)
+		}
+	}
+}
+
+func TestDomainRules(t *testing.T) {
+	rejectAct := func(text string) *milter.Action {
+		return &milter.Action{Code: milter.ActReplyCode, SMTPCode: 550, SMTPText: "5.7.1 " + text}
+	}
+	cases := []struct {
+		name   string
+		header string
+		action *milter.Action
+	}{
+		{
+			name:   "message",
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: rejectAct("gmail.com must pass DMARC"),
+		},
+		{
+			name:   "default action",
+			header: "mail.club1.fr; dmarc=fail header.from=mail.example.org",
+			action: rejectAct("rejected because of DMARC failure for mail.example.org overriding policy"),
+		},
+		{
+			name:   "listed result",
+			header: "mail.club1.fr; dmarc=none header.from=example.com",
+			action: rejectAct("rejected because of DMARC failure for example.com overriding policy"),
+		},
+		{
+			name:   "unlisted result",
+			header: "mail.club1.fr; dmarc=fail header.from=example.com",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:   "overrides RejectDomains",
+			header: "mail.club1.fr; dmarc=fail header.from=hotmail.fr",
+			action: &milter.Action{Code: milter.ActAccept},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["hotmail.fr"]
+
+[[Domain]]
+name = "gmail.com"
+action = "reject"
+message = "%s must pass DMARC"
+
+[[Domain]]
+name = "*.example.org"
+
+[[Domain]]
+name = "example.com"
+action = "reject"
+results = ["none"]
+
+[[Domain]]
+name = "hotmail.fr"
+action = "accept"
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, []string{"Authentication-Results", c.header}, c.action)
+		})
+	}
+
+	stdout, log := runMain(t, config, "--dump-config")
+	var actual Conf
+	if _, err := toml.Decode(stdout, &actual); err != nil {
+		t.Fatalf("unexpected error decoding dumped config: %v\n%s", err, stdout)
+	}
+	if len(actual.Domain) != 4 || actual.Domain[1].Action != nil || *actual.Domain[3].Action != ActionAccept {
+		t.Errorf("unexpected dumped Domain: %#v", actual.Domain)
+	}
+	expected := `Warning: domain "hotmail.fr" of RejectDomains is shadowed by Domain`
+	if !strings.Contains(log, expected) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", expected, log)
+	}
+}
+
+func TestDomainRuleResults(t *testing.T) {
+	reject := func(domain string) *milter.Action {
+		return &milter.Action{
+			Code:     milter.ActReplyCode,
+			SMTPCode: 550,
+			SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+		}
+	}
+	accept := &milter.Action{Code: milter.ActAccept}
+	cases := []struct {
+		domain string
+		value  string
+		action *milter.Action
+	}{
+		{"gmail.com", "fail", reject("gmail.com")},
+		{"gmail.com", "none", accept},
+		{"example.net", "fail", accept},
+		{"example.net", "none", reject("example.net")},
+		{"example.net", "pass", accept},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+
+[[Domain]]
+name = "gmail.com"
+results = ["fail"]
+
+[[Domain]]
+name = "example.net"
+results = ["none"]
+`
+	for _, c := range cases {
+		t.Run(c.domain+" "+c.value, func(t *testing.T) {
+			header := fmt.Sprintf("mail.club1.fr; dmarc=%s header.from=%s", c.value, c.domain)
+			testHeaders(t, config, []string{"Authentication-Results", header}, c.action)
+		})
+	}
+}
+
+func TestInvalidDomainRules(t *testing.T) {
+	config := `
+DomainActions = { "example.org" = "tag" }
+
+[[Domain]]
+name = "gmail,com"
+
+[[Domain]]
+name = "example.com"
+results = ["pass", "softfail", "fail"]
+message = "rejected"
+
+[[Domain]]
+name = "Example.com"
+
+[[Domain]]
+name = "example.org"
+
+[[Domain]]
+name = "example.net"
+action = "reject"
+actions = ["tag", "reject"]
+
+[[Domain]]
+name = "gmail.com"
+actions = ["tag"]
+
+[[Domain]]
+name = "hotmail.fr"
+actions = ["quarantine", "reject"]
+
+[[Domain]]
+name = "yahoo.fr"
+actions = ["log"]
+`
+	_, log := runMain(t, config, "--dump-config")
+	expected := []string{
+		`Warning: invalid name "gmail,com" of Domain 1: `,
+		`Warning: invalid result "pass" of Domain "example.com"`,
+		`Warning: invalid result "softfail" of Domain "example.com"`,
+		`Warning: message of Domain "example.com" must contain "%s" once`,
+		`Warning: duplicate name "Example.com" in Domain`,
+		`Warning: domain "example.org" of DomainActions is shadowed by Domain`,
+		`Warning: action and actions of Domain "example.net" are exclusive`,
+		`Warning: actions of Domain "example.net" cannot combine tag with reject, as the message is not delivered, use "log" to record it instead`,
+		`Warning: actions of Domain "gmail.com" must contain exactly one of accept, defer, quarantine and reject`,
+		`Warning: actions of Domain "hotmail.fr" must contain exactly one of accept, defer, quarantine and reject`,
+		`Warning: actions of Domain "yahoo.fr" must contain exactly one of accept, defer, quarantine and reject`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(log, e) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", e, log)
+		}
+	}
+	if strings.Contains(log, `"fail"`) {
+		t.Errorf("expected valid result not to be reported, got:\n%s", log)
+	}
+}
+
+func TestLogUntrustedResults(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogLevel = "debug"
+LogUntrustedResults = true
+`
+	headers := []string{
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+		"Authentication-Results", "mx.example.com; dmarc=pass header.from=gmail.com",
+		"Authentication-Results", "mx.example.net; spf=pass smtp.mailfrom=gmail.com",
+	}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testHeaders(t, config, headers, expected,
+		`QUEUEID: untrusted DMARC result authserv="mx.example.com" trusted=false dmarc=pass from=gmail.com`)
+}
+
+func TestAuthResHeaders(t *testing.T) {
+	reject := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	cases := []struct {
+		name     string
+		config   string
+		headers  []string
+		expected *milter.Action
+	}{
+		{
+			name:     "default ignores other names",
+			headers:  []string{"X-Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"},
+			expected: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:     "configured name",
+			config:   `AuthResHeaders = ["X-Authentication-Results"]`,
+			headers:  []string{"x-authentication-results", "mail.club1.fr; dmarc=fail header.from=gmail.com"},
+			expected: reject,
+		},
+		{
+			name:   "configured name replaces the default",
+			config: `AuthResHeaders = ["X-Authentication-Results"]`,
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+				"X-Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			},
+			expected: reject,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+` + c.config
+			testHeaders(t, config, c.headers, c.expected)
+		})
+	}
+}
+
+func TestNormalizedDomain(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogLevel = "debug"
+`
+	normalized := metricNormalizedDomains.Value()
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=GMail.com"}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for GMail.com overriding policy",
+	}
+	testHeaders(t, config, headers, expected,
+		`QUEUEID: normalized case of header.from "GMail.com" to "gmail.com"`)
+	if delta := metricNormalizedDomains.Value() - normalized; delta != 1 {
+		t.Errorf("expected normalized_domains to increase by 1, got %d", delta)
+	}
+}
+
+func TestExemptReasons(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+ExemptReasons = ["forwarded"]
+`
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail reason=forwarded header.from=gmail.com"}
+	testHeaders(t, config, headers, &milter.Action{Code: milter.ActAccept},
+		`QUEUEID: accept dmarc=fail from=gmail.com addr="" header_from_domain= dmarc_reason="forwarded" reason=exempt-reason`)
+}
+
+func TestDebugQueueIDs(t *testing.T) {
+	headers := []string{
+		"Subject", "Coucou\r\n\tles amis",
+		"From", "=?ISO-8859-1?Q?Aur=E9lien?= <coucou@gmail.com>",
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+	}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	for _, id := range []string{"QUEUEID", "*"} {
+		t.Run(id, func(t *testing.T) {
+			config := fmt.Sprintf(`
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+DebugQueueIDs = ["OTHER", %q]
+`, id)
+			testHeaders(t, config, headers, expected,
+				`QUEUEID: header Subject: "Coucou\r\n\tles amis"`+"\n",
+				`QUEUEID: header From: "=?ISO-8859-1?Q?Aur=E9lien?= <coucou@gmail.com>" decoded="Aurélien <coucou@gmail.com>"`,
+				`QUEUEID: header Authentication-Results: "mail.club1.fr; dmarc=fail header.from=gmail.com"`,
+			)
+		})
+	}
+}
+
+func TestStrictMechanismCheck(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+StrictMechanismCheck = true
+`
+	headers := []string{
+		"Authentication-Results", "mail.club1.fr; spf=fail smtp.mailfrom=gmail.com; dkim=fail header.d=gmail.com; dmarc=pass header.from=gmail.com",
+		"From", "coucou@gmail.com",
+	}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testHeaders(t, config, headers, expected,
+		`QUEUEID: reject reason=mechanism-inconsistency dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com spf=fail dkim=fail`)
+}
+
+func TestReadReceivedSPF(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	acceptAct := &milter.Action{Code: milter.ActAccept}
+	enabled := "ReadReceivedSPF = true\n"
+	result := "mail.club1.fr; dkim=fail header.d=gmail.com; dmarc=pass header.from=gmail.com"
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  string
+	}{
+		{
+			name:   "mechanism check",
+			config: enabled,
+			headers: []string{
+				"Received-SPF", "Fail (mailfrom) identity=mailfrom; client-ip=192.0.2.1; helo=mail.example.com; envelope-from=coucou@gmail.com; receiver=mail.club1.fr",
+				"Authentication-Results", result,
+			},
+			action: rejectAct,
+			output: `QUEUEID: reject reason=mechanism-inconsistency dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com spf=fail dkim=fail`,
+		},
+		{
+			name:   "first trusted",
+			config: enabled,
+			headers: []string{
+				"Received-SPF", "pass (mx.example.com: domain of coucou@gmail.com designates 192.0.2.1 as permitted sender) receiver=mx.example.com;",
+				"Received-SPF", "pass (helo) identity=helo; receiver=mail.club1.fr",
+				"Received-SPF", `softfail (mail.club1.fr: transitioning domain) client-ip=192.0.2.1; envelope-from="coucou@gmail.com"; receiver=mail.club1.fr`,
+				"Received-SPF", "pass receiver=mail.club1.fr",
+				"Authentication-Results", result,
+			},
+			action: rejectAct,
+			output: `spf=softfail dkim=fail`,
+		},
+		{
+			name:   "Authentication-Results first",
+			config: enabled,
+			headers: []string{
+				"Received-SPF", "fail receiver=mail.club1.fr",
+				"Authentication-Results", "mail.club1.fr; spf=pass smtp.mailfrom=gmail.com; dkim=fail header.d=gmail.com; dmarc=pass header.from=gmail.com",
+			},
+			action: acceptAct,
+			output: `QUEUEID: accept dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com reason=pass spf=pass dkim=fail`,
+		},
+		{
+			name:   "unparsable",
+			config: enabled,
+			headers: []string{
+				"Received-SPF", "maybe receiver=mail.club1.fr",
+				"Authentication-Results", result,
+			},
+			action: acceptAct,
+			output: `QUEUEID: failed to parse header Received-SPF: invalid result "maybe"`,
+		},
+		{
+			name: "disabled",
+			headers: []string{
+				"Received-SPF", "fail receiver=mail.club1.fr",
+				"Authentication-Results", result,
+			},
+			action: acceptAct,
+			output: `QUEUEID: accept dmarc=pass from=gmail.com addr="coucou@gmail.com" header_from_domain=gmail.com reason=pass dkim=fail`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+LogAccept = true
+RejectDomains = ["gmail.com"]
+StrictMechanismCheck = true
+` + c.config
+			headers := append(c.headers, "From", "coucou@gmail.com")
+			testHeaders(t, config, headers, c.action, c.output)
+		})
+	}
+}
+
+func TestDuplicateResults(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	cases := []struct {
+		name     string
+		headers  []string
+		expected *milter.Action
+		output   string
+	}{
+		{
+			name: "first wins",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+			},
+			expected: &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+			},
+			output: `QUEUEID: duplicate authres for authserv="mail.club1.fr" ignored dmarc=pass from=gmail.com`,
+		},
+		{
+			name: "first pass wins",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+				"Authentication-Results", "mx.example.com; dmarc=fail header.from=gmail.com",
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			},
+			expected: &milter.Action{Code: milter.ActAccept},
+			output:   `QUEUEID: duplicate authres for authserv="mail.club1.fr" ignored dmarc=fail from=gmail.com`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testHeaders(t, config, c.headers, c.expected, c.output)
+		})
+	}
+}
+
+func TestOwnedHeaders(t *testing.T) {
+	remove := func(index uint32) milter.ModifyAction {
+		return milter.ModifyAction{Code: milter.ActChangeHeader, HeaderIndex: index, HeaderName: "X-Dmarcator"}
+	}
+	cases := []struct {
+		name    string
+		headers []string
+		modify  []milter.ModifyAction
+		output  string
+	}{
+		{
+			name: "tag",
+			headers: []string{
+				"X-Dmarcator", "DMARC pass",
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=example.com",
+				"x-dmarcator", "DMARC pass",
+			},
+			modify: []milter.ModifyAction{
+				remove(2),
+				remove(1),
+				{Code: milter.ActAddHeader, HeaderName: "X-Dmarcator", HeaderValue: "DMARC failure for example.com"},
+			},
+			output: "QUEUEID: stripped spoofed header field X-Dmarcator count=2",
+		},
+		{
+			name: "accept",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=example.com",
+				"X-Dmarcator", "DMARC failure for example.com",
+			},
+			modify: []milter.ModifyAction{remove(1)},
+			output: "QUEUEID: stripped spoofed header field X-Dmarcator count=1",
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+DomainActions = { "example.com" = "tag" }
+OwnedHeaders = ["X-Dmarcator"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+			session := miltertest.Session(t, network, address)
+			if _, err := session.Mail("coucou@example.com", []string{}); err != nil {
+				t.Fatal("unexpected err sending MAIL FROM: ", err)
+			}
+			if err := session.Macros(milter.CodeHeader, "i", "QUEUEID"); err != nil {
+				t.Fatal("unexpected err setting macros: ", err)
+			}
+			for i := 0; i < len(c.headers); i += 2 {
+				if _, err := session.HeaderField(c.headers[i], c.headers[i+1]); err != nil {
+					t.Error("unexpected err sending header: ", err)
+				}
+			}
+			act, err := session.HeaderEnd()
+			if err != nil {
+				t.Fatal("unexpected err sending EOH: ", err)
+			}
+			if act.Code != milter.ActContinue {
+				t.Fatalf("expected continue, got %#v", act)
+			}
+			modifyActs, act, err := session.End()
+			if err != nil {
+				t.Fatal("unexpected err sending EOB: ", err)
+			}
+			if !reflect.DeepEqual(c.modify, modifyActs) {
+				t.Errorf("expected %#v, got %#v", c.modify, modifyActs)
+			}
+			if expected := (&milter.Action{Code: milter.ActAccept}); !reflect.DeepEqual(expected, act) {
+				t.Errorf("expected %#v, got %#v", expected, act)
+			}
+			if !strings.Contains(out.String(), c.output) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.output, out.String())
+			}
+		})
+	}
+}
+
+func TestSkipMailingLists(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	cases := []struct {
+		name    string
+		config  string
+		headers []string
+		action  *milter.Action
+		output  []string
+	}{
+		{
+			name: "list-id after all other fields",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+				"From", "coucou@gmail.com",
+				"list-id", "<debian-devel.lists.debian.org>",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept reason=mailing-list list_header=List-Id addr="coucou@gmail.com"`},
+		},
+		{
+			name: "list-unsubscribe",
+			headers: []string{
+				"List-Unsubscribe", "<mailto:leave@lists.example.com>",
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			},
+			action: &milter.Action{Code: milter.ActAccept},
+			output: []string{`accept reason=mailing-list list_header=List-Unsubscribe`},
+		},
+		{
+			name:   "custom list header",
+			config: `MailingListHeaders = ["X-Mailing-List"]`,
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+				"List-Id", "<debian-devel.lists.debian.org>",
+			},
+			action: rejectAct,
+		},
+		{
+			name: "no list header",
+			headers: []string{
+				"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+				"From", "coucou@gmail.com",
+			},
+			action: rejectAct,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+SkipMailingLists = true
+` + c.config
+			testHeaders(t, config, c.headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestOverrideMacro(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	acceptAct := &milter.Action{Code: milter.ActAccept}
+	cases := []struct {
+		name   string
+		macro  string
+		header string
+		action *milter.Action
+		output []string
+	}{
+		{
+			name:   "accept overrides reject",
+			macro:  "accept",
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: acceptAct,
+			output: []string{"accept reason=override macro={dmarcator_action}"},
+		},
+		{
+			name:   "reject overrides accept",
+			macro:  "reject",
+			header: "mail.club1.fr; dmarc=pass header.from=gmail.com",
+			action: rejectAct,
+			output: []string{"reject reason=override macro={dmarcator_action}"},
+		},
+		{
+			name:   "empty macro",
+			header: "mail.club1.fr; dmarc=fail header.from=gmail.com",
+			action: rejectAct,
+			output: []string{"reject dmarc=fail from=gmail.com"},
+		},
+		{
+			name:   "invalid macro",
+			macro:  "quarantine",
+			header: "mail.club1.fr; dmarc=pass header.from=gmail.com",
+			action: acceptAct,
+			output: []string{
+				`ignoring invalid value of macro {dmarcator_action}: "quarantine"`,
+				"accept dmarc=pass from=gmail.com",
+			},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+OverrideMacro = "{dmarcator_action}"
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			macros := []string{"i", "QUEUEID", "{dmarcator_action}", c.macro}
+			headers := []string{"Authentication-Results", c.header}
+			testMessage(t, config, macros, headers, c.action, c.output...)
+		})
+	}
+}
+
+func TestOverrideHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		output []string
+	}{
+		{
+			name: "trusted accept overrides reject",
+			script: `
+connect relay.club1.fr 4 40000 192.0.2.1
+expect continue
+macros mail i=QUEUEID
+mail <coucou@gmail.com>
+expect continue
+header Authentication-Results: mail.club1.fr; dmarc=fail header.from=gmail.com
+header X-Trust-Override: accept
+eoh
+expect continue
+eom
+modify change-header 1 X-Trust-Override:
+expect accept
+`,
+			output: []string{
+				"QUEUEID: accept reason=override header=X-Trust-Override",
+				"QUEUEID: stripped override header field X-Trust-Override count=1",
+			},
+		},
+		{
+			name: "trusted reject overrides pass",
+			script: `
+connect relay.club1.fr 4 40000 192.0.2.1
+expect continue
+macros mail i=QUEUEID
+mail <coucou@gmail.com>
+expect continue
+header Authentication-Results: mail.club1.fr; dmarc=pass header.from=gmail.com
+header x-trust-override: Reject
+eoh
+expect reply 550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy
+`,
+			output: []string{"QUEUEID: reject reason=override header=X-Trust-Override"},
+		},
+		{
+			name: "untrusted is ignored and stripped",
+			script: `
+connect mail.example.com 4 40000 203.0.113.9
+expect continue
+macros mail i=QUEUEID
+mail <coucou@gmail.com>
+expect continue
+header Authentication-Results: mail.club1.fr; dmarc=pass header.from=gmail.com
+header X-Trust-Override: reject
+eoh
+expect continue
+eom
+modify change-header 1 X-Trust-Override:
+expect accept
+`,
+			output: []string{
+				"QUEUEID: ignoring header field X-Trust-Override from untrusted client_ip=203.0.113.9",
+				"QUEUEID: accept dmarc=pass from=gmail.com",
+			},
+		},
+		{
+			name: "invalid value",
+			script: `
+connect relay.club1.fr 4 40000 192.0.2.1
+expect continue
+macros mail i=QUEUEID
+mail <coucou@gmail.com>
+expect continue
+header Authentication-Results: mail.club1.fr; dmarc=fail header.from=gmail.com
+header X-Trust-Override: quarantine
+eoh
+expect reply 550 5.7.1 rejected because of DMARC failure for gmail.com overriding policy
+`,
+			output: []string{`QUEUEID: ignoring invalid value of header field X-Trust-Override: "quarantine"`},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+OverrideHeader = "X-Trust-Override"
+TrustedRelays = ["192.0.2.1"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+			session := miltertest.Session(t, network, address)
+			miltertest.Replay(t, session, c.script)
+			for _, expected := range c.output {
+				if !waitForLog(out, expected) {
+					t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+
+	_, log := runMain(t, "AuthservID = \"mail.club1.fr\"\nOverrideHeader = \"X-Trust-Override\"\n", "--dump-config")
+	warning := "Warning: OverrideHeader is never honored without TrustedNetworks nor TrustedRelays"
+	if !strings.Contains(log, warning) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", warning, log)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+LogLevel = "debug"
+RejectDomains = ["gmail.com"]
+`
+	t.Run("header sample", func(t *testing.T) {
+		value := "mail.club1.fr; dmarc " + strings.Repeat("x", 300)
+		sample := ("Authentication-Results: " + value)[:200] + "..."
+		headers := []string{"Authentication-Results", value}
+		testHeaders(t, config, headers, &milter.Action{Code: milter.ActAccept},
+			"QUEUEID: failed to parse header Authentication-Results: ",
+			fmt.Sprintf("QUEUEID: unparsable header sample: %q\n", sample),
+		)
+	})
+
+	t.Run("summary on SIGUSR2", func(t *testing.T) {
+		_, _, out := setup(t, config)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+		expected := fmt.Sprintf("Parse errors since startup: %d", metricParseErrors.Value())
+		if !waitForLog(out, expected) {
+			t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+		}
+	})
+}
+
+func TestCountersSummary(t *testing.T) {
+	config := `ListenURI = "tcp://127.0.0.1:"`
+	_, _, out := setup(t, config)
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	expected := "Counters since startup: " + countersSummary()
+	if !waitForLog(out, expected) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+}
+
+func TestTopRejectedDomains(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com", "example.com"]
+TopRejectedDomains = 1
+`
+	network, address, out := setup(t, config)
+	for _, domain := range []string{"example.com", "gmail.com", "example.com"} {
+		session := miltertest.Session(t, network, address)
+		miltertest.Headers(t, session, []string{"i", "QUEUEID"},
+			"Authentication-Results", "mail.club1.fr; dmarc=fail header.from="+domain)
+	}
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	expected := "Top rejected domains since startup: example.com=2\n"
+	if !waitForLog(out, expected) {
+		t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+	}
+}
+
+func TestLogSubject(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+LogSubject = true
+LogSubjectLength = 20
+`
+	reject := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	headers := []string{
+		"Subject", "Hello\r\nQUEUEID: accept dmarc=pass from=gmail.com",
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+	}
+	testHeaders(t, config, headers, reject, ` subject="Hello  QUEUEID: acce..." dur=`)
+}
+
+func TestLogAccepts(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   string
+		accepts  int
+		expected string
+	}{
+		{name: "all", accepts: 3},
+		{name: "sampled", config: "LogAccepts = \"sampled\"\nLogAcceptsRate = 2", accepts: 2},
+		{name: "none", config: "LogAccepts = \"none\"", accepts: 0},
+		{
+			name:     "summary",
+			config:   "LogAccepts = \"summary\"\nLogAcceptsInterval = \"5ms\"",
+			accepts:  0,
+			expected: "Accepted 3 messages since the previous summary\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+` + c.config
+			network, address, out := setup(t, config)
+			for _, domain := range []string{"example.com", "example.com", "example.com", "gmail.com"} {
+				session := miltertest.Session(t, network, address)
+				miltertest.Headers(t, session, []string{"i", "QUEUEID"},
+					"Authentication-Results", "mail.club1.fr; dmarc=fail header.from="+domain)
+			}
+			// Rejects are always logged, and the last one is logged after
+			// all the accepts.
+			if expected := "QUEUEID: reject dmarc=fail from=gmail.com"; !waitForLog(out, expected) {
+				t.Fatalf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+			}
+			if accepts := strings.Count(out.String(), "QUEUEID: accept "); accepts != c.accepts {
+				t.Errorf("expected %d accepts logged, got %d:\n%s", c.accepts, accepts, out.String())
+			}
+			if c.expected != "" && !waitForLog(out, c.expected) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+		})
+	}
+}
+
+// waitForLog waits a bit for the log output to contain expected, as it is
+// written asynchronously, and reports whether it did.
+func waitForLog(out *bytes.Buffer, expected string) bool {
+	for i := 0; i < 50; i++ {
+		if strings.Contains(out.String(), expected) {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestCheckChroot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0664); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		dir      string
+		expected string
+	}{
+		{dir, ""},
+		{"var/empty", `"var/empty" is not an absolute path`},
+		{filepath.Join(dir, "missing"), "no such file or directory"},
+		{file, fmt.Sprintf("%q is not a directory", file)},
+	}
+	for _, c := range cases {
+		err := checkChroot(c.dir)
+		if c.expected == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", c.dir, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%q: expected error containing %q, got %v", c.dir, c.expected, err)
+		}
 	}
 }
@@ -0,0 +1,279 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// Counters published with expvar. They are safe for concurrent use.
+var (
+	metricAccepted          = expvar.NewInt("messages_accepted")
+	metricInternalErrors    = expvar.NewInt("internal_errors")
+	metricMissingAuthres    = expvar.NewInt("missing_authres")
+	metricAuthenticated     = expvar.NewInt("messages_authenticated")
+	metricDeferred          = expvar.NewInt("messages_deferred")
+	metricQuarantined       = expvar.NewInt("messages_quarantined")
+	metricRejected          = expvar.NewInt("messages_rejected")
+	metricTagged            = expvar.NewInt("messages_tagged")
+	metricTrustedSubmitters = expvar.NewInt("messages_trusted_submitters")
+	metricNormalizedDomains = expvar.NewInt("normalized_domains")
+	metricParseErrors       = expvar.NewInt("parse_errors")
+	metricProbes            = expvar.NewInt("probes_total")
+	metricSessions          = expvar.NewInt("sessions_total")
+
+	metricDecisionDuration = expvar.NewMap("decision_duration_ms")
+
+	// metricMessages counts the messages by action and DMARC result, with
+	// keys of the form "action,dmarc". It is only exposed at /metrics.
+	metricMessages = new(expvar.Map).Init()
+
+	// metricReasons counts the decisions by reason.
+	metricReasons = expvar.NewMap("messages_by_reason")
+)
+
+// countMessage records a message in metricMessages, given the value of its
+// DMARC result, if any, and in metricReasons.
+func countMessage(action Action, value authres.ResultValue, reason Reason) {
+	metricReasons.Add(string(reason), 1)
+	var result string
+	switch value {
+	case "":
+		result = "unknown"
+	case authres.ResultNone, authres.ResultPass, authres.ResultFail, authres.ResultTempError, authres.ResultPermError:
+		result = string(value)
+	default:
+		// Avoids unbounded label values from malformed header fields.
+		result = "other"
+	}
+	metricMessages.Add(action.String()+","+result, 1)
+}
+
+func init() {
+	expvar.Publish("dmarcator_build_info", expvar.Func(buildInfo))
+	expvar.Publish("top_rejected_domains", expvar.Func(func() any {
+		confMu.RLock()
+		defer confMu.RUnlock()
+		return rejectedDomains.top(conf.TopRejectedDomains)
+	}))
+}
+
+// buildInfo returns the details of the build published with expvar.
+func buildInfo() any {
+	return map[string]string{
+		"version": version,
+		"commit":  commit,
+		"date":    date,
+		"go":      runtime.Version(),
+	}
+}
+
+// countersSummary returns the values of the message counters, formatted on a
+// single line to be logged.
+func countersSummary() string {
+	return fmt.Sprintf("accepted=%d authenticated=%d trusted_submitters=%d deferred=%d quarantined=%d rejected=%d tagged=%d parse_errors=%d probes=%d internal_errors=%d missing_authres=%d",
+		metricAccepted.Value(), metricAuthenticated.Value(), metricTrustedSubmitters.Value(), metricDeferred.Value(), metricQuarantined.Value(),
+		metricRejected.Value(), metricTagged.Value(), metricParseErrors.Value(), metricProbes.Value(), metricInternalErrors.Value(), metricMissingAuthres.Value())
+}
+
+// rejectedDomainsFactor is the number of domains tracked in rejectedDomains
+// for each one reported, so that the counts of the reported ones are
+// accurate even when there are many rejected domains.
+const rejectedDomainsFactor = 10
+
+// rejectedDomains counts the rejected messages by domain, when
+// TopRejectedDomains is set.
+var rejectedDomains domainCounter
+
+// domainCounter counts the occurrences of domains, keeping at most a fixed
+// number of them. When it is full, the least frequent domain is replaced by
+// the new one, which inherits its count, like in the Space-Saving algorithm,
+// so that the most frequent domains are kept, with an overestimated count. It
+// is safe for concurrent use.
+type domainCounter struct {
+	mu     sync.Mutex
+	size   int
+	counts map[string]int64
+}
+
+// domainCount is the count of a domain, as exposed by domainCounter.top.
+type domainCount struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+}
+
+// reset clears the counts and sets the number of domains to keep. A size of
+// 0 disables the counter.
+func (c *domainCounter) reset(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.counts = make(map[string]int64)
+}
+
+// add records an occurrence of domain.
+func (c *domainCounter) add(domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if _, ok := c.counts[domain]; !ok && len(c.counts) >= c.size {
+		minDomain, minCount := "", int64(-1)
+		for d, n := range c.counts {
+			if minCount < 0 || n < minCount || n == minCount && d < minDomain {
+				minDomain, minCount = d, n
+			}
+		}
+		delete(c.counts, minDomain)
+		c.counts[domain] = minCount
+	}
+	c.counts[domain]++
+}
+
+// top returns at most n domains with the highest counts, by decreasing
+// count.
+func (c *domainCounter) top(n int) []domainCount {
+	if n <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	counts := make([]domainCount, 0, len(c.counts))
+	for domain, count := range c.counts {
+		counts = append(counts, domainCount{domain, count})
+	}
+	c.mu.Unlock()
+	sortDomainCounts(counts)
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// sortDomainCounts sorts counts by decreasing count, then by domain.
+func sortDomainCounts(counts []domainCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Domain < counts[j].Domain
+	})
+}
+
+// topRejectedSummary returns the top rejected domains with their counts,
+// formatted on a single line to be logged.
+func topRejectedSummary() string {
+	var b strings.Builder
+	for i, dc := range rejectedDomains.top(conf.TopRejectedDomains) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%d", dc.Domain, dc.Count)
+	}
+	return b.String()
+}
+
+// Upper bounds in milliseconds of the buckets of the decision duration
+// histogram. Like Prometheus histograms, the buckets are cumulative.
+var decisionDurationBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+
+// observeDecisionDuration records the duration of a session, from MAIL FROM
+// to the decision, in the decision_duration_ms histogram.
+func observeDecisionDuration(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	for _, bound := range decisionDurationBuckets {
+		if ms <= bound {
+			metricDecisionDuration.Add("le_"+strconv.FormatFloat(bound, 'f', -1, 64), 1)
+		}
+	}
+	metricDecisionDuration.Add("le_+Inf", 1)
+	metricDecisionDuration.Add("count", 1)
+	metricDecisionDuration.AddFloat("sum", ms)
+}
+
+// newMetricsServer returns an HTTP server exposing the expvar variables at
+// /debug/vars if expvarVars is set, the OpenMetrics text exposition at
+// /metrics if openMetrics is set, and a health check endpoint at /healthz.
+func newMetricsServer(expvarVars, openMetrics bool) *http.Server {
+	mux := http.NewServeMux()
+	if expvarVars {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+	if openMetrics {
+		mux.HandleFunc("/metrics", serveOpenMetrics)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	return &http.Server{Handler: mux}
+}
+
+// serveOpenMetrics writes the counters in the OpenMetrics text format.
+func serveOpenMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	var b strings.Builder
+	b.WriteString("# TYPE dmarcator_messages counter\n")
+	b.WriteString("# HELP dmarcator_messages Messages by action and DMARC result.\n")
+	metricMessages.Do(func(kv expvar.KeyValue) {
+		action, result, _ := strings.Cut(kv.Key, ",")
+		fmt.Fprintf(&b, "dmarcator_messages_total{action=%q,dmarc=%q} %s\n", action, result, kv.Value)
+	})
+	b.WriteString("# TYPE dmarcator_messages_by_reason counter\n")
+	b.WriteString("# HELP dmarcator_messages_by_reason Messages by reason of their decision.\n")
+	metricReasons.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(&b, "dmarcator_messages_by_reason_total{reason=%q} %s\n", kv.Key, kv.Value)
+	})
+	b.WriteString("# TYPE dmarcator_parse_errors counter\n")
+	b.WriteString("# HELP dmarcator_parse_errors Authentication-Results header fields that failed to parse.\n")
+	fmt.Fprintf(&b, "dmarcator_parse_errors_total %d\n", metricParseErrors.Value())
+	b.WriteString("# TYPE dmarcator_probes counter\n")
+	b.WriteString("# HELP dmarcator_probes Connections closed without any message, like health probes.\n")
+	fmt.Fprintf(&b, "dmarcator_probes_total %d\n", metricProbes.Value())
+	b.WriteString("# TYPE dmarcator_missing_authres counter\n")
+	b.WriteString("# HELP dmarcator_missing_authres Messages with a From header field but without trusted Authentication-Results.\n")
+	fmt.Fprintf(&b, "dmarcator_missing_authres_total %d\n", metricMissingAuthres.Value())
+	b.WriteString("# TYPE dmarcator_internal_errors counter\n")
+	b.WriteString("# HELP dmarcator_internal_errors Decisions replaced by InternalErrorAction after an internal error.\n")
+	fmt.Fprintf(&b, "dmarcator_internal_errors_total %d\n", metricInternalErrors.Value())
+	b.WriteString("# TYPE dmarcator_config_last_reload_successful gauge\n")
+	b.WriteString("# HELP dmarcator_config_last_reload_successful Whether the last reload of the config succeeded.\n")
+	fmt.Fprintf(&b, "dmarcator_config_last_reload_successful %d\n", metricReloadSuccessful.Value())
+	b.WriteString("# TYPE dmarcator_config_last_reload_success_timestamp_seconds gauge\n")
+	b.WriteString("# HELP dmarcator_config_last_reload_success_timestamp_seconds Time of the last successful reload of the config, or of the startup.\n")
+	fmt.Fprintf(&b, "dmarcator_config_last_reload_success_timestamp_seconds %d\n", metricReloadSuccessAt.Value())
+	b.WriteString("# EOF\n")
+	w.Write([]byte(b.String()))
+}
+
+// serveMetrics serves the metrics server on ln until it is closed.
+func serveMetrics(srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		l.Fatal("Failed to serve metrics: ", err)
+	}
+}
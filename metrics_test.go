@@ -0,0 +1,225 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-milter"
+)
+
+func TestExpvar(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "expvar.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+ExpvarListenURI = "unix://` + sock + `"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	before := map[string]int64{
+		"messages_accepted": metricAccepted.Value(),
+		"messages_rejected": metricRejected.Value(),
+		"parse_errors":      metricParseErrors.Value(),
+		"sessions_total":    metricSessions.Value(),
+	}
+	headers := []string{
+		"Authentication-Results", "mail.club1.fr; dmarc header.from=gmail.com",
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com",
+	}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testHeaders(t, config, headers, expected)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://localhost/debug/vars")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	defer resp.Body.Close()
+	vars := make(map[string]any)
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal("unexpected error decoding vars: ", err)
+	}
+	expectedDelta := map[string]int64{
+		"messages_accepted": 0,
+		"messages_rejected": 1,
+		"parse_errors":      1,
+		"sessions_total":    1,
+	}
+	for name, delta := range expectedDelta {
+		v, ok := vars[name].(float64)
+		if !ok {
+			t.Errorf("expected var %s to be a number, got %#v", name, vars[name])
+			continue
+		}
+		if actual := int64(v) - before[name]; actual != delta {
+			t.Errorf("expected %s to increase by %d, got %d", name, delta, actual)
+		}
+	}
+	expectedInfo := map[string]any{
+		"version": version,
+		"commit":  commit,
+		"date":    date,
+		"go":      runtime.Version(),
+	}
+	if info := vars["dmarcator_build_info"]; !reflect.DeepEqual(expectedInfo, info) {
+		t.Errorf("expected build info %#v, got %#v", expectedInfo, info)
+	}
+}
+
+func TestObserveDecisionDuration(t *testing.T) {
+	get := func(key string) int64 {
+		if v, ok := metricDecisionDuration.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	keys := []string{"le_1", "le_5", "le_10", "le_5000", "le_+Inf", "count"}
+	before := make(map[string]int64)
+	for _, key := range keys {
+		before[key] = get(key)
+	}
+	observeDecisionDuration(7 * time.Millisecond)
+	expectedDelta := map[string]int64{
+		"le_1":    0,
+		"le_5":    0,
+		"le_10":   1,
+		"le_5000": 1,
+		"le_+Inf": 1,
+		"count":   1,
+	}
+	for key, delta := range expectedDelta {
+		if actual := get(key) - before[key]; actual != delta {
+			t.Errorf("expected %s to increase by %d, got %d", key, delta, actual)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	srv := httptest.NewServer(newMetricsServer(true, false).Handler)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "metrics.sock")
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+MetricsListenURI = "unix://` + sock + `"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	headers := []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}
+	expected := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	testHeaders(t, config, headers, expected)
+	countMessage(ActionAccept, "bogus", ReasonUnknown)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	for _, e := range []string{
+		"# TYPE dmarcator_messages counter\n",
+		`dmarcator_messages_total{action="reject",dmarc="fail"} `,
+		`dmarcator_messages_total{action="accept",dmarc="other"} `,
+		`dmarcator_messages_by_reason_total{reason="domain-action"} `,
+		"# TYPE dmarcator_parse_errors counter\n",
+		"dmarcator_parse_errors_total ",
+	} {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("expected body contains:\n%s\nactual:\n%s", e, body)
+		}
+	}
+	if !strings.HasSuffix(string(body), "\n# EOF\n") {
+		t.Errorf("expected body to end with # EOF, got:\n%s", body)
+	}
+
+	resp, err = client.Get("http://localhost/debug/vars")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected expvar not to be served, got status %d", resp.StatusCode)
+	}
+}
+
+func TestDomainCounter(t *testing.T) {
+	var c domainCounter
+	c.add("ignored.com")
+	if top := c.top(1); len(top) != 0 {
+		t.Errorf("expected disabled counter to be empty, got %v", top)
+	}
+
+	c.reset(3)
+	for _, domain := range []string{"gmail.com", "a.com", "gmail.com", "b.com", "gmail.com", "a.com", "c.com"} {
+		c.add(domain)
+	}
+	// "c.com" replaces "b.com", the least frequent domain, and inherits its
+	// count.
+	expected := []domainCount{{"gmail.com", 3}, {"a.com", 2}, {"c.com", 2}}
+	if top := c.top(5); !reflect.DeepEqual(expected, top) {
+		t.Errorf("expected %v, got %v", expected, top)
+	}
+	if top := c.top(1); !reflect.DeepEqual(expected[:1], top) {
+		t.Errorf("expected %v, got %v", expected[:1], top)
+	}
+}
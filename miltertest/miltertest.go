@@ -0,0 +1,97 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+// Package miltertest provides helpers to test a milter through the milter
+// protocol, like the integration tests of dmarcator do: a message is sent as
+// a list of header fields, and the action returned at the end of the header
+// is compared with the expected one.
+package miltertest
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-milter"
+)
+
+// Actions are the actions offered to the milter by Session, like an MTA
+// would. They are the ones of the version 2 of the milter protocol, which
+// the client can fall back to.
+const Actions = milter.OptAddHeader | milter.OptChangeBody | milter.OptAddRcpt | milter.OptRemoveRcpt |
+	milter.OptChangeHeader | milter.OptQuarantine
+
+// Session opens a new milter session with the milter listening on address,
+// with the given network. The client and the session are closed at the end of
+// the test.
+func Session(t testing.TB, network, address string) *milter.ClientSession {
+	t.Helper()
+	client := milter.NewClientWithOptions(network, address, milter.ClientOptions{
+		Dialer:     &net.Dialer{},
+		ActionMask: Actions,
+	})
+	t.Cleanup(func() { client.Close() })
+	session, err := client.Session()
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// Headers sends a dummy MAIL FROM, without authentication macro, then the
+// header stage macros and the header fields, given as name and value pairs,
+// and returns the action of the end of header. The MAIL FROM is expected to
+// be continued.
+func Headers(t testing.TB, session *milter.ClientSession, macros []string, headers ...string) *milter.Action {
+	t.Helper()
+	if len(headers)%2 != 0 {
+		panic("headers varargs must be pairs")
+	}
+	res, err := session.Mail("nicolas@example.fr", []string{})
+	if err != nil {
+		t.Fatal("unexpected err sending MAIL FROM: ", err)
+	}
+	if expected := (&milter.Action{Code: milter.ActContinue}); !reflect.DeepEqual(expected, res) {
+		t.Fatalf("expected %#v, got %#v", expected, res)
+	}
+
+	if err := session.Macros(milter.CodeHeader, macros...); err != nil {
+		t.Fatal("unexpected err setting macros: ", err)
+	}
+	for i := 0; i < len(headers); i += 2 {
+		_, err := session.HeaderField(headers[i], headers[i+1])
+		if err != nil {
+			t.Error("unexpected err sending header: ", err)
+		}
+	}
+	res, err = session.HeaderEnd()
+	if err != nil {
+		t.Error("unexpected err sending EOH: ", err)
+	}
+	return res
+}
+
+// AssertHeaders is like Headers, but it reports an error if the action of the
+// end of header is not expected.
+func AssertHeaders(t testing.TB, session *milter.ClientSession, expected *milter.Action, macros []string, headers ...string) {
+	t.Helper()
+	res := Headers(t, session, macros, headers...)
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %#v, got %#v", expected, res)
+	}
+}
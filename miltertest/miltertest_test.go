@@ -0,0 +1,135 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package miltertest
+
+import (
+	"net"
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-milter"
+)
+
+// rejecter rejects the messages that have a From header field.
+type rejecter struct {
+	milter.NoOpMilter
+}
+
+func (rejecter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	if h.Get("From") != "" {
+		return milter.RespReject, nil
+	}
+	return milter.RespAccept, nil
+}
+
+// serve starts a rejecter milter server and returns its address.
+func serve(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := milter.Server{
+		NewMilter: func() milter.Milter { return rejecter{} },
+		Protocol:  milter.OptNoHelo | milter.OptNoRcptTo | milter.OptNoBody,
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func TestHeaders(t *testing.T) {
+	address := serve(t)
+
+	cases := []struct {
+		name     string
+		headers  []string
+		expected *milter.Action
+	}{
+		{
+			name:     "accept",
+			headers:  []string{"Subject", "Coucou"},
+			expected: &milter.Action{Code: milter.ActAccept},
+		},
+		{
+			name:     "reject",
+			headers:  []string{"Subject", "Coucou", "From", "coucou@example.com"},
+			expected: &milter.Action{Code: milter.ActReject},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			session := Session(t, "tcp", address)
+			AssertHeaders(t, session, c.expected, []string{"i", "QUEUEID"}, c.headers...)
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	address := serve(t)
+	session := Session(t, "tcp", address)
+	Replay(t, session, `
+# The helo and rcpt commands are not sent, as the milter skips them.
+macros connect _="mail.example.com [192.0.2.1]"
+connect mail.example.com 4 25 192.0.2.1
+expect continue
+helo mail.example.com
+macros mail i=QUEUEID1
+mail <coucou@example.com> SIZE=1024
+expect continue
+rcpt <nicolas@club1.fr>
+header Subject: Coucou
+eoh
+expect accept
+macros mail i=QUEUEID2
+mail <coucou@example.com>
+expect continue
+header From: coucou@example.com
+eoh
+expect reject
+`)
+}
+
+func TestParseMacros(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"empty", "", nil},
+		{"simple", "i=QUEUEID {auth_authen}=nicolas", []string{"i", "QUEUEID", "{auth_authen}", "nicolas"}},
+		{"quoted", `_="mail.example.com [192.0.2.1]" j=mx`, []string{"_", "mail.example.com [192.0.2.1]", "j", "mx"}},
+		{"empty value", "i= j=mx", []string{"i", "", "j", "mx"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := parseMacros(c.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.expected, actual) {
+				t.Errorf("expected %q, got %q", c.expected, actual)
+			}
+		})
+	}
+	for _, input := range []string{"i", "=QUEUEID", `_="unterminated`} {
+		if _, err := parseMacros(input); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package miltertest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-milter"
+)
+
+// macroStages maps the stage names of the macros command of Replay to the
+// codes of the milter commands.
+var macroStages = map[string]milter.Code{
+	"connect": milter.CodeConn,
+	"helo":    milter.CodeHelo,
+	"mail":    milter.CodeMail,
+	"rcpt":    milter.CodeRcpt,
+	"data":    milter.CodeData,
+	"header":  milter.CodeHeader,
+	"eoh":     milter.CodeEOH,
+	"eom":     milter.CodeEOB,
+}
+
+// replayActions maps the action names of the expect command of Replay to
+// their codes.
+var replayActions = map[string]milter.ActionCode{
+	"accept":   milter.ActAccept,
+	"continue": milter.ActContinue,
+	"discard":  milter.ActDiscard,
+	"reject":   milter.ActReject,
+	"tempfail": milter.ActTempFail,
+}
+
+// Replay sends the milter commands of script to session in order, like an
+// MTA would, and reports an error for each action that differs from the
+// expected one. The script has one command per line, with its arguments
+// separated by spaces. The empty lines and the ones starting with "#" are
+// ignored. The commands are:
+//
+//	connect HOSTNAME FAMILY PORT ADDRESS
+//	helo NAME
+//	macros STAGE [NAME=VALUE]...
+//	mail SENDER [ARG]...
+//	rcpt RECIPIENT [ARG]...
+//	header NAME: VALUE
+//	eoh
+//	eom
+//	abort
+//	expect ACTION
+//	modify ACTION
+//
+// FAMILY is the letter of the protocol family: "4", "6", "L" or "U". STAGE
+// is the command before which the macros are sent: connect, helo, mail,
+// rcpt, data, header, eoh or eom, and a VALUE can be quoted like a Go string
+// to contain spaces. The addresses of mail and rcpt are given
+// in angle brackets, as in "<>". As with Postfix, the commands of the
+// protocol steps skipped by the milter are not sent.
+//
+// expect checks the action returned by the previous command, which is one
+// of accept, continue, discard, reject, tempfail, or "reply CODE TEXT" for a
+// custom SMTP reply. modify checks the next modification of the message
+// returned by the previous eom, one of "add-header NAME: VALUE",
+// "change-header INDEX NAME: VALUE", "insert-header INDEX NAME: VALUE" and
+// "quarantine REASON". All the modifications must be checked.
+func Replay(t testing.TB, session *milter.ClientSession, script string) {
+	t.Helper()
+	var (
+		act  *milter.Action
+		mods []milter.ModifyAction
+		// modLine is the line of the eom whose modifications are checked.
+		modLine int
+	)
+	checkMods := func() {
+		t.Helper()
+		if len(mods) > 0 {
+			t.Errorf("line %d: unexpected modifications %#v", modLine, mods)
+		}
+		mods = nil
+	}
+	for i, line := range strings.Split(script, "\n") {
+		n := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, args, _ := strings.Cut(line, " ")
+		if cmd != "modify" {
+			checkMods()
+		}
+		var err error
+		switch cmd {
+		case "connect":
+			fields := strings.Fields(args)
+			if len(fields) != 4 || len(fields[1]) != 1 {
+				t.Fatalf("line %d: invalid connect %q", n, args)
+			}
+			port, perr := strconv.ParseUint(fields[2], 10, 16)
+			if perr != nil {
+				t.Fatalf("line %d: invalid port %q", n, fields[2])
+			}
+			act, err = session.Conn(fields[0], milter.ProtoFamily(fields[1][0]), uint16(port), fields[3])
+		case "helo":
+			act, err = session.Helo(args)
+		case "macros":
+			stage, macros, _ := strings.Cut(args, " ")
+			code, ok := macroStages[stage]
+			if !ok {
+				t.Fatalf("line %d: unknown macro stage %q", n, stage)
+			}
+			kv, perr := parseMacros(macros)
+			if perr != nil {
+				t.Fatalf("line %d: %v", n, perr)
+			}
+			err = session.Macros(code, kv...)
+		case "mail", "rcpt":
+			fields := strings.Fields(args)
+			addr := strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+			if cmd == "mail" {
+				act, err = session.Mail(addr, fields[1:])
+			} else {
+				act, err = session.Rcpt(addr, fields[1:])
+			}
+		case "header":
+			name, value, found := strings.Cut(args, ":")
+			if !found {
+				t.Fatalf("line %d: invalid header field %q", n, args)
+			}
+			act, err = session.HeaderField(name, strings.TrimLeft(value, " \t"))
+		case "eoh":
+			act, err = session.HeaderEnd()
+		case "eom":
+			mods, act, err = session.End()
+			modLine = n
+		case "abort":
+			err = session.Abort()
+		case "expect":
+			expected, perr := parseAction(args)
+			if perr != nil {
+				t.Fatalf("line %d: %v", n, perr)
+			}
+			if !reflect.DeepEqual(expected, act) {
+				t.Errorf("line %d: expected %#v, got %#v", n, expected, act)
+			}
+		case "modify":
+			expected, perr := parseModifyAction(args)
+			if perr != nil {
+				t.Fatalf("line %d: %v", n, perr)
+			}
+			if len(mods) == 0 {
+				t.Errorf("line %d: expected %#v, got no modification", n, expected)
+				continue
+			}
+			if !reflect.DeepEqual(*expected, mods[0]) {
+				t.Errorf("line %d: expected %#v, got %#v", n, *expected, mods[0])
+			}
+			mods = mods[1:]
+		default:
+			t.Fatalf("line %d: unknown command %q", n, cmd)
+		}
+		if err != nil {
+			t.Fatalf("line %d: unexpected error: %v", n, err)
+		}
+	}
+	checkMods()
+}
+
+// parseMacros parses the NAME=VALUE pairs of a macros command into a list of
+// names and values. A value can be quoted like a Go string, to contain
+// spaces.
+func parseMacros(s string) ([]string, error) {
+	var kv []string
+	for s = strings.TrimLeft(s, " "); s != ""; s = strings.TrimLeft(s, " ") {
+		name, rest, found := strings.Cut(s, "=")
+		if !found || name == "" || strings.Contains(name, " ") {
+			return nil, fmt.Errorf("invalid macro %q", s)
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of macro %s: %w", name, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		kv = append(kv, name, value)
+		s = rest
+	}
+	return kv, nil
+}
+
+// parseAction parses the action of an expect command.
+func parseAction(s string) (*milter.Action, error) {
+	if strings.HasPrefix(s, "reply ") {
+		code, text, _ := strings.Cut(strings.TrimPrefix(s, "reply "), " ")
+		smtpCode, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply code %q", code)
+		}
+		return &milter.Action{Code: milter.ActReplyCode, SMTPCode: smtpCode, SMTPText: text}, nil
+	}
+	code, ok := replayActions[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", s)
+	}
+	return &milter.Action{Code: code}, nil
+}
+
+// parseModifyAction parses the modification of a modify command.
+func parseModifyAction(s string) (*milter.ModifyAction, error) {
+	kind, rest, _ := strings.Cut(s, " ")
+	if kind == "quarantine" {
+		return &milter.ModifyAction{Code: milter.ActQuarantine, Reason: rest}, nil
+	}
+	var act milter.ModifyAction
+	switch kind {
+	case "add-header":
+		act.Code = milter.ActAddHeader
+	case "change-header", "insert-header":
+		act.Code = milter.ActChangeHeader
+		if kind == "insert-header" {
+			act.Code = milter.ActInsertHeader
+		}
+		index, field, _ := strings.Cut(rest, " ")
+		i, err := strconv.ParseUint(index, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header index %q", index)
+		}
+		act.HeaderIndex = uint32(i)
+		rest = field
+	default:
+		return nil, fmt.Errorf("unknown modification %q", kind)
+	}
+	name, value, found := strings.Cut(rest, ":")
+	if !found {
+		return nil, fmt.Errorf("invalid header field %q", rest)
+	}
+	act.HeaderName = name
+	act.HeaderValue = strings.TrimLeft(value, " \t")
+	return &act, nil
+}
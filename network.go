@@ -0,0 +1,92 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ipNets is a list of IP networks.
+type ipNets []*net.IPNet
+
+// parseIPNets parses a list of IP addresses or CIDR networks, like
+// "192.0.2.1" or "2001:db8::/32".
+func parseIPNets(entries []string) (ipNets, error) {
+	nets := make(ipNets, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// contains reports whether ip is in one of the networks.
+func (nets ipNets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// receivedFromRegexp matches the "from" clause of a Received header field,
+// which ends at the "by" clause, if any.
+var receivedFromRegexp = regexp.MustCompile(`(?is)^\s*from\s(.*?)(?:\sby\s|$)`)
+
+// receivedIPRegexp matches the IP address between brackets of the "from"
+// clause of a Received header field, as in
+// "from mx.example.com (mx.example.com [192.0.2.1])" or "[IPv6:2001:db8::1]".
+var receivedIPRegexp = regexp.MustCompile(`\[(?i:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// receivedFromIP returns the IP address of the host the message was received
+// from, according to the value of a Received header field, or nil if it has
+// none.
+func receivedFromIP(value string) net.IP {
+	from := receivedFromRegexp.FindStringSubmatch(value)
+	if from == nil {
+		return nil
+	}
+	m := receivedIPRegexp.FindStringSubmatch(from[1])
+	if m == nil {
+		return nil
+	}
+	return net.ParseIP(m[1])
+}
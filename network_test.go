@@ -0,0 +1,346 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/club-1/dmarcator/miltertest"
+	"github.com/emersion/go-milter"
+)
+
+func TestParseIPNets(t *testing.T) {
+	nets, err := parseIPNets([]string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	cases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.42", true},
+		{"::ffff:198.51.100.42", true},
+		{"2001:db8:1::25", true},
+		{"2001:db9::25", false},
+		{"::1", true},
+	}
+	for _, c := range cases {
+		if actual := nets.contains(net.ParseIP(c.ip)); actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.ip, c.expected, actual)
+		}
+	}
+	if nets.contains(nil) {
+		t.Error("expected nil IP not to be contained")
+	}
+	for _, entry := range []string{"192.0.2.300", "example.com", "198.51.100.0/33", ""} {
+		if _, err := parseIPNets([]string{entry}); err == nil {
+			t.Errorf("%q: expected error", entry)
+		}
+	}
+}
+
+func TestReceivedFromIP(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"from mx.example.com (mx.example.com [192.0.2.1]) by mail.club1.fr (Postfix) with ESMTPS id 67A7541757", "192.0.2.1"},
+		{"from relay.example.com (relay.example.com [IPv6:2001:db8::1])\r\n\tby mail.club1.fr (Postfix) with ESMTP", "2001:db8::1"},
+		{"FROM [198.51.100.7] BY mail.club1.fr", "198.51.100.7"},
+		{"by mail.club1.fr (Postfix, from userid 1000) id 67A7541757", ""},
+		{"from localhost by mail.club1.fr (Postfix) with ESMTP [192.0.2.1]", ""},
+		{"from mx.example.com (unknown) by mail.club1.fr", ""},
+	}
+	for _, c := range cases {
+		actual := receivedFromIP(c.value)
+		if (c.expected == "" && actual != nil) || (c.expected != "" && !actual.Equal(net.ParseIP(c.expected))) {
+			t.Errorf("%q: expected %q, got %v", c.value, c.expected, actual)
+		}
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	rejectAct := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+	}
+	cases := []struct {
+		name     string
+		clientIP string
+		// macro sends the client IP with the {client_addr} macro instead
+		// of the Connect stage.
+		macro    bool
+		received []string
+		action   *milter.Action
+		expected string
+	}{
+		{
+			name:     "trusted client",
+			clientIP: "192.0.2.25",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "accept reason=trusted-network client_ip=192.0.2.25 origin_ip=192.0.2.25",
+		},
+		{
+			name:     "trusted client macro",
+			clientIP: "192.0.2.25",
+			macro:    true,
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "accept reason=trusted-network client_ip=192.0.2.25 origin_ip=192.0.2.25",
+		},
+		{
+			name:     "untrusted client",
+			clientIP: "203.0.113.25",
+			action:   rejectAct,
+			expected: `reject dmarc=fail from=gmail.com addr="" header_from_domain= client_ip=203.0.113.25 dur=`,
+		},
+		{
+			name:     "untrusted IPv6 client",
+			clientIP: "2001:0DB9:0:0::25",
+			action:   rejectAct,
+			expected: " client_ip=2001:db9::25 dur=",
+		},
+		{
+			name:     "trusted origin through relay",
+			clientIP: "198.51.100.1",
+			received: []string{
+				"from relay.club1.fr (relay.club1.fr [198.51.100.1]) by mail.club1.fr (Postfix)",
+				"from internal.club1.fr (internal.club1.fr [IPv6:2001:db8::25]) by relay.club1.fr (Postfix)",
+				"from mx.example.com (mx.example.com [203.0.113.25]) by internal.club1.fr (Postfix)",
+			},
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: "accept reason=trusted-network client_ip=198.51.100.1 origin_ip=2001:db8::25",
+		},
+		{
+			name:     "untrusted origin through relay",
+			clientIP: "198.51.100.1",
+			received: []string{
+				"from mx.example.com (mx.example.com [203.0.113.25]) by relay.club1.fr (Postfix)",
+				"from internal.club1.fr (internal.club1.fr [192.0.2.25]) by mx.example.com (Postfix)",
+			},
+			action: rejectAct,
+		},
+		{
+			name:     "forwarded origin of untrusted client",
+			clientIP: "203.0.113.25",
+			received: []string{
+				"from internal.club1.fr (internal.club1.fr [192.0.2.25]) by mx.example.com (Postfix)",
+			},
+			action: rejectAct,
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+TrustedNetworks = ["192.0.2.0/24", "2001:db8::/32"]
+TrustedRelays = ["198.51.100.1"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+
+			session := miltertest.Session(t, network, address)
+
+			family := milter.FamilyInet
+			if strings.Contains(c.clientIP, ":") {
+				family = milter.FamilyInet6
+			}
+			if c.macro {
+				if err := session.Macros(milter.CodeMail, "{client_addr}", c.clientIP); err != nil {
+					t.Fatal("unexpected err setting macros: ", err)
+				}
+			} else if _, err := session.Conn("mx.example.com", family, 25, c.clientIP); err != nil {
+				t.Fatal("unexpected err sending CONNECT: ", err)
+			}
+			if _, err := session.Mail("coucou@gmail.com", []string{}); err != nil {
+				t.Fatal("unexpected err sending MAIL FROM: ", err)
+			}
+			if err := session.Macros(milter.CodeHeader, "i", "QUEUEID"); err != nil {
+				t.Fatal("unexpected err setting macros: ", err)
+			}
+			for _, value := range c.received {
+				if _, err := session.HeaderField("Received", value); err != nil {
+					t.Error("unexpected err sending header: ", err)
+				}
+			}
+			if _, err := session.HeaderField("Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"); err != nil {
+				t.Error("unexpected err sending header: ", err)
+			}
+			res, err := session.HeaderEnd()
+			if err != nil {
+				t.Error("unexpected err sending EOH: ", err)
+			}
+			if !reflect.DeepEqual(c.action, res) {
+				t.Errorf("expected %#v, got %#v", c.action, res)
+			}
+			if !strings.Contains(out.String(), c.expected) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestTrustedNetworksConnection(t *testing.T) {
+	cases := []struct {
+		name string
+		// macro sends the client IP with the {client_addr} macro of the
+		// first message instead of the Connect stage.
+		macro bool
+		// mailMacros sends the queue ID with the MAIL FROM stage macros,
+		// instead of the header ones.
+		mailMacros bool
+	}{
+		{name: "connect"},
+		{name: "connect mail macros", mailMacros: true},
+		{name: "macro", macro: true},
+		{name: "macro mail macros", macro: true, mailMacros: true},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+TrustedNetworks = ["192.0.2.0/24"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+
+			session := miltertest.Session(t, network, address)
+			if c.macro {
+				if err := session.Macros(milter.CodeMail, "{client_addr}", "192.0.2.25", "i", "QUEUEID1"); err != nil {
+					t.Fatal("unexpected err setting macros: ", err)
+				}
+			} else if _, err := session.Conn("mx.example.com", milter.FamilyInet, 25, "192.0.2.25"); err != nil {
+				t.Fatal("unexpected err sending CONNECT: ", err)
+			}
+			// The server renews its session for each message, but the
+			// client address must still be known by the following ones.
+			for i := 1; i <= 2; i++ {
+				queueID := fmt.Sprintf("QUEUEID%d", i)
+				if c.mailMacros && (i > 1 || !c.macro) {
+					if err := session.Macros(milter.CodeMail, "i", queueID); err != nil {
+						t.Fatal("unexpected err setting macros: ", err)
+					}
+				}
+				if _, err := session.Mail("coucou@gmail.com", []string{}); err != nil {
+					t.Fatal("unexpected err sending MAIL FROM: ", err)
+				}
+				if err := session.Macros(milter.CodeHeader, "i", queueID); err != nil {
+					t.Fatal("unexpected err setting macros: ", err)
+				}
+				if _, err := session.HeaderField("Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"); err != nil {
+					t.Error("unexpected err sending header: ", err)
+				}
+				res, err := session.HeaderEnd()
+				if err != nil {
+					t.Error("unexpected err sending EOH: ", err)
+				}
+				expectedAct := &milter.Action{Code: milter.ActAccept}
+				if !reflect.DeepEqual(expectedAct, res) {
+					t.Errorf("message %d: expected %#v, got %#v", i, expectedAct, res)
+				}
+			}
+			for i := 1; i <= 2; i++ {
+				expected := fmt.Sprintf("QUEUEID%d: accept reason=trusted-network client_ip=192.0.2.25 ", i)
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedSubmitters(t *testing.T) {
+	cases := []struct {
+		name     string
+		clientIP string
+		macro    bool
+		action   *milter.Action
+		expected string
+		trusted  int64
+	}{
+		{
+			name:     "trusted IPv4 submitter",
+			clientIP: "203.0.113.7",
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: `QUEUEID: accept reason=trusted-submitter client_ip=203.0.113.7 mail_from="coucou@gmail.com"`,
+			trusted:  1,
+		},
+		{
+			name:     "trusted IPv6 submitter macro",
+			clientIP: "2001:DB8:1::25",
+			macro:    true,
+			action:   &milter.Action{Code: milter.ActAccept},
+			expected: `QUEUEID: accept reason=trusted-submitter client_ip=2001:db8:1::25 mail_from="coucou@gmail.com"`,
+			trusted:  1,
+		},
+		{
+			name:     "untrusted client",
+			clientIP: "203.0.113.8",
+			action:   &milter.Action{Code: milter.ActContinue},
+		},
+	}
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+TrustedSubmitterIPs = ["203.0.113.7", "2001:db8:1::/48"]
+`
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+
+			session := miltertest.Session(t, network, address)
+
+			family := milter.FamilyInet
+			if strings.Contains(c.clientIP, ":") {
+				family = milter.FamilyInet6
+			}
+			macros := []string{"i", "QUEUEID"}
+			if c.macro {
+				macros = append(macros, "{client_addr}", c.clientIP)
+			} else if _, err := session.Conn("mx.example.com", family, 25, c.clientIP); err != nil {
+				t.Fatal("unexpected err sending CONNECT: ", err)
+			}
+			if err := session.Macros(milter.CodeMail, macros...); err != nil {
+				t.Fatal("unexpected err setting macros: ", err)
+			}
+			trusted := metricTrustedSubmitters.Value()
+			res, err := session.Mail("coucou@gmail.com", []string{})
+			if err != nil {
+				t.Fatal("unexpected err sending MAIL FROM: ", err)
+			}
+			if !reflect.DeepEqual(c.action, res) {
+				t.Errorf("expected %#v, got %#v", c.action, res)
+			}
+			if delta := metricTrustedSubmitters.Value() - trusted; delta != c.trusted {
+				t.Errorf("expected messages_trusted_submitters to increase by %d, got %d", c.trusted, delta)
+			}
+			if !strings.Contains(out.String(), c.expected) {
+				t.Errorf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"expvar"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// confMu protects the running config and the structures built from it, like
+// trustedNetworks, against a reload. The milter callbacks and the background
+// tasks that read them hold it for reading, so that they see either the
+// previous config or the new one, but never a mix of both.
+var confMu sync.RWMutex
+
+// confPaths are the paths of the config files read at startup, and
+// confMustExist whether they were explicitly given, in which case they cannot
+// be missing.
+var (
+	confPaths     []string
+	confMustExist bool
+)
+
+// reloadMu serializes the reloads, which can be requested by SIGHUP and by the
+// control API at the same time.
+var reloadMu sync.Mutex
+
+// restartOptions are the options that are only used at startup, like the
+// sockets to listen on. Their running value is kept on reload.
+var restartOptions = []string{
+	"AuditFile",
+	"Chroot",
+	"ControlListenURI",
+	"ExpvarListenURI",
+	"LearnFile",
+	"ListenBacklog",
+	"ListenURI",
+	"Listener",
+	"LogAccepts",
+	"LogAcceptsInterval",
+	"MaxConnections",
+	"MetricsListenURI",
+	"RejectDomainsFile",
+	"RejectDomainsRefresh",
+	"RejectDomainsURL",
+	"ReusePort",
+	"SessionTimeout",
+	"TopRejectedDomains",
+	"UMask",
+}
+
+// keepRestartOptions copies the running value of the restartOptions to next,
+// warning about the ones that changed. It must only be called by reloadConf,
+// which is the only writer of the config.
+func keepRestartOptions(next *Conf) {
+	running := reflect.ValueOf(&conf).Elem()
+	v := reflect.ValueOf(next).Elem()
+	for _, name := range restartOptions {
+		prev := running.FieldByName(name)
+		if f := v.FieldByName(name); !reflect.DeepEqual(f.Interface(), prev.Interface()) {
+			l.Printf("Warning: %s cannot be changed by a reload, restart dmarcator to apply it", name)
+			f.Set(prev)
+		}
+	}
+}
+
+// reloadConf reads and validates the config file again, and replaces the
+// running config with it. In case of error, the running config is left
+// untouched.
+func reloadConf() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if conf.Chroot != "" {
+		l.Printf("Warning: reloading inside of Chroot %q, the config files and the files of the options are read from there", conf.Chroot)
+	}
+	next, _, err := readConf(confPaths, confMustExist)
+	if err != nil {
+		return err
+	}
+	keepRestartOptions(&next)
+	prepared, err := prepareConf(next)
+	if err != nil {
+		return err
+	}
+	confMu.Lock()
+	prepared.apply()
+	confMu.Unlock()
+	return nil
+}
+
+// reloadStatus is the outcome of the last reload of the config, the startup
+// counting as the first one.
+type reloadStatus struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// lastReload holds the reloadStatus of the last reload.
+var lastReload atomic.Value
+
+// Gauges of the last reload, published with expvar.
+var (
+	metricReloadSuccessful = expvar.NewInt("config_last_reload_successful")
+	metricReloadSuccessAt  = expvar.NewInt("config_last_reload_success_timestamp_seconds")
+)
+
+// recordReload records the outcome of a reload, err being nil if it
+// succeeded.
+func recordReload(err error) reloadStatus {
+	status := reloadStatus{Status: "ok", Time: time.Now()}
+	if err != nil {
+		status.Status = "failed"
+		status.Error = err.Error()
+		metricReloadSuccessful.Set(0)
+	} else {
+		metricReloadSuccessful.Set(1)
+		metricReloadSuccessAt.Set(status.Time.Unix())
+	}
+	lastReload.Store(status)
+	return status
+}
+
+// reload reloads the config, logs and records its outcome.
+func reload() reloadStatus {
+	err := reloadConf()
+	if err != nil {
+		l.Printf("Failed to reload config, keeping the running one: %v", err)
+	} else {
+		l.Printf("Reloaded config from %s", strings.Join(confPaths, ", "))
+	}
+	return recordReload(err)
+}
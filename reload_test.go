@@ -0,0 +1,188 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/club-1/dmarcator/miltertest"
+	"github.com/emersion/go-milter"
+)
+
+// assertDomainAction sends a message failing DMARC for domain, and asserts
+// the action of the milter.
+func assertDomainAction(t *testing.T, network, address, domain string, expected *milter.Action) {
+	t.Helper()
+	session := miltertest.Session(t, network, address)
+	miltertest.AssertHeaders(t, session, expected, []string{"i", "QUEUEID"},
+		"Authentication-Results", "mail.club1.fr; dmarc=fail header.from="+domain,
+	)
+}
+
+// rewriteConf replaces the content of the config file given to main by setup.
+func rewriteConf(t *testing.T, config string) {
+	t.Helper()
+	if err := os.WriteFile(os.Args[2], []byte(config), 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+`
+	network, address, out := setup(t, config)
+	reject := &milter.Action{
+		Code:     milter.ActReplyCode,
+		SMTPCode: 550,
+		SMTPText: "5.7.1 rejected because of DMARC failure for hotmail.fr overriding policy",
+	}
+	accept := &milter.Action{Code: milter.ActAccept}
+	assertDomainAction(t, network, address, "hotmail.fr", accept)
+
+	rewriteConf(t, `
+ListenURI = "tcp://127.0.0.1:25"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["hotmail.fr"]
+`)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	for _, expected := range []string{
+		"Warning: ListenURI cannot be changed by a reload, restart dmarcator to apply it",
+		"Reloaded config from " + os.Args[2],
+	} {
+		if !waitForLog(out, expected) {
+			t.Fatalf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+		}
+	}
+	confMu.RLock()
+	listenURI := conf.ListenURI
+	confMu.RUnlock()
+	if listenURI != "tcp://127.0.0.1:" {
+		t.Errorf("expected ListenURI to be kept, got %q", listenURI)
+	}
+	assertDomainAction(t, network, address, "hotmail.fr", reject)
+	assertDomainAction(t, network, address, "gmail.com", accept)
+	if status := lastReload.Load().(reloadStatus); status.Status != "ok" {
+		t.Errorf("expected ok reload status, got %+v", status)
+	}
+	if v := metricReloadSuccessful.Value(); v != 1 {
+		t.Errorf("expected config_last_reload_successful 1, got %d", v)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+TrustedNetworks = ["192.0.2.0/24"]
+`
+	cases := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "syntax",
+			config:   config + `RejectDomains = [`,
+			expected: "Failed to reload config, keeping the running one: parse conf file ",
+		},
+		{
+			name: "derived structure",
+			config: `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["hotmail.fr"]
+TrustedNetworks = ["192.0.2.0/33"]
+`,
+			expected: "Failed to reload config, keeping the running one: invalid TrustedNetworks: invalid CIDR address: 192.0.2.0/33",
+		},
+		{
+			name: "strict problem",
+			config: `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+StrictConfig = true
+RejectDomains = ["hotmail.fr", "hotmail.fr"]
+`,
+			expected: `Failed to reload config, keeping the running one: duplicate domain "hotmail.fr" in RejectDomains`,
+		},
+		{
+			name: "template",
+			config: `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["hotmail.fr"]
+MaxReplyLength = 10
+`,
+			expected: "Failed to reload config, keeping the running one: invalid MaxReplyLength 10, must be at least ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			network, address, out := setup(t, config)
+			rewriteConf(t, c.config)
+			syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+			if !waitForLog(out, c.expected) {
+				t.Fatalf("expected contains:\n%s\nactual:\n%s", c.expected, out.String())
+			}
+			assertDomainAction(t, network, address, "gmail.com", &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for gmail.com overriding policy",
+			})
+			assertDomainAction(t, network, address, "hotmail.fr", &milter.Action{Code: milter.ActAccept})
+			if len(trustedNetworks) != 1 || len(conf.RejectDomains) != 1 {
+				t.Errorf("expected the running config to be kept, got TrustedNetworks %v and RejectDomains %v", trustedNetworks, conf.RejectDomains)
+			}
+			if status := lastReload.Load().(reloadStatus); status.Status != "failed" || status.Error == "" {
+				t.Errorf("expected failed reload status, got %+v", status)
+			}
+			if v := metricReloadSuccessful.Value(); v != 0 {
+				t.Errorf("expected config_last_reload_successful 0, got %d", v)
+			}
+		})
+	}
+}
+
+func TestReloadChroot(t *testing.T) {
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+`
+	_, _, out := setup(t, config)
+	// Chrooting needs privileges, so only the running value is set, as
+	// if dmarcator was started with it.
+	confMu.Lock()
+	conf.Chroot = "/var/empty"
+	confMu.Unlock()
+	rewriteConf(t, config+`Chroot = "/var/empty"`+"\n")
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	for _, expected := range []string{
+		`Warning: reloading inside of Chroot "/var/empty", the config files and the files of the options are read from there`,
+		"Reloaded config from " + os.Args[2],
+	} {
+		if !waitForLog(out, expected) {
+			t.Fatalf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/club-1/dmarcator/dmarc"
+)
+
+// maxRemoteListSize is the maximum size of a remote list of domains.
+const maxRemoteListSize = 16 << 20
+
+// remoteList is a list of domains fetched over HTTP. It keeps the caching
+// headers of the last response to avoid downloading it again if it did not
+// change.
+type remoteList struct {
+	url          string
+	client       *http.Client
+	etag         string
+	lastModified string
+	domains      []string
+}
+
+func newRemoteList(url string) *remoteList {
+	return &remoteList{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// fetch downloads the list of domains and reports whether it changed since
+// the last call. In case of error, the previous list is kept.
+func (r *remoteList) fetch(stripTrailingDot bool) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	// Read one more byte to tell a list at the limit from a larger one,
+	// that must not be silently truncated.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteListSize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > maxRemoteListSize {
+		return false, fmt.Errorf("list larger than %d bytes", maxRemoteListSize)
+	}
+	domains, err := parseDomainList(bytes.NewReader(body), stripTrailingDot)
+	if err != nil {
+		return false, err
+	}
+	r.domains = domains
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// parseDomainList parses a newline-delimited list of domains, where the text
+// after a "#" is a comment. The trailing dot of the domains is stripped if
+// stripTrailingDot is set. Invalid domains are an error.
+func parseDomainList(r io.Reader, stripTrailingDot bool) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		domain := strings.TrimSpace(line)
+		if domain == "" {
+			continue
+		}
+		if stripTrailingDot {
+			domain = dmarc.TrimTrailingDot(domain)
+		}
+		if err := dmarc.ValidateDomain(domain); err != nil {
+			return nil, fmt.Errorf("line %d: invalid domain %q: %v", n, domain, err)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, scanner.Err()
+}
+
+// refreshDomains fetches the remote list and replaces the current domains if
+// it changed.
+func refreshDomains(r *remoteList) {
+	confMu.RLock()
+	stripTrailingDot := conf.StripTrailingDot
+	confMu.RUnlock()
+	changed, err := r.fetch(stripTrailingDot)
+	if err != nil {
+		l.Printf("Failed to fetch RejectDomainsURL, keeping the previous list: %v", err)
+		return
+	}
+	if changed {
+		confMu.RLock()
+		domainLists.mu.Lock()
+		domainLists.remote = r.domains
+		storeDomainLists()
+		domainLists.mu.Unlock()
+		confMu.RUnlock()
+		l.Printf("Loaded %d domains from RejectDomainsURL", len(r.domains))
+	}
+}
+
+// refreshDomainsEvery refreshes the remote list at the given interval, until
+// done is closed.
+func refreshDomainsEvery(r *remoteList, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refreshDomains(r)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-milter"
+)
+
+func TestParseDomainList(t *testing.T) {
+	list := `# Blocklist
+gmail.com
+  hotmail.fr  # with a comment
+
+*.example.com
+`
+	domains, err := parseDomainList(strings.NewReader(list), false)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected := []string{"gmail.com", "hotmail.fr", "*.example.com"}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+
+	domains, err = parseDomainList(strings.NewReader("gmail.com.\n*.example.com.\n"), true)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected = []string{"gmail.com", "*.example.com"}
+	if !reflect.DeepEqual(expected, domains) {
+		t.Errorf("expected %#v, got %#v", expected, domains)
+	}
+	if _, err = parseDomainList(strings.NewReader("gmail.com.\n"), false); err == nil {
+		t.Error("expected an error for a trailing dot without stripTrailingDot")
+	}
+
+	_, err = parseDomainList(strings.NewReader("gmail.com\ngmail,com\n"), false)
+	if err == nil || !strings.Contains(err.Error(), `line 2: invalid domain "gmail,com"`) {
+		t.Errorf("expected invalid domain error, got %v", err)
+	}
+}
+
+// listServer serves a list of domains with an ETag, that can be changed or
+// made to fail.
+type listServer struct {
+	mu       sync.Mutex
+	list     string
+	etag     string
+	fail     bool
+	requests int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.fail {
+		http.Error(w, "oops", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.list))
+}
+
+func (s *listServer) set(list, etag string, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list, s.etag, s.fail = list, etag, fail
+}
+
+func TestRemoteList(t *testing.T) {
+	srv := &listServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	r := newRemoteList(ts.URL)
+
+	srv.set("gmail.com\n", `"v1"`, false)
+	if changed, err := r.fetch(false); err != nil || !changed {
+		t.Fatalf("expected changed list, got %v, %v", changed, err)
+	}
+	if changed, err := r.fetch(false); err != nil || changed {
+		t.Fatalf("expected unchanged list, got %v, %v", changed, err)
+	}
+	srv.set("", `"v2"`, true)
+	if _, err := r.fetch(false); err == nil {
+		t.Fatal("expected error")
+	}
+	if expected := []string{"gmail.com"}; !reflect.DeepEqual(expected, r.domains) {
+		t.Errorf("expected previous list %#v to be kept, got %#v", expected, r.domains)
+	}
+	srv.set("hotmail.fr\n", `"v2"`, false)
+	if changed, err := r.fetch(false); err != nil || !changed {
+		t.Fatalf("expected changed list, got %v, %v", changed, err)
+	}
+	if expected := []string{"hotmail.fr"}; !reflect.DeepEqual(expected, r.domains) {
+		t.Errorf("expected %#v, got %#v", expected, r.domains)
+	}
+	// A list over the limit is an error, instead of being truncated.
+	srv.set(strings.Repeat("gmail.com\n", maxRemoteListSize/10+1), `"v3"`, false)
+	if _, err := r.fetch(false); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatal("expected size error, got: ", err)
+	}
+	if expected := []string{"hotmail.fr"}; !reflect.DeepEqual(expected, r.domains) {
+		t.Errorf("expected previous list %#v to be kept, got %#v", expected, r.domains)
+	}
+	if srv.requests != 5 {
+		t.Errorf("expected 5 requests, got %d", srv.requests)
+	}
+}
+
+func TestRejectDomainsURL(t *testing.T) {
+	srv := &listServer{}
+	srv.set("# Remote list\nhotmail.fr\nyahoo.fr.\n", `"v1"`, false)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	config := `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+RejectDomains = ["gmail.com"]
+RejectDomainsURL = "` + ts.URL + `"
+`
+	// The trailing dot of the entries is stripped, as for the config.
+	for _, domain := range []string{"hotmail.fr", "yahoo.fr"} {
+		t.Run(domain, func(t *testing.T) {
+			expected := &milter.Action{
+				Code:     milter.ActReplyCode,
+				SMTPCode: 550,
+				SMTPText: "5.7.1 rejected because of DMARC failure for " + domain + " overriding policy",
+			}
+			testHeaders(t, config, []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=" + domain}, expected)
+		})
+	}
+}
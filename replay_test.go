@@ -0,0 +1,71 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/club-1/dmarcator/miltertest"
+)
+
+// TestReplay replays the milter transactions of testdata/replay, written in
+// the form of miltertest.Replay, as sent by a real MTA. Each file can also
+// contain lines of the config, prefixed by "config ", and substrings of the
+// expected log, prefixed by "log ".
+func TestReplay(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "replay", "*.milter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no transaction to replay")
+	}
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".milter"), func(t *testing.T) {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := "ListenURI = \"tcp://127.0.0.1:\"\n"
+			var logs []string
+			lines := strings.Split(string(content), "\n")
+			for i, line := range lines {
+				if rest := strings.TrimPrefix(line, "config "); rest != line {
+					config += rest + "\n"
+				} else if rest := strings.TrimPrefix(line, "log "); rest != line {
+					logs = append(logs, rest)
+				} else {
+					continue
+				}
+				// Keeps the line numbers of the script.
+				lines[i] = ""
+			}
+			network, address, out := setup(t, config)
+			session := miltertest.Session(t, network, address)
+			miltertest.Replay(t, session, strings.Join(lines, "\n"))
+			for _, expected := range logs {
+				if !waitForLog(out, expected) {
+					t.Errorf("expected contains:\n%s\nactual:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails, as SO_REUSEPORT is only supported on Linux.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("ReusePort is only supported on Linux")
+}
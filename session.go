@@ -0,0 +1,1039 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/textproto"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/emersion/go-milter"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+const (
+	fieldAuthres = 1 << iota
+	fieldFrom
+	fieldList
+	// fieldMultiFrom is set when a second From field is found.
+	fieldMultiFrom
+
+	// Keep last
+	fieldLast
+	fieldAll = fieldLast - 1
+)
+
+// wantedFields returns the fields that are needed to take a decision,
+// depending on the enabled features.
+func wantedFields() uint {
+	wanted := uint(fieldAll)
+	if !conf.SkipMailingLists {
+		wanted &^= fieldList
+	}
+	if !conf.RejectMultipleFrom {
+		wanted &^= fieldMultiFrom
+	}
+	return wanted
+}
+
+type Session struct {
+	milter.NoOpMilter
+	fieldsFound uint
+	// authresSeen is set when an Authentication-Results header field is
+	// found, trusted or not.
+	authresSeen bool
+	result      *dmarc.Result
+	headerFrom  string
+	otherFrom   string
+	listHeader  string
+	subject     string
+	override    string
+	// overrideBy is the macro or the header field of the override, as a
+	// key=value pair to be logged.
+	overrideBy string
+	start      time.Time
+	decision   Decision
+	// clientIP is the IP address of the SMTP client, and origin the one of
+	// the host that sent the message, as reported by the trusted relays.
+	clientIP   net.IP
+	origin     net.IP
+	originDone bool
+	// mailFrom is the envelope sender of the MAIL FROM stage, empty for
+	// the bounces.
+	mailFrom string
+	// owned are the names of the fields of OwnedHeaders found in the
+	// message, one per occurrence, to be removed.
+	owned []string
+	// spf is the SPF result of the first trusted Received-SPF header field,
+	// read if ReadReceivedSPF is set.
+	spf authres.ResultValue
+}
+
+// sessionPool allows to reuse the Session objects across messages, to reduce
+// the pressure on the garbage collector.
+var sessionPool = sync.Pool{
+	New: func() any { return new(Session) },
+}
+
+// newSession returns a reset Session from the pool.
+func newSession() *Session {
+	return sessionPool.Get().(*Session)
+}
+
+// reset clears all the state of the session.
+func (s *Session) reset() {
+	*s = Session{}
+}
+
+// release resets the session and returns it to the pool, so that the pooled
+// sessions do not keep the data of their last message. It must not be used
+// afterwards.
+func (s *Session) release() {
+	s.reset()
+	sessionPool.Put(s)
+}
+
+// maxHeaderSample is the maximum length of the header samples logged in debug
+// mode.
+const maxHeaderSample = 200
+
+// truncate returns s cut to at most n bytes, with "..." appended if it was
+// longer.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func (s *Session) Connect(host string, family string, port uint16, addr net.IP, m *milter.Modifier) (milter.Response, error) {
+	s.clientIP = addr
+	return milter.RespContinue, nil
+}
+
+func (s *Session) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	metricSessions.Add(1)
+	s.start = time.Now()
+	s.mailFrom = from
+	// The session is renewed for each message of a connection, so the
+	// Connect stage is only seen by the first one, the following ones get
+	// the client address added to their macros by the listener.
+	if s.clientIP == nil {
+		s.clientIP = net.ParseIP(macro(m.Macros, "{client_addr}"))
+	}
+	s.origin = s.clientIP
+	// Skip emails from trusted submitters, whatever their authentication.
+	if trustedSubmitters.contains(s.clientIP) {
+		queueID := macro(m.Macros, "i")
+		if logAccept() {
+			logDecision(queueID, "accept", fmt.Sprintf("reason=%s client_ip=%s mail_from=%q", ReasonTrustedSubmitter, s.clientIP, from))
+		}
+		metricTrustedSubmitters.Add(1)
+		countMessage(ActionAccept, "", ReasonTrustedSubmitter)
+		s.release()
+		return milter.RespAccept, nil
+	}
+	// Skip emails from authenticated clients, e.g. SASL authenticated in Postfix.
+	if user := macro(m.Macros, "{auth_authen}"); user != "" {
+		queueID := macro(m.Macros, "i")
+		if !conf.SkipAuthenticated {
+			debugf("%s: not skipping authenticated client: auth_authen=%q", queueID, user)
+			return milter.RespContinue, nil
+		}
+		debugf("%s: skipping DMARC evaluation of authenticated client: auth_authen=%q mail_from=%q", queueID, user, from)
+		metricAuthenticated.Add(1)
+		countMessage(ActionAccept, "", ReasonAuthenticated)
+		s.release()
+		return milter.RespAccept, nil
+	}
+	return milter.RespContinue, nil
+}
+
+func (s *Session) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	s.header(macro(m.Macros, "i"), name, value)
+	return milter.RespContinue, nil
+}
+
+// macro returns the value of the macro name in macros, or "" if it is not
+// defined. As MTAs differ in how they name the macros, with or without braces
+// around single-character names like "i", and with differing case, these
+// variants are tried when name is not found as is.
+func macro(macros map[string]string, name string) string {
+	if v, ok := macros[name]; ok {
+		return v
+	}
+	bare := strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+	for k, v := range macros {
+		if strings.EqualFold(strings.TrimSuffix(strings.TrimPrefix(k, "{"), "}"), bare) {
+			return v
+		}
+	}
+	return ""
+}
+
+// header records the information needed to take a decision from a single
+// header field.
+func (s *Session) header(queueID, name, value string) {
+	if debugQueueID(queueID) {
+		if decoded := decodeHeader(value); decoded != value {
+			l.Printf("%s: header %s: %q decoded=%q", queueID, name, value, decoded)
+		} else {
+			l.Printf("%s: header %s: %q", queueID, name, value)
+		}
+	}
+	if !s.originDone && strings.EqualFold(name, "Received") && trustedRelays.contains(s.origin) {
+		s.received(queueID, value)
+	}
+	authRes := isAuthResHeader(name)
+	if authRes {
+		s.authresSeen = true
+		if conf.LogUntrustedResults {
+			logUntrusted(queueID, value)
+		}
+		if s.fieldsFound&fieldAuthres != 0 && conf.MultiResultPolicy == "first" {
+			logDuplicate(queueID, value)
+		}
+	}
+	if conf.LogSubject && s.subject == "" && strings.EqualFold(name, "Subject") {
+		s.subject = sanitizeSubject(value, conf.LogSubjectLength)
+	}
+	if conf.ReadReceivedSPF && s.spf == "" && strings.EqualFold(name, "Received-SPF") {
+		s.receivedSPF(queueID, value)
+	}
+	for _, owned := range ownedHeaders() {
+		if strings.EqualFold(name, owned) {
+			s.owned = append(s.owned, owned)
+			break
+		}
+	}
+	if conf.OverrideHeader != "" && strings.EqualFold(name, conf.OverrideHeader) {
+		s.overrideHeader(queueID, value)
+	}
+	if s.fieldsFound == wantedFields() && conf.MultiResultPolicy == "first" {
+		return
+	}
+
+	if conf.SkipMailingLists && s.fieldsFound&fieldList == 0 {
+		for _, listHeader := range conf.MailingListHeaders {
+			if strings.EqualFold(name, listHeader) {
+				s.fieldsFound |= fieldList
+				s.listHeader = listHeader
+				return
+			}
+		}
+	}
+
+	if strings.EqualFold(name, "From") {
+		if s.fieldsFound&fieldFrom == 0 {
+			s.fieldsFound |= fieldFrom
+			s.headerFrom = decodeHeader(value)
+		} else if conf.RejectMultipleFrom {
+			s.fieldsFound |= fieldMultiFrom
+			s.otherFrom = decodeHeader(value)
+		}
+		return
+	}
+
+	if authRes && (s.fieldsFound&fieldAuthres == 0 || conf.MultiResultPolicy != "first") {
+		result, err := decisionConfig().ParseResult(value)
+		if err != nil {
+			// Simply log in case we can't parse an AR header, because we cannot
+			// handle it better than that.
+			l.Printf("%s: failed to parse header %s: %v", queueID, name, err)
+			debugf("%s: unparsable header sample: %q", queueID, truncate(name+": "+value, maxHeaderSample))
+			metricParseErrors.Add(1)
+			return
+		}
+
+		if result != nil {
+			debugf("%s: trusted Authentication-Results matching %q", queueID, result.Rule)
+			if lower := strings.ToLower(result.From); lower != result.From {
+				// Not an issue for the decision, but can reveal a
+				// misconfigured upstream milter.
+				metricNormalizedDomains.Add(1)
+				debugf("%s: normalized case of header.from %q to %q", queueID, result.From, lower)
+			}
+			if s.result != nil {
+				if !preferResult(s.result, result) {
+					result = s.result
+				}
+				debugf("%s: multiple DMARC results, kept the %s one dmarc=%v from=%s", queueID, conf.MultiResultPolicy, result.Value, result.From)
+			}
+			s.fieldsFound |= fieldAuthres
+			s.result = result
+		}
+	}
+}
+
+// receivedSPF records the SPF result of a Received-SPF header field, if its
+// receiver is trusted.
+func (s *Session) receivedSPF(queueID, value string) {
+	spf, err := decisionConfig().ParseSPF(value)
+	if err != nil {
+		l.Printf("%s: failed to parse header Received-SPF: %v", queueID, err)
+		debugf("%s: unparsable header sample: %q", queueID, truncate("Received-SPF: "+value, maxHeaderSample))
+		metricParseErrors.Add(1)
+		return
+	}
+	if spf == nil {
+		debugf("%s: ignoring Received-SPF of untrusted receiver or identity: %q", queueID, truncate(value, maxHeaderSample))
+		return
+	}
+	debugf("%s: trusted Received-SPF spf=%s", queueID, spf.Value)
+	s.spf = spf.Value
+}
+
+// resultSeverity orders the DMARC result values from the least to the most
+// severe, for the "worst" MultiResultPolicy.
+var resultSeverity = map[authres.ResultValue]int{
+	authres.ResultPass:      1,
+	authres.ResultNone:      2,
+	authres.ResultTempError: 3,
+	authres.ResultPermError: 4,
+	authres.ResultFail:      5,
+}
+
+// preferResult reports whether result must replace current, a DMARC result
+// found in a previous header field, according to MultiResultPolicy.
+func preferResult(current, result *dmarc.Result) bool {
+	switch conf.MultiResultPolicy {
+	case "last":
+		return true
+	case "worst":
+		return resultSeverity[result.Value] > resultSeverity[current.Value]
+	default:
+		return false
+	}
+}
+
+// debugQueueID reports whether the header fields of the message with the
+// given queue ID must be logged, according to DebugQueueIDs.
+func debugQueueID(queueID string) bool {
+	for _, id := range conf.DebugQueueIDs {
+		if id == "*" || id == queueID {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthResHeader reports whether name is one of AuthResHeaders, the names of
+// the header fields holding the authentication results.
+func isAuthResHeader(name string) bool {
+	for _, authResHeader := range conf.AuthResHeaders {
+		if strings.EqualFold(name, authResHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// logDuplicate logs the trusted DMARC result of the value of an
+// Authentication-Results header field found after the one that is used, which
+// is ignored. The first trusted field is the one added by the closest host.
+func logDuplicate(queueID, value string) {
+	id, result, err := dmarc.ParseField(value)
+	if err != nil || result == nil {
+		return
+	}
+	if _, ok := decisionConfig().MatchAuthservID(id); ok {
+		l.Printf("%s: duplicate authres for authserv=%q ignored dmarc=%v from=%s", queueID, id, result.Value, result.From)
+	}
+}
+
+// received follows the chain of trusted relays with the value of a Received
+// header field, added by the relay the message was received from. The first
+// field that does not give the address of the previous hop ends the chain.
+func (s *Session) received(queueID, value string) {
+	ip := receivedFromIP(value)
+	switch {
+	case ip == nil:
+		s.originDone = true
+	case ip.Equal(s.origin):
+		// Added by our own MTA when receiving the message from the relay.
+	default:
+		debugf("%s: trusted relay %s received the message from %s", queueID, s.origin, ip)
+		s.origin = ip
+	}
+}
+
+// logUntrusted logs in debug mode the DMARC result of the value of an
+// Authentication-Results header field if its authserv-id is not trusted, to
+// see what the other hops concluded. It is never used for the decision.
+func logUntrusted(queueID, value string) {
+	if conf.LogLevel != "debug" {
+		return
+	}
+	id, result, err := dmarc.ParseField(value)
+	if err != nil || result == nil {
+		return
+	}
+	if _, ok := decisionConfig().MatchAuthservID(id); ok {
+		return
+	}
+	debugf("%s: untrusted DMARC result authserv=%q trusted=false dmarc=%v from=%s", queueID, id, result.Value, result.From)
+}
+
+func (s *Session) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	queueID := macro(m.Macros, "i")
+	resp, delay := s.headers(queueID, m)
+	if delay > 0 {
+		// Without holding confMu, so that a reload is not blocked.
+		tarpit(queueID, delay)
+	}
+	return resp, nil
+}
+
+// headers takes the decision at the end of the header, and returns the
+// response along with the delay to wait before returning it.
+func (s *Session) headers(queueID string, m *milter.Modifier) (milter.Response, time.Duration) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	if conf.OverrideMacro != "" {
+		switch v := macro(m.Macros, conf.OverrideMacro); v {
+		case "":
+		case "accept", "reject":
+			s.override = v
+			s.overrideBy = "macro=" + conf.OverrideMacro
+		default:
+			l.Printf("%s: ignoring invalid value of macro %s: %q", queueID, conf.OverrideMacro, v)
+		}
+	}
+	s.decision = s.safeDecide(queueID)
+	resp := s.decision.Response()
+	if resp == milter.RespAccept && len(s.owned) > 0 {
+		// The owned fields can only be removed at the end of the message.
+		resp = milter.RespContinue
+	}
+	var delay time.Duration
+	if s.decision.Action == ActionReject {
+		delay = conf.RejectDelay
+	}
+	if resp != milter.RespContinue {
+		s.release()
+	}
+	return resp, delay
+}
+
+// maxRejectDelay is the maximum value of RejectDelay, below the 30s
+// milter_command_timeout of Postfix, after which it would give up on the
+// milter and apply its default action instead of the reject.
+const maxRejectDelay = 25 * time.Second
+
+// shutdown is closed when the server shuts down, to interrupt the tarpits.
+var shutdown <-chan struct{}
+
+// tarpit waits for delay before a reject is returned, to slow down the
+// abusive senders, or until the server shuts down.
+func tarpit(queueID string, delay time.Duration) {
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		l.Printf("%s: tarpit delay=%v applied before the reject", queueID, delay)
+	case <-shutdown:
+		l.Printf("%s: tarpit delay=%v interrupted by the shutdown after %v", queueID, delay, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func (s *Session) Body(m *milter.Modifier) (milter.Response, error) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	defer s.release()
+	if err := s.stripOwned(m); err != nil {
+		return nil, err
+	}
+	if err := s.decision.Apply(m); err != nil {
+		return nil, err
+	}
+	return milter.RespAccept, nil
+}
+
+// Abort resets the state of the message when the MTA aborts it, e.g. because
+// the client disconnected, as the MTA can then use the same session for the
+// next message of the connection. The client IP address is kept, as the
+// Connect stage is not sent again.
+func (s *Session) Abort(m *milter.Modifier) error {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	if queueID := macro(m.Macros, "i"); queueID != "" {
+		debugf("%s: message aborted by the MTA", queueID)
+	} else {
+		debugf("Message aborted by the MTA before its queue ID was known")
+	}
+	*s = Session{clientIP: s.clientIP}
+	return nil
+}
+
+// ownedHeaders returns the names of the header fields removed from the
+// messages: OwnedHeaders and OverrideHeader.
+func ownedHeaders() []string {
+	if conf.OverrideHeader == "" {
+		return conf.OwnedHeaders
+	}
+	for _, owned := range conf.OwnedHeaders {
+		if strings.EqualFold(owned, conf.OverrideHeader) {
+			return conf.OwnedHeaders
+		}
+	}
+	return append(conf.OwnedHeaders[:len(conf.OwnedHeaders):len(conf.OwnedHeaders)], conf.OverrideHeader)
+}
+
+// overrideHeader records the override of an OverrideHeader field, only
+// honored from the TrustedNetworks and TrustedRelays, as it could otherwise
+// be added by the sender. The field is removed from the message either way.
+func (s *Session) overrideHeader(queueID, value string) {
+	if !trustedNetworks.contains(s.clientIP) && !trustedRelays.contains(s.clientIP) {
+		l.Printf("%s: ignoring header field %s from untrusted client_ip=%s", queueID, conf.OverrideHeader, s.clientIP)
+		return
+	}
+	switch v := strings.ToLower(strings.TrimSpace(value)); v {
+	case "accept", "reject":
+		s.override = v
+		s.overrideBy = "header=" + conf.OverrideHeader
+	default:
+		l.Printf("%s: ignoring invalid value of header field %s: %q", queueID, conf.OverrideHeader, value)
+	}
+}
+
+// stripOwned removes the fields of OwnedHeaders found in the message, which
+// could have been added by a sender to spoof those of dmarcator, along with
+// the OverrideHeader fields, which are only meant for dmarcator.
+func (s *Session) stripOwned(m *milter.Modifier) error {
+	queueID := macro(m.Macros, "i")
+	for _, name := range ownedHeaders() {
+		count := 0
+		for _, owned := range s.owned {
+			if owned == name {
+				count++
+			}
+		}
+		// Remove from the last one, so that the indexes of the remaining
+		// ones do not change.
+		for i := count; i > 0; i-- {
+			if err := m.ChangeHeader(i, name, ""); err != nil {
+				return err
+			}
+		}
+		if count > 0 {
+			kind := "spoofed"
+			if strings.EqualFold(name, conf.OverrideHeader) {
+				kind = "override"
+			}
+			l.Printf("%s: stripped %s header field %s count=%d", queueID, kind, name, count)
+		}
+	}
+	return nil
+}
+
+// headerDecoder decodes the MIME encoded-words of the header fields. It is
+// never modified, so it can be shared by the sessions.
+var headerDecoder = new(mime.WordDecoder)
+
+// decodeHeader decodes the MIME encoded-words of a header field value, to be
+// logged. It falls back to the raw value if it cannot be decoded, like when
+// the charset is unknown.
+func decodeHeader(value string) string {
+	if v, err := headerDecoder.DecodeHeader(value); err == nil {
+		return v
+	}
+	return value
+}
+
+// sanitizeSubject returns the decoded value of a Subject header field, safe to
+// be logged: its control characters are replaced by spaces and it is cut to
+// at most n characters, with "..." appended if it was longer.
+func sanitizeSubject(value string, n int) string {
+	subject := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, decodeHeader(value))
+	if utf8.RuneCountInString(subject) <= n {
+		return subject
+	}
+	return string([]rune(subject)[:n]) + "..."
+}
+
+// headerFromDomain returns the domain of the address found in the From header
+// field, or an empty string if there is none.
+func (s *Session) headerFromDomain() string {
+	return addressDomain(s.headerFrom)
+}
+
+// addressDomain is like dmarc.AddressDomain, without the trailing dot of the
+// domain if StripTrailingDot is set.
+func addressDomain(address string) string {
+	domain := dmarc.AddressDomain(address)
+	if conf.StripTrailingDot {
+		domain = dmarc.TrimTrailingDot(domain)
+	}
+	return domain
+}
+
+// safeDecide is like decide, but an internal error, like a panic of one of
+// the lookups, results in InternalErrorAction instead of crashing the whole
+// milter, so that a bug does not block the mail by default.
+func (s *Session) safeDecide(queueID string) (d Decision) {
+	defer func() {
+		if err := recover(); err != nil {
+			metricInternalErrors.Add(1)
+			l.Printf("%s: Error: internal error while taking the decision, falling back to %v: %v", queueID, conf.InternalErrorAction, err)
+			debugf("%s: stack of the internal error: %q", queueID, debug.Stack())
+			d = Decision{Action: conf.InternalErrorAction, Domain: s.headerFromDomain(), Reason: ReasonInternalError}
+			countMessage(d.Action, "", d.Reason)
+			s.audit(queueID, d)
+		}
+	}()
+	return s.decide(queueID)
+}
+
+// decide takes and logs the decision for the message, based on the header
+// fields recorded so far.
+func (s *Session) decide(queueID string) Decision {
+	d, details := s.takeDecision()
+	switch d.Reason {
+	case ReasonNoTrustedAuthres, ReasonFallbackPolicy, ReasonNoRecord, ReasonFallbackError:
+		metricMissingAuthres.Add(1)
+	}
+	if s.result != nil {
+		if methods := s.result.Methods(); methods != "" {
+			details += " " + methods
+		}
+	}
+	if (d.Action == ActionReject || d.Log) && s.clientIP != nil {
+		// Allows to trace the rejects back to the connecting host.
+		details += " client_ip=" + s.clientIP.String()
+	}
+	if (d.Action == ActionReject || d.Log) && conf.LogSubject {
+		details += fmt.Sprintf(" subject=%q", s.subject)
+	}
+	if _, truncated := d.reply(); truncated {
+		l.Printf("%s: truncated the SMTP reply to MaxReplyLength=%d", queueID, conf.MaxReplyLength)
+	}
+	dur := time.Since(s.start)
+	if d.Action != ActionAccept || d.Log || logAccept() {
+		logDecision(queueID, d.actions(), fmt.Sprintf("%s dur=%.3fms", details, float64(dur)/float64(time.Millisecond)))
+	}
+	switch d.Action {
+	case ActionReject:
+		metricRejected.Add(1)
+		if d.Domain != "" {
+			rejectedDomains.add(d.Domain)
+		}
+	case ActionDefer:
+		metricDeferred.Add(1)
+	case ActionQuarantine:
+		metricQuarantined.Add(1)
+		if d.Tag {
+			metricTagged.Add(1)
+		}
+	case ActionTag:
+		metricTagged.Add(1)
+	default:
+		metricAccepted.Add(1)
+	}
+	var value authres.ResultValue
+	if s.result != nil {
+		value = s.result.Value
+	}
+	countMessage(d.Action, value, d.Reason)
+	if (value == authres.ResultFail || value == authres.ResultNone) && s.result.From != "" {
+		learnedDomains.add(strings.ToLower(s.result.From))
+	}
+	if s.authresSeen && authservCheck.observe(s.result != nil) {
+		l.Printf("Warning: none of the last %d messages with Authentication-Results header fields had a trusted authserv-id, AuthservID %q probably does not match the one of the upstream milter, so the messages are handled as without DMARC result, enable LogUntrustedResults to see their authserv-ids", conf.AuthservIDCheckMessages, conf.AuthservID)
+	}
+	observeDecisionDuration(dur)
+	s.audit(queueID, d)
+	return d
+}
+
+// logfmtTime is the layout of the time of the logfmt lines.
+const logfmtTime = "2006-01-02T15:04:05.000Z07:00"
+
+// logDecision logs the line of the decision taken for a message, made of its
+// actions followed by details in the key=value form, according to LogFormat
+// and LogFields.
+func logDecision(queueID, actions, details string) {
+	if conf.LogFormat == "logfmt" {
+		l.Print(logFields.apply(fmt.Sprintf("ts=%s queue_id=%s action=%s %s", time.Now().UTC().Format(logfmtTime), logfmtValue(queueID), actions, details)))
+		return
+	}
+	l.Printf("%s: %s %s", queueID, actions, logFields.apply(details))
+}
+
+// logField is an entry of LogFields: the key of a decision line field and the
+// name it is logged with.
+type logField struct {
+	key  string
+	name string
+}
+
+// logFieldList are the parsed LogFields.
+type logFieldList []logField
+
+// logFields are the parsed LogFields of the running config.
+var logFields logFieldList
+
+// parseLogFields parses the entries of LogFields, either a key, or a key and
+// the name to log it with, separated by "=".
+func parseLogFields(entries []string) (logFieldList, error) {
+	fields := make(logFieldList, 0, len(entries))
+	keys := make(map[string]bool, len(entries))
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		key, name, found := strings.Cut(entry, "=")
+		if !found {
+			name = key
+		}
+		if !validLogKey(key) || !validLogKey(name) {
+			return nil, fmt.Errorf("invalid entry %q, must be KEY or KEY=NAME", entry)
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate name %q", name)
+		}
+		keys[key], names[name] = true, true
+		fields = append(fields, logField{key, name})
+	}
+	return fields, nil
+}
+
+// validLogKey reports whether key can be the key of a key=value pair.
+func validLogKey(key string) bool {
+	return key != "" && strings.IndexFunc(key, needsQuote) < 0
+}
+
+// apply returns line, a list of key=value pairs separated by spaces, with the
+// pairs of the fields first, in their order and renamed, followed by the
+// other pairs, in their original order.
+func (fields logFieldList) apply(line string) string {
+	if len(fields) == 0 {
+		return line
+	}
+	pairs := splitPairs(line)
+	out := make([]string, 0, len(pairs))
+	used := make([]bool, len(pairs))
+	for _, f := range fields {
+		for i, pair := range pairs {
+			if key, value, ok := strings.Cut(pair, "="); ok && key == f.key && !used[i] {
+				out = append(out, f.name+"="+value)
+				used[i] = true
+			}
+		}
+	}
+	for i, pair := range pairs {
+		if !used[i] {
+			out = append(out, pair)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// splitPairs splits line into its key=value pairs separated by spaces, whose
+// values can be quoted strings containing spaces.
+func splitPairs(line string) []string {
+	var pairs []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return pairs
+		}
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+		if eq := strings.IndexByte(line, '='); eq >= 0 && eq < end && eq+1 < len(line) && line[eq+1] == '"' {
+			if quoted, err := strconv.QuotedPrefix(line[eq+1:]); err == nil {
+				end = eq + 1 + len(quoted)
+			}
+		}
+		pairs = append(pairs, line[:end])
+		line = line[end:]
+	}
+}
+
+// logfmtValue returns v quoted if needed to be a logfmt value.
+func logfmtValue(v string) string {
+	if strings.IndexFunc(v, needsQuote) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// needsQuote reports whether r cannot be part of an unquoted logfmt key or
+// value.
+func needsQuote(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError
+}
+
+// audit records the decision in AuditFile.
+func (s *Session) audit(queueID string, d Decision) {
+	e := auditEvent{
+		Time:       time.Now().UTC(),
+		QueueID:    queueID,
+		Action:     d.actions(),
+		Reason:     string(d.Reason),
+		FromDomain: s.headerFromDomain(),
+		HeaderFrom: s.headerFrom,
+	}
+	if s.result != nil {
+		e.DMARC = string(s.result.Value)
+	}
+	auditLog.add(e)
+}
+
+// authservCheck watches the trusted DMARC results, for
+// AuthservIDCheckMessages.
+var authservCheck authservChecker
+
+// authservChecker counts the messages with Authentication-Results header
+// fields, and those among them with a trusted DMARC result, by windows of
+// AuthservIDCheckMessages messages, to detect a wrong AuthservID, which
+// silently makes all the messages accepted.
+type authservChecker struct {
+	mu      sync.Mutex
+	seen    int
+	trusted int
+}
+
+// reset starts a new window.
+func (c *authservChecker) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen, c.trusted = 0, 0
+}
+
+// observe records a message with Authentication-Results header fields, and
+// reports whether it ends a window in which none of them was trusted.
+func (c *authservChecker) observe(trusted bool) bool {
+	if conf.AuthservIDCheckMessages == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen++
+	if trusted {
+		c.trusted++
+	}
+	if c.seen < conf.AuthservIDCheckMessages {
+		return false
+	}
+	mismatch := c.trusted == 0
+	c.seen, c.trusted = 0, 0
+	return mismatch
+}
+
+// acceptsSeen counts the accepted messages, to sample their logs, and
+// acceptsUnlogged counts those not logged since the last summary.
+var acceptsSeen, acceptsUnlogged uint64
+
+// logAccept reports whether an accepted message must be logged, according
+// to LogAccepts.
+func logAccept() bool {
+	switch conf.LogAccepts {
+	case "sampled":
+		return (atomic.AddUint64(&acceptsSeen, 1)-1)%uint64(conf.LogAcceptsRate) == 0
+	case "none":
+		return false
+	case "summary":
+		atomic.AddUint64(&acceptsUnlogged, 1)
+		return false
+	default:
+		return true
+	}
+}
+
+// logAcceptsSummary logs the number of accepted messages since the previous
+// summary, if any.
+func logAcceptsSummary() {
+	if count := atomic.SwapUint64(&acceptsUnlogged, 0); count > 0 {
+		l.Printf("Accepted %d messages since the previous summary", count)
+	}
+}
+
+// logAcceptsEvery logs the summary of the accepted messages at the given
+// interval, and a last time when done is closed.
+func logAcceptsEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logAcceptsSummary()
+		case <-done:
+			logAcceptsSummary()
+			return
+		}
+	}
+}
+
+// takeDecision returns the decision for the message, along with its details
+// to be logged.
+func (s *Session) takeDecision() (Decision, string) {
+	if s.result != nil && s.result.SPF == "" && s.spf != "" {
+		// The SPF result of Authentication-Results takes precedence.
+		s.result.SPF = s.spf
+	}
+	fromDomain := s.headerFromDomain()
+	switch s.override {
+	case "accept":
+		return Decision{Action: ActionAccept, Reason: ReasonOverride},
+			fmt.Sprintf("reason=%s %s addr=%q header_from_domain=%s", ReasonOverride, s.overrideBy, s.headerFrom, fromDomain)
+	case "reject":
+		domain := fromDomain
+		if s.result != nil {
+			domain = s.result.From
+		}
+		return Decision{Action: ActionReject, Domain: domain, Reason: ReasonOverride},
+			fmt.Sprintf("reason=%s %s addr=%q header_from_domain=%s", ReasonOverride, s.overrideBy, s.headerFrom, fromDomain)
+	}
+	if trustedNetworks.contains(s.origin) {
+		return Decision{Action: ActionAccept, Reason: ReasonTrustedNetwork},
+			fmt.Sprintf("reason=%s client_ip=%s origin_ip=%s addr=%q header_from_domain=%s", ReasonTrustedNetwork, s.clientIP, s.origin, s.headerFrom, fromDomain)
+	}
+	if s.fieldsFound&fieldMultiFrom != 0 {
+		return Decision{Action: ActionReject, Domain: fromDomain, Reason: ReasonMultipleFrom},
+			fmt.Sprintf("reason=%s addr=%q other_addr=%q header_from_domain=%s", ReasonMultipleFrom, s.headerFrom, s.otherFrom, fromDomain)
+	}
+	if conf.RejectMissingFrom && s.fieldsFound&fieldFrom == 0 {
+		return Decision{Action: ActionReject, Reason: ReasonMissingFrom, text: missingFromText}, "reason=" + string(ReasonMissingFrom)
+	}
+	if s.fieldsFound&fieldList != 0 {
+		return Decision{Action: ActionAccept, Reason: ReasonMailingList},
+			fmt.Sprintf("reason=%s list_header=%s addr=%q header_from_domain=%s", ReasonMailingList, s.listHeader, s.headerFrom, fromDomain)
+	}
+	if conf.RejectEnvelopeMismatch {
+		if d, details, ok := s.envelopeMismatch(fromDomain); ok {
+			return d, details
+		}
+	}
+	if s.result == nil && conf.FallbackDNS && fromDomain != "" {
+		if d, details, ok := fallbackDecision(s.headerFrom, fromDomain); ok {
+			return d, details
+		}
+	}
+	action, reason := dmarc.DecideResult(decisionConfig(), s.result, s.headerFrom)
+	d := Decision{Action: action, Domain: reason.Domain, Reason: reason.Code, Message: reason.Message, Tag: reason.Tag, Log: reason.Log}
+	if s.result != nil {
+		d.Result = string(s.result.Value)
+	}
+	if conf.RequireFromHeader && d.Action == ActionReject && s.result != nil && !fromConfirms(fromDomain, d.Domain) {
+		return Decision{Action: ActionAccept, Domain: d.Domain, Reason: ReasonNoFromToConfirm, Result: d.Result},
+			fmt.Sprintf("reason=%s dmarc=%v from=%s addr=%q header_from_domain=%s", ReasonNoFromToConfirm, s.result.Value, s.result.From, s.headerFrom, fromDomain)
+	}
+	return d, reason.Details
+}
+
+// fromConfirms reports whether the From header field confirms the reject of
+// domain, by being present with the same organizational domain. This is the
+// case of the rejects based on the From header field itself, with
+// RejectOnFromMismatch or MatchHeaderFromDomain.
+func fromConfirms(fromDomain, domain string) bool {
+	return fromDomain != "" && dmarc.OrgDomain(fromDomain) == dmarc.OrgDomain(domain)
+}
+
+// envelopeMismatch returns a reject decision if the organizational domain of
+// the envelope sender differs from the one of the From header field, for the
+// domains that are not accepted. The bounces, without envelope sender, are
+// exempted.
+func (s *Session) envelopeMismatch(fromDomain string) (Decision, string, bool) {
+	envDomain := addressDomain(s.mailFrom)
+	if envDomain == "" || fromDomain == "" || dmarc.OrgDomain(envDomain) == dmarc.OrgDomain(fromDomain) {
+		return Decision{}, "", false
+	}
+	if rule, ok := domainActions().MatchRule(fromDomain); !ok || rule.Action == ActionAccept {
+		return Decision{}, "", false
+	}
+	return Decision{Action: ActionReject, Domain: fromDomain, Reason: ReasonEnvelopeMismatch},
+		fmt.Sprintf("reason=%s envelope_from_domain=%s header_from_domain=%s mail_from=%q addr=%q", ReasonEnvelopeMismatch, envDomain, fromDomain, s.mailFrom, s.headerFrom), true
+}
+
+// fallbackDecision returns the decision for a message without DMARC result of
+// one of the listed domains, based on the DMARC policy published by the domain
+// of its From header field. As the message cannot be authenticated, the action
+// of the domain is taken if it publishes a reject or quarantine policy, others
+// fall back to NoAuthResultAction. If the lookup fails, the message is
+// accepted. It reports false for the domains that are not listed, or mapped to
+// "accept", which are handled as without DMARC result.
+func fallbackDecision(headerFrom, fromDomain string) (Decision, string, bool) {
+	rule, ok := domainActions().MatchRule(fromDomain)
+	if !ok || rule.Action == ActionAccept {
+		return Decision{}, "", false
+	}
+	policy, err := dmarcPolicies.lookup(fromDomain, conf.FallbackDNSTimeout)
+	if err != nil {
+		return Decision{Action: ActionAccept, Domain: fromDomain, Reason: ReasonFallbackError},
+			fmt.Sprintf("dmarc=unknown from=unknown fallback_error=%q addr=%q header_from_domain=%s", err, headerFrom, fromDomain), true
+	}
+	details := fmt.Sprintf("dmarc=unknown from=unknown fallback_policy=%s addr=%q header_from_domain=%s", policy, headerFrom, fromDomain)
+	switch policy {
+	case "reject", "quarantine":
+		return Decision{Action: rule.Action, Domain: fromDomain, Reason: ReasonFallbackPolicy, Message: rule.Message, Tag: rule.Tag, Log: rule.Log}, details, true
+	case "":
+		return Decision{Action: conf.NoAuthResultAction, Domain: fromDomain, Reason: ReasonNoRecord}, details, true
+	}
+	return Decision{Action: conf.NoAuthResultAction, Domain: fromDomain, Reason: ReasonFallbackPolicy}, details, true
+}
+
+// headerField is a field of the header of a message, as received from the
+// MTA.
+type headerField struct {
+	name  string
+	value string
+}
+
+// evaluate takes the decision for a message with the given header fields,
+// in their order in the message, using the same logic as a milter session.
+func evaluate(queueID string, fields []headerField) Decision {
+	return headerSession(queueID, fields).decide(queueID)
+}
+
+// dryEvaluate is like evaluate, but only takes the decision, without logging,
+// counting nor auditing it, and also returns its details.
+func dryEvaluate(queueID string, fields []headerField) (Decision, string) {
+	return headerSession(queueID, fields).takeDecision()
+}
+
+// headerSession returns a session that has received fields, in order.
+func headerSession(queueID string, fields []headerField) *Session {
+	s := &Session{start: time.Now()}
+	for _, f := range fields {
+		s.header(queueID, f.name, f.value)
+	}
+	return s
+}
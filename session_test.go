@@ -0,0 +1,401 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/club-1/dmarcator/dmarc"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// setupSessions configures the sessions to trust mail.club1.fr and to
+// reject gmail.com, without logs and without a milter server.
+func setupSessions(tb testing.TB) {
+	prevLogOut := l.Writer()
+	tb.Cleanup(func() { l.SetOutput(prevLogOut) })
+	l.SetOutput(io.Discard)
+	prevConf := conf
+	tb.Cleanup(func() { conf = prevConf })
+	conf.AuthservID = "mail.club1.fr"
+	prevDomains := domainActions()
+	tb.Cleanup(func() { currentDomains.Store(prevDomains) })
+	domains := dmarc.NewDomains()
+	domains.Insert("gmail.com", ActionReject)
+	currentDomains.Store(domains)
+}
+
+func TestSessionPool(t *testing.T) {
+	setupSessions(t)
+
+	// A dirty session must be cleared before going back to the pool, as
+	// the pool may hand out fresh sessions, that would hide a dirty one.
+	dirty := dirtySession()
+	dirty.release()
+	assertResetSession(t, dirty)
+
+	messages := []struct {
+		headers []string
+		action  Action
+	}{
+		{[]string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com"}, ActionReject},
+		{[]string{"From", "hello@example.com"}, ActionAccept},
+		{[]string{"Authentication-Results", "mail.club1.fr; dmarc=none header.from=gmail.com"}, ActionReject},
+		{[]string{"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com"}, ActionAccept},
+		{[]string{}, ActionAccept},
+	}
+	for i := 0; i < 100; i++ {
+		m := messages[i%len(messages)]
+		s := newSession()
+		for j := 0; j < len(m.headers); j += 2 {
+			s.header("QUEUEID", m.headers[j], m.headers[j+1])
+		}
+		if d := s.decide("QUEUEID"); d.Action != m.action {
+			t.Fatalf("message %d: expected %v, got %v", i, m.action, d.Action)
+		}
+		s.release()
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	setupSessions(t)
+	s := dirtySession()
+	s.reset()
+	assertResetSession(t, s)
+}
+
+// dirtySession returns a session with the state of a decided message.
+func dirtySession() *Session {
+	s := &Session{start: time.Now(), mailFrom: "coucou@gmail.com", spf: authres.ResultFail, owned: []string{"X-Dmarcator"}}
+	s.clientIP = net.ParseIP("192.0.2.1")
+	s.origin = s.clientIP
+	s.header("QUEUEID", "Authentication-Results", "mail.club1.fr; dmarc=fail header.from=gmail.com")
+	s.header("QUEUEID", "From", "coucou@gmail.com")
+	s.header("QUEUEID", "List-Id", "<list.example.com>")
+	s.header("QUEUEID", "Subject", "Hello")
+	s.decide("QUEUEID")
+	return s
+}
+
+// assertResetSession checks that every field of s is cleared.
+func assertResetSession(t *testing.T, s *Session) {
+	t.Helper()
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); !f.IsZero() {
+			t.Errorf("expected %s to be cleared, got %#v", v.Type().Field(i).Name, f)
+		}
+	}
+}
+
+func TestMacro(t *testing.T) {
+	cases := []struct {
+		name     string
+		macros   map[string]string
+		macro    string
+		expected string
+	}{
+		{"exact", map[string]string{"i": "QUEUEID", "{i}": "OTHER"}, "i", "QUEUEID"},
+		{"braces added", map[string]string{"{i}": "QUEUEID"}, "i", "QUEUEID"},
+		{"braces removed", map[string]string{"auth_authen": "nicolas"}, "{auth_authen}", "nicolas"},
+		{"case", map[string]string{"{Auth_Authen}": "nicolas"}, "{auth_authen}", "nicolas"},
+		{"missing", map[string]string{"j": "mail.club1.fr"}, "i", ""},
+		{"nil", nil, "i", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if v := macro(c.macros, c.macro); v != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestSanitizeSubject(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		n        int
+		expected string
+	}{
+		{"plain", "Hello world!", 80, "Hello world!"},
+		{"mime encoded", "=?ISO-8859-1?Q?Bient=F4t?=", 80, "Bientôt"},
+		{"log injection", "Hello\r\nQUEUEID: accept reason=pass", 80, "Hello  QUEUEID: accept reason=pass"},
+		{"encoded control characters", "=?UTF-8?Q?Hello=0D=0Aworld=07?=", 80, "Hello  world "},
+		{"truncated", "0123456789abcdef", 10, "0123456789..."},
+		{"truncated on characters", "ééééééééééé", 10, "éééééééééé..."},
+		{"exact length", "0123456789", 10, "0123456789"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if v := sanitizeSubject(c.value, c.n); v != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	fields, err := parseLogFields([]string{"reason", "from=sender_domain", "addr=header_from", "missing"})
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	line := `dmarc=fail from=gmail.com addr="Coucou \"a=b\" <coucou@gmail.com>" header_from_domain=gmail.com reason=domain-action dur=0.123ms`
+	expected := `reason=domain-action sender_domain=gmail.com header_from="Coucou \"a=b\" <coucou@gmail.com>" dmarc=fail header_from_domain=gmail.com dur=0.123ms`
+	if actual := fields.apply(line); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	if actual := logFieldList(nil).apply(line); actual != line {
+		t.Errorf("expected the line unchanged without fields, got:\n%s", actual)
+	}
+
+	for _, c := range []struct {
+		entries  []string
+		expected string
+	}{
+		{[]string{""}, `invalid entry "", must be KEY or KEY=NAME`},
+		{[]string{"from="}, `invalid entry "from=", must be KEY or KEY=NAME`},
+		{[]string{"from=sender domain"}, `invalid entry "from=sender domain", must be KEY or KEY=NAME`},
+		{[]string{"from=a=b"}, `invalid entry "from=a=b", must be KEY or KEY=NAME`},
+		{[]string{"from", "from=sender_domain"}, `duplicate key "from"`},
+		{[]string{"from=domain", "header_from_domain=domain"}, `duplicate name "domain"`},
+	} {
+		if _, err := parseLogFields(c.entries); err == nil || err.Error() != c.expected {
+			t.Errorf("%q: expected error %q, got %v", c.entries, c.expected, err)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"plain", "Coucou <coucou@gmail.com>", "Coucou <coucou@gmail.com>"},
+		{"q encoding", "=?ISO-8859-1?Q?Aur=E9lien_COUDERC?= <libre@coucou.fr>", "Aurélien COUDERC <libre@coucou.fr>"},
+		{"b encoding", "=?UTF-8?B?QXVyw6lsaWVu?=", "Aurélien"},
+		{"adjacent words", "=?UTF-8?Q?Bient?= =?UTF-8?Q?=C3=B4t?=", "Bientôt"},
+		{"unknown charset", "=?UTF-42?Q?Broken?= <coucou@broken.com>", "=?UTF-42?Q?Broken?= <coucou@broken.com>"},
+		{"malformed word", "=?UTF-8?X?Broken?=", "=?UTF-8?X?Broken?="},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if v := decodeHeader(c.value); v != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, v)
+			}
+		})
+	}
+}
+
+// benchMessages are the header fields of typical messages, for the
+// benchmarks of the header processing.
+var benchMessages = []struct {
+	name    string
+	headers []string
+}{
+	{"hit", []string{
+		"Received", "from mx.example.com (mx.example.com [192.0.2.1]) by mail.club1.fr (Postfix) with ESMTPS id 67A7541757",
+		"Authentication-Results", "mail.club1.fr; spf=pass smtp.mailfrom=gmail.com; dkim=pass header.d=gmail.com; dmarc=fail (p=none dis=none) header.from=gmail.com",
+		"From", "Coucou <coucou@gmail.com>",
+		"Subject", "Hello",
+	}},
+	{"miss", []string{
+		"Received", "from mx.example.com (mx.example.com [192.0.2.1]) by mail.club1.fr (Postfix) with ESMTPS id 67A7541757",
+		"Authentication-Results", "mail.club1.fr; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com; dmarc=fail (p=none dis=none) header.from=example.com",
+		"From", "Coucou <coucou@example.com>",
+		"Subject", "Hello",
+	}},
+	{"parse-error", []string{
+		"Received", "from mx.example.com (mx.example.com [192.0.2.1]) by mail.club1.fr (Postfix) with ESMTPS id 67A7541757",
+		"Authentication-Results", "mail.club1.fr; dmarc",
+		"From", "Coucou <coucou@gmail.com>",
+		"Subject", "Hello",
+	}},
+	{"mime-from", []string{
+		"Received", "from mx.example.com (mx.example.com [192.0.2.1]) by mail.club1.fr (Postfix) with ESMTPS id 67A7541757",
+		"Authentication-Results", "mail.club1.fr; dmarc=pass header.from=gmail.com",
+		"From", "=?UTF-8?Q?Fran=C3=A7ois_Coucou?= <coucou@gmail.com>",
+		"Subject", "=?UTF-8?B?SGVsbG8gd29ybGQ=?=",
+	}},
+}
+
+func BenchmarkHeader(b *testing.B) {
+	setupSessions(b)
+	for _, m := range benchMessages {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := newSession()
+				for j := 0; j < len(m.headers); j += 2 {
+					s.header("QUEUEID", m.headers[j], m.headers[j+1])
+				}
+				s.release()
+			}
+		})
+	}
+}
+
+func BenchmarkDecision(b *testing.B) {
+	setupSessions(b)
+	for _, m := range benchMessages {
+		b.Run(m.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := newSession()
+				for j := 0; j < len(m.headers); j += 2 {
+					s.header("QUEUEID", m.headers[j], m.headers[j+1])
+				}
+				s.decide("QUEUEID")
+				s.release()
+			}
+		})
+	}
+}
+
+func TestDecisionReason(t *testing.T) {
+	setupSessions(t)
+	prevNetworks := trustedNetworks
+	t.Cleanup(func() { trustedNetworks = prevNetworks })
+	networks, err := parseIPNets([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedNetworks = networks
+
+	const (
+		failAR = "mail.club1.fr; dmarc=fail header.from=gmail.com"
+		passAR = "mail.club1.fr; dmarc=pass header.from=gmail.com"
+	)
+	cases := []struct {
+		name    string
+		setup   func(s *Session)
+		headers []string
+		action  Action
+		reason  Reason
+	}{
+		{
+			name:    "dmarc fail",
+			headers: []string{"Authentication-Results", failAR, "From", "coucou@gmail.com"},
+			action:  ActionReject,
+			reason:  ReasonDomainAction,
+		},
+		{
+			name:    "dmarc pass",
+			headers: []string{"Authentication-Results", passAR, "From", "coucou@gmail.com"},
+			action:  ActionAccept,
+			reason:  ReasonPass,
+		},
+		{
+			name:    "not listed",
+			headers: []string{"Authentication-Results", "mail.club1.fr; dmarc=fail header.from=example.com", "From", "coucou@example.com"},
+			action:  ActionAccept,
+			reason:  ReasonNotListed,
+		},
+		{
+			name:    "no trusted authres",
+			headers: []string{"From", "coucou@gmail.com"},
+			action:  ActionAccept,
+			reason:  ReasonNoTrustedAuthres,
+		},
+		{
+			name:   "unknown",
+			action: ActionAccept,
+			reason: ReasonUnknown,
+		},
+		{
+			name:    "override",
+			setup:   func(s *Session) { s.override = "accept" },
+			headers: []string{"Authentication-Results", failAR},
+			action:  ActionAccept,
+			reason:  ReasonOverride,
+		},
+		{
+			name:    "trusted network",
+			setup:   func(s *Session) { s.origin = net.ParseIP("192.0.2.1") },
+			headers: []string{"Authentication-Results", failAR},
+			action:  ActionAccept,
+			reason:  ReasonTrustedNetwork,
+		},
+		{
+			name:    "multiple from",
+			setup:   func(*Session) { conf.RejectMultipleFrom = true },
+			headers: []string{"From", "coucou@example.com", "From", "coucou@gmail.com"},
+			action:  ActionReject,
+			reason:  ReasonMultipleFrom,
+		},
+		{
+			name:    "missing from",
+			setup:   func(*Session) { conf.RejectMissingFrom = true },
+			headers: []string{"Authentication-Results", passAR},
+			action:  ActionReject,
+			reason:  ReasonMissingFrom,
+		},
+		{
+			name: "mailing list",
+			setup: func(*Session) {
+				conf.SkipMailingLists = true
+				conf.MailingListHeaders = []string{"List-Id"}
+			},
+			headers: []string{"List-Id", "<list.example.com>", "Authentication-Results", failAR},
+			action:  ActionAccept,
+			reason:  ReasonMailingList,
+		},
+		{
+			name: "envelope mismatch",
+			setup: func(s *Session) {
+				conf.RejectEnvelopeMismatch = true
+				s.mailFrom = "coucou@example.com"
+			},
+			headers: []string{"Authentication-Results", passAR, "From", "coucou@gmail.com"},
+			action:  ActionReject,
+			reason:  ReasonEnvelopeMismatch,
+		},
+		{
+			name:    "no from to confirm",
+			setup:   func(*Session) { conf.RequireFromHeader = true },
+			headers: []string{"Authentication-Results", failAR},
+			action:  ActionAccept,
+			reason:  ReasonNoFromToConfirm,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prevConf := conf
+			t.Cleanup(func() { conf = prevConf })
+			s := &Session{}
+			if c.setup != nil {
+				c.setup(s)
+			}
+			for i := 0; i < len(c.headers); i += 2 {
+				s.header("QUEUEID", c.headers[i], c.headers[i+1])
+			}
+			d := s.decide("QUEUEID")
+			if d.Action != c.action {
+				t.Errorf("expected action %v, got %v", c.action, d.Action)
+			}
+			if d.Reason != c.reason {
+				t.Errorf("expected reason %q, got %q", c.reason, d.Reason)
+			}
+		})
+	}
+}
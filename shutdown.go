@@ -0,0 +1,143 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// exitForcedShutdown is the exit status of dmarcator when sessions were still
+// active at the end of ShutdownTimeout, and were closed.
+const exitForcedShutdown = 3
+
+// shutdownProgressInterval is the interval at which the number of sessions
+// still active is logged during the shutdown.
+const shutdownProgressInterval = time.Second
+
+// exit terminates the process with the given status, it is replaced by the
+// tests.
+var exit = os.Exit
+
+// sessions are the open milter connections, of all the listeners.
+var sessions sessionTracker
+
+// sessionTracker keeps track of the open connections, so that the shutdown
+// can wait for them to end.
+type sessionTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// closed is signaled when a connection is removed.
+	closed chan struct{}
+}
+
+func (t *sessionTracker) add(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+		t.closed = make(chan struct{}, 1)
+	}
+	t.conns[c] = struct{}{}
+}
+
+func (t *sessionTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	select {
+	case t.closed <- struct{}{}:
+	default:
+	}
+}
+
+// count returns the number of open connections.
+func (t *sessionTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// wait waits until all the connections are closed, logging how many are still
+// open every interval, or until ctx is done, in which case it returns the
+// error of ctx.
+func (t *sessionTracker) wait(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	t.mu.Lock()
+	if t.closed == nil {
+		t.closed = make(chan struct{}, 1)
+	}
+	closed := t.closed
+	t.mu.Unlock()
+	for {
+		n := t.count()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-closed:
+		case <-ticker.C:
+			l.Printf("Shutting down, %d sessions still active", n)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeAll closes the open connections, and returns how many there were.
+func (t *sessionTracker) closeAll() int {
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	// Close removes the connection, so it is called without the lock.
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// drainSessions waits for the active milter sessions to end, once the
+// listeners are closed, for at most ShutdownTimeout, and closes the remaining
+// ones. It reports whether all the sessions ended in time.
+func drainSessions() bool {
+	confMu.RLock()
+	timeout := conf.ShutdownTimeout
+	confMu.RUnlock()
+	start := time.Now()
+	n := sessions.count()
+	if n == 0 {
+		return true
+	}
+	l.Printf("Shutting down, %d sessions active, waiting for at most %v", n, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sessions.wait(ctx, shutdownProgressInterval); err != nil {
+		n := sessions.closeAll()
+		l.Printf("Shutdown deadline of %v exceeded, closed %d sessions still active", timeout, n)
+		return n == 0
+	}
+	l.Printf("Shutdown completed after %v, all the sessions ended", time.Since(start).Round(time.Millisecond))
+	return true
+}
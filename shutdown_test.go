@@ -0,0 +1,83 @@
+// dmarcator, a milter server to reject mails based on DMARC headers
+//
+// Copyright (C) 2025  Nicolas Peugnet <nicolas@club1.fr>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program; if not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/club-1/dmarcator/miltertest"
+)
+
+// catchExit replaces exit for the duration of the test, and returns the
+// channel receiving its status.
+func catchExit(t *testing.T) <-chan int {
+	codes := make(chan int, 1)
+	prevExit := exit
+	t.Cleanup(func() { exit = prevExit })
+	exit = func(code int) { codes <- code }
+	return codes
+}
+
+func TestShutdownDrain(t *testing.T) {
+	codes := catchExit(t)
+	network, address, out := setup(t, `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+ShutdownTimeout = "10s"
+`)
+	session := miltertest.Session(t, network, address)
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	if !waitForLog(out, "Shutting down, 1 sessions active, waiting for at most 10s") {
+		t.Fatalf("expected the shutdown to wait for the session, got:\n%s", out.String())
+	}
+	session.Close()
+	if !waitForLog(out, "Shutdown completed after ") {
+		t.Errorf("expected the shutdown to complete, got:\n%s", out.String())
+	}
+	<-mainDone
+	select {
+	case code := <-codes:
+		t.Errorf("unexpected exit with status %d", code)
+	default:
+	}
+}
+
+func TestShutdownForced(t *testing.T) {
+	codes := catchExit(t)
+	network, address, out := setup(t, `
+ListenURI = "tcp://127.0.0.1:"
+AuthservID = "mail.club1.fr"
+ShutdownTimeout = "50ms"
+`)
+	miltertest.Session(t, network, address)
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case code := <-codes:
+		if code != exitForcedShutdown {
+			t.Errorf("expected exit status %d, got %d", exitForcedShutdown, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a forced shutdown")
+	}
+	if !waitForLog(out, "Shutdown deadline of 50ms exceeded, closed 1 sessions still active") {
+		t.Errorf("expected the sessions to be closed, got:\n%s", out.String())
+	}
+	<-mainDone
+}